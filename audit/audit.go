@@ -0,0 +1,54 @@
+package audit
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// One line of the audit trail, either an HTTP request or a domain event (Event is set).
+// Never put credentials in here.
+type Record struct {
+	Time      time.Time              `json:"time"`
+	Event     string                 `json:"event,omitempty"`
+	RequestId string                 `json:"requestId,omitempty"`
+	Method    string                 `json:"method,omitempty"`
+	Path      string                 `json:"path,omitempty"`
+	Status    int                    `json:"status,omitempty"`
+	LatencyMs float64                `json:"latencyMs,omitempty"`
+	UserId    string                 `json:"userId,omitempty"`
+	AuthType  string                 `json:"authType,omitempty"`
+	ClientIP  string                 `json:"clientIp,omitempty"`
+	Data      map[string]interface{} `json:"data,omitempty"`
+}
+
+// Where records go, stdout by default. Swap it for a file, a queue...
+type Sink interface {
+	Write(rec Record)
+}
+
+var Default Sink = NewJSONSink(os.Stdout)
+
+type jsonSink struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+// One JSON object per line
+func NewJSONSink(w io.Writer) Sink {
+	return &jsonSink{enc: json.NewEncoder(w)}
+}
+
+func (s *jsonSink) Write(rec Record) {
+	if rec.Time.IsZero() {
+		rec.Time = time.Now()
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.enc.Encode(rec); err != nil {
+		log.Printf("audit: %v", err)
+	}
+}
@@ -0,0 +1,37 @@
+package audit
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestJSONSink(t *testing.T) {
+	var out bytes.Buffer
+	sink := NewJSONSink(&out)
+	at := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+
+	sink.Write(Record{Time: at, Event: "login.succeeded", Data: map[string]interface{}{"accountId": "42"}})
+	sink.Write(Record{RequestId: "req-1", Method: "GET", Path: "/forms", Status: 200})
+
+	lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("%d lines, want one per record: %s", len(lines), out.String())
+	}
+	if lines[0] != `{"time":"2024-05-01T10:00:00Z","event":"login.succeeded","data":{"accountId":"42"}}` {
+		t.Errorf("event record %s", lines[0])
+	}
+
+	var rec Record
+	if err := json.Unmarshal([]byte(lines[1]), &rec); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Time.IsZero() || time.Since(rec.Time) > time.Minute {
+		t.Errorf("time %v, want now when unset", rec.Time)
+	}
+	if rec.RequestId != "req-1" || rec.Method != "GET" || rec.Path != "/forms" || rec.Status != 200 || rec.Event != "" {
+		t.Errorf("request record %s", lines[1])
+	}
+}
@@ -0,0 +1,119 @@
+package auth
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+const minSecretLength = 32
+
+var ErrInvalidToken = errors.New("invalid token")
+
+var (
+	signingKey    []byte
+	signingMethod jwt.SigningMethod = jwt.SigningMethodHS256
+	// lifetime of tokens minted on login, JWT_TTL (default 1h)
+	TokenTTL = time.Hour
+	// lifetime of refresh tokens, REFRESH_TOKEN_TTL (default 30 days)
+	RefreshTokenTTL = 30 * 24 * time.Hour
+)
+
+type JWTClaims struct {
+	AccountId string   `json:"accountId"`
+	Username  string   `json:"username"`
+	Roles     []string `json:"roles"`
+	// granted by the account's roles, looked up on every request and never part of the token
+	Permissions []string `json:"-"`
+	jwt.RegisteredClaims
+}
+
+/*
+* InitJWT
+* Loads the signing config from env, must run once at startup after the .env file is loaded
+* JWT_SECRET: signing secret, required (min 32 bytes) when APP_ENV=production
+* JWT_ALGORITHM: HS256 (default), HS384 or HS512
+* JWT_TTL: token lifetime as a Go duration, e.g. 15m
+* REFRESH_TOKEN_TTL: refresh token lifetime, e.g. 720h
+ */
+func InitJWT() {
+	production := os.Getenv("APP_ENV") == "production"
+
+	switch alg := os.Getenv("JWT_ALGORITHM"); alg {
+	case "", "HS256":
+		signingMethod = jwt.SigningMethodHS256
+	case "HS384":
+		signingMethod = jwt.SigningMethodHS384
+	case "HS512":
+		signingMethod = jwt.SigningMethodHS512
+	default:
+		log.Fatalf("JWT_ALGORITHM %q is not supported", alg)
+	}
+
+	if ttl := os.Getenv("JWT_TTL"); ttl != "" {
+		d, err := time.ParseDuration(ttl)
+		if err != nil || d <= 0 {
+			log.Fatalf("JWT_TTL %q is not a valid duration", ttl)
+		}
+		TokenTTL = d
+	}
+	if ttl := os.Getenv("REFRESH_TOKEN_TTL"); ttl != "" {
+		d, err := time.ParseDuration(ttl)
+		if err != nil || d <= 0 {
+			log.Fatalf("REFRESH_TOKEN_TTL %q is not a valid duration", ttl)
+		}
+		RefreshTokenTTL = d
+	}
+
+	secret := os.Getenv("JWT_SECRET")
+	switch {
+	case secret == "" && production:
+		log.Fatal("JWT_SECRET is not set")
+	case secret == "":
+		// tokens won't survive a restart, fine for development
+		log.Printf("JWT_SECRET is not set, using a random secret")
+		signingKey = make([]byte, minSecretLength)
+		if _, err := rand.Read(signingKey); err != nil {
+			log.Fatal(err)
+		}
+	case len(secret) < minSecretLength && production:
+		log.Fatalf("JWT_SECRET must be at least %d bytes", minSecretLength)
+	default:
+		signingKey = []byte(secret)
+	}
+}
+
+func SigningAlgorithm() string {
+	return signingMethod.Alg()
+}
+
+// Signs the claims, IssuedAt and ExpiresAt are overwritten from ttl
+func GenerateToken(claims JWTClaims, ttl time.Duration) (string, error) {
+	if len(signingKey) == 0 {
+		return "", errors.New("jwt is not initialized")
+	}
+	now := time.Now()
+	claims.IssuedAt = jwt.NewNumericDate(now)
+	claims.ExpiresAt = jwt.NewNumericDate(now.Add(ttl))
+	return jwt.NewWithClaims(signingMethod, claims).SignedString(signingKey)
+}
+
+func ValidateToken(tokenString string) (*JWTClaims, error) {
+	var claims JWTClaims
+	token, err := jwt.ParseWithClaims(tokenString, &claims, func(t *jwt.Token) (interface{}, error) {
+		// only accept the configured algorithm, rejects "none" and algorithm switching
+		if t.Method.Alg() != signingMethod.Alg() {
+			return nil, fmt.Errorf("unexpected signing method %v", t.Header["alg"])
+		}
+		return signingKey, nil
+	})
+	if err != nil || !token.Valid {
+		return nil, ErrInvalidToken
+	}
+	return &claims, nil
+}
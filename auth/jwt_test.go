@@ -0,0 +1,84 @@
+package auth
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+func TestValidateToken(t *testing.T) {
+	signingKey = []byte(strings.Repeat("k", minSecretLength))
+	signingMethod = jwt.SigningMethodHS256
+	claims := JWTClaims{AccountId: "62f0c0a1e4b0a1b2c3d4e5f6", Username: "alice", Roles: []string{"user"}}
+
+	sign := func(method jwt.SigningMethod, key interface{}, c JWTClaims) string {
+		token, err := jwt.NewWithClaims(method, c).SignedString(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+	valid, err := GenerateToken(claims, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expired, err := GenerateToken(claims, -time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherSecret := claims
+	otherSecret.ExpiresAt = jwt.NewNumericDate(time.Now().Add(time.Hour))
+	// the signature of the valid token over a payload with more roles
+	admin := otherSecret
+	admin.Roles = []string{"admin"}
+	parts := strings.Split(valid, ".")
+	tampered := parts[0] + "." + strings.Split(sign(jwt.SigningMethodHS256, []byte("other"), admin), ".")[1] + "." + parts[2]
+
+	tests := []struct {
+		name    string
+		token   string
+		wantErr bool
+	}{
+		{"valid", valid, false},
+		{"expired", expired, true},
+		{"signed with another secret", sign(jwt.SigningMethodHS256, []byte(strings.Repeat("x", minSecretLength)), otherSecret), true},
+		{"other algorithm", sign(jwt.SigningMethodHS512, signingKey, otherSecret), true},
+		{"unsigned", sign(jwt.SigningMethodNone, jwt.UnsafeAllowNoneSignatureType, otherSecret), true},
+		{"tampered", tampered, true},
+		{"garbage", "not.a.token", true},
+		{"empty", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ValidateToken(tt.token)
+			if tt.wantErr {
+				if !errors.Is(err, ErrInvalidToken) {
+					t.Fatalf("got %v, want ErrInvalidToken", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.AccountId != claims.AccountId || got.Username != claims.Username || len(got.Roles) != 1 || got.Roles[0] != "user" {
+				t.Errorf("got claims %+v", got)
+			}
+			if got.IssuedAt == nil || got.ExpiresAt == nil || !got.ExpiresAt.After(got.IssuedAt.Time) {
+				t.Errorf("got iat %v, exp %v", got.IssuedAt, got.ExpiresAt)
+			}
+		})
+	}
+}
+
+func TestGenerateTokenNotInitialized(t *testing.T) {
+	key := signingKey
+	signingKey = nil
+	defer func() { signingKey = key }()
+
+	if _, err := GenerateToken(JWTClaims{}, time.Hour); err == nil {
+		t.Fatal("got a token without a signing key")
+	}
+}
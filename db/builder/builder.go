@@ -2,12 +2,26 @@ package builder
 
 import (
 	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
 
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
+var (
+	ErrInvalidCursor   = errors.New("invalid cursor")
+	ErrVersionConflict = errors.New("document was modified concurrently, reload it and retry")
+	ErrNoTextIndex     = errors.New("collection has no text index, declare one with EnsureTextIndex")
+)
+
+// Helpers touching the database take the context of the caller first,
+// inside db.WithTransaction that has to be the session context for them to join the transaction.
+
 type IBuilder interface {
 	Search() interface{}
 	Sort() interface{}
@@ -31,9 +45,14 @@ func SearchById(field string, id primitive.ObjectID) bson.M {
 	return bson.M{"$match": bson.M{field: id}}
 }
 
+func SearchByIds(field string, ids []primitive.ObjectID) bson.M {
+	return bson.M{"$match": bson.M{field: bson.M{"$in": ids}}}
+}
+
 // ascending 1, descending -1
-func Sort(field string, order string) bson.M {
-	return bson.M{"$sort": bson.M{field: order}}
+// ties are broken by _id so pages cut from the result are stable
+func Sort(field string, order int) bson.M {
+	return bson.M{"$sort": bson.D{{Key: field, Value: order}, {Key: "_id", Value: order}}}
 }
 
 // Skip: number of documents to skip
@@ -58,7 +77,11 @@ func Lookup(from string, localField string, foreignField string, as string) bson
 	}}
 }
 
-func Unwind(field string) bson.M {
+// preserveEmpty keeps documents whose field is missing, null or empty, e.g. a lookup without a match
+func Unwind(field string, preserveEmpty bool) bson.M {
+	if preserveEmpty {
+		return bson.M{"$unwind": bson.M{"path": "$" + field, "preserveNullAndEmptyArrays": true}}
+	}
 	return bson.M{"$unwind": "$" + field}
 }
 
@@ -78,40 +101,429 @@ func Project(fields []string) bson.M {
 	return bson.M{"$project": project}
 }
 
+/*
+* AggregatePaged
+* Runs the pipeline and returns one page of it along with the total number of documents,
+* both in a single query through $facet. Without a $sort in the pipeline the documents are
+* sorted by _id, so pages don't overlap.
+* pageStages run on the page only, after skip/limit, that's where lookups belong. They must
+* not drop documents (unwind with preserveEmpty), or the page comes up short of the total.
+ */
+func AggregatePaged[T any](ctx context.Context, collection *mongo.Collection, pipeline []bson.M, page int, limit int, pageStages ...bson.M) ([]T, int64, error) {
+	var result []struct {
+		Data  []T `bson:"data"`
+		Total []struct {
+			Count int64 `bson:"count"`
+		} `bson:"total"`
+	}
+
+	stages := make([]bson.M, 0, len(pipeline)+2)
+	stages = append(stages, pipeline...)
+	if !hasStage(pipeline, "$sort") {
+		stages = append(stages, bson.M{"$sort": bson.M{"_id": 1}})
+	}
+
+	skip, lim := Pagination(page, limit)
+	data := append([]bson.M{skip, lim}, pageStages...)
+	stages = append(stages, bson.M{"$facet": bson.M{
+		"data":  data,
+		"total": []bson.M{{"$count": "count"}},
+	}})
+
+	cursor, err := collection.Aggregate(ctx, stages)
+	if err != nil {
+		return nil, 0, err
+	}
+	if err = cursor.All(ctx, &result); err != nil {
+		return nil, 0, err
+	}
+
+	if len(result) == 0 || len(result[0].Total) == 0 {
+		return []T{}, 0, nil
+	}
+	return result[0].Data, result[0].Total[0].Count, nil
+}
+
+func hasStage(pipeline []bson.M, stage string) bool {
+	for _, s := range pipeline {
+		if _, ok := s[stage]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+* TextSearch
+* Full-text search through the collection text index, best matches first.
+* Returns ErrNoTextIndex when the collection has none.
+ */
+func TextSearch[T any](ctx context.Context, collection *mongo.Collection, query string, page int, limit int) ([]T, int64, error) {
+	aggSearch := bson.M{"$match": bson.M{"$text": bson.M{"$search": query}}}
+	// equal scores are common, _id keeps the pages stable
+	aggSort := bson.M{"$sort": bson.D{{Key: "score", Value: bson.M{"$meta": "textScore"}}, {Key: "_id", Value: 1}}}
+
+	result, total, err := AggregatePaged[T](ctx, collection, []bson.M{aggSearch, aggSort}, page, limit)
+	var serverErr mongo.ServerError
+	if errors.As(err, &serverErr) && serverErr.HasErrorCode(27) { // IndexNotFound
+		return nil, 0, ErrNoTextIndex
+	}
+	return result, total, err
+}
+
+// Creates the indexes, ones that already exist with the same spec are left as is. Returns their names.
+func EnsureIndexes(ctx context.Context, collection *mongo.Collection, models []mongo.IndexModel) ([]string, error) {
+	if len(models) == 0 {
+		return nil, nil
+	}
+	return collection.Indexes().CreateMany(ctx, models)
+}
+
+// A collection can only have one text index, it covers all given fields
+func EnsureTextIndex(ctx context.Context, collection *mongo.Collection, fields ...string) error {
+	keys := bson.D{}
+	for _, field := range fields {
+		keys = append(keys, bson.E{Key: field, Value: "text"})
+	}
+	_, err := collection.Indexes().CreateOne(ctx, mongo.IndexModel{Keys: keys})
+	return err
+}
+
 func ConvertToObjectId(id string) (primitive.ObjectID, error) {
 	return primitive.ObjectIDFromHex(id)
 }
 
-func GetAll[T any](collection *mongo.Collection) (*[]T, error) {
+func GetAll[T any](ctx context.Context, collection *mongo.Collection) (*[]T, error) {
 	var result []T
-	cursor, err := collection.Find(context.TODO(), bson.D{})
+	cursor, err := collection.Find(ctx, bson.D{})
 	if err != nil {
 		return nil, err
 	}
-	if err = cursor.All(context.TODO(), &result); err != nil {
+	if err = cursor.All(ctx, &result); err != nil {
 		return nil, err
 	}
 	return &result, nil
 }
 
-func GetById[T any](collection *mongo.Collection, pid string) (*T, error) {
+func GetById[T any](ctx context.Context, collection *mongo.Collection, pid string) (*T, error) {
 	var result T
 	id, err := ConvertToObjectId(pid)
 	if err != nil {
 		return nil, err
 	}
-	err = collection.FindOne(context.TODO(), bson.D{{"_id", id}}).Decode(&result)
+	err = collection.FindOne(ctx, bson.D{{Key: "_id", Value: id}}).Decode(&result)
 	if err != nil {
 		return nil, err
 	}
 	return &result, nil
 }
 
-func GetByField[T any](collection *mongo.Collection, field string, value interface{}) (*T, error) {
+func GetByField[T any](ctx context.Context, collection *mongo.Collection, field string, value interface{}) (*T, error) {
 	var result T
-	err := collection.FindOne(context.TODO(), bson.D{{field, value}}).Decode(&result)
+	err := collection.FindOne(ctx, bson.D{{Key: field, Value: value}}).Decode(&result)
 	if err != nil {
 		return nil, err
 	}
 	return &result, nil
 }
+
+/*
+* Projected reads
+* projection follows mongo: {"name": 1} only returns name (and _id unless "_id": 0),
+* {"password": 0} returns everything but password. Unknown fields are simply ignored.
+ */
+func GetByIdProjected[T any](ctx context.Context, collection *mongo.Collection, pid string, projection map[string]int) (*T, error) {
+	id, err := ConvertToObjectId(pid)
+	if err != nil {
+		return nil, err
+	}
+	return GetByFieldProjected[T](ctx, collection, "_id", id, projection)
+}
+
+func GetByFieldProjected[T any](ctx context.Context, collection *mongo.Collection, field string, value interface{}, projection map[string]int) (*T, error) {
+	var result T
+	err := collection.FindOne(ctx, bson.D{{Key: field, Value: value}},
+		options.FindOne().SetProjection(projection)).Decode(&result)
+	if err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+/*
+* CreateMany
+* Inserts all entities with a single unordered InsertMany, documents without an _id get one generated.
+* Returns the entities as stored, i.e. with their ids filled in, in the same order.
+* A document failing (duplicate key...) doesn't stop the others: the ones inserted are returned
+* along with an error wrapping the mongo.BulkWriteException, its WriteErrors index the failed entities.
+ */
+func CreateMany[T any](ctx context.Context, collection *mongo.Collection, entities []T) ([]T, error) {
+	if len(entities) == 0 {
+		return []T{}, nil
+	}
+
+	docs := make([]interface{}, len(entities))
+	for i := range entities {
+		// through a pointer so MarshalBSON hooks (createAt/updateAt) run
+		raw, err := bson.Marshal(&entities[i])
+		if err != nil {
+			return nil, err
+		}
+		var doc bson.D
+		if err := bson.Unmarshal(raw, &doc); err != nil {
+			return nil, err
+		}
+		docs[i] = withId(doc)
+	}
+
+	failed := map[int]bool{}
+	_, insertErr := collection.InsertMany(ctx, docs, options.InsertMany().SetOrdered(false))
+	if insertErr != nil {
+		var bulkErr mongo.BulkWriteException
+		if !errors.As(insertErr, &bulkErr) || len(bulkErr.WriteErrors) == 0 {
+			return nil, insertErr
+		}
+		for _, writeErr := range bulkErr.WriteErrors {
+			failed[writeErr.Index] = true
+		}
+		first := bulkErr.WriteErrors[0]
+		insertErr = fmt.Errorf("%d of %d documents not inserted, first at index %d: %s: %w",
+			len(bulkErr.WriteErrors), len(docs), first.Index, first.Message, insertErr)
+	}
+
+	result := make([]T, 0, len(docs)-len(failed))
+	for i, doc := range docs {
+		if failed[i] {
+			continue
+		}
+		raw, err := bson.Marshal(doc)
+		if err != nil {
+			return nil, err
+		}
+		var entity T
+		if err := bson.Unmarshal(raw, &entity); err != nil {
+			return nil, err
+		}
+		result = append(result, entity)
+	}
+	return result, insertErr
+}
+
+// Applies updates with $set to every document matching filter, returns how many were modified
+func UpdateMany(ctx context.Context, collection *mongo.Collection, filter interface{}, updates interface{}) (int64, error) {
+	rs, err := collection.UpdateMany(ctx, filter, bson.M{"$set": updates})
+	if err != nil {
+		return 0, err
+	}
+	return rs.ModifiedCount, nil
+}
+
+/*
+* UpdateVersioned
+* $sets updates only when the stored version still is expectedVersion, and bumps it.
+* Documents written before opting in have no version and match expectedVersion 0.
+* Returns the new version, ErrVersionConflict when someone else updated it first
+* and mongo.ErrNoDocuments when there is no such document.
+ */
+func UpdateVersioned(ctx context.Context, collection *mongo.Collection, pid string, updates interface{}, expectedVersion int64) (int64, error) {
+	id, err := ConvertToObjectId(pid)
+	if err != nil {
+		return 0, err
+	}
+
+	filter := bson.M{"_id": id, "version": expectedVersion}
+	if expectedVersion == 0 {
+		filter["version"] = bson.M{"$in": bson.A{0, nil}}
+	}
+	rs, err := collection.UpdateOne(ctx, filter, bson.M{
+		"$set": updates,
+		"$inc": bson.M{"version": 1},
+	})
+	if err != nil {
+		return 0, err
+	}
+	if rs.MatchedCount == 0 {
+		count, err := collection.CountDocuments(ctx, bson.M{"_id": id})
+		if err != nil {
+			return 0, err
+		}
+		if count == 0 {
+			return 0, mongo.ErrNoDocuments
+		}
+		return 0, ErrVersionConflict
+	}
+	return expectedVersion + 1, nil
+}
+
+// Gives doc a generated _id when it has none, or a zero ObjectID from an _id tag without omitempty
+func withId(doc bson.D) bson.D {
+	for i, e := range doc {
+		if e.Key == "_id" {
+			if id, ok := e.Value.(primitive.ObjectID); ok && id.IsZero() {
+				doc[i].Value = primitive.NewObjectID()
+			}
+			return doc
+		}
+	}
+	return append(bson.D{{Key: "_id", Value: primitive.NewObjectID()}}, doc...)
+}
+
+type CursorListOptions struct {
+	Filter    bson.M
+	SortField string // stable, ascending sort key present on every document, ties are broken by _id (default _id)
+	Limit     int
+	Cursor    string // opaque token from a previous page, empty for the first page
+	Backward  bool   // return the page before Cursor instead of the one after it
+	// same as the projected reads, _id and SortField are always kept as the cursor needs them
+	Projection map[string]int
+	// run on the page only, like the pageStages of AggregatePaged; must keep _id and SortField
+	PageStages []bson.M
+}
+
+type CursorListResult[T any] struct {
+	Data       []T    `json:"data"`
+	NextCursor string `json:"nextCursor,omitempty"`
+	PrevCursor string `json:"prevCursor,omitempty"`
+}
+
+type pageCursor struct {
+	Value bson.RawValue `bson:"v"`
+	Id    bson.RawValue `bson:"id"`
+}
+
+/*
+* ListCursor
+* Keyset pagination: pages are cut with a range filter on (SortField, _id) instead of $skip,
+* so they stay fast on big collections and don't shift when documents are inserted meanwhile.
+* Use the returned NextCursor/PrevCursor as Cursor (with Backward for PrevCursor) to move around.
+ */
+func ListCursor[T any](ctx context.Context, collection *mongo.Collection, opts CursorListOptions) (*CursorListResult[T], error) {
+	field := opts.SortField
+	if field == "" {
+		field = "_id"
+	}
+	limit := opts.Limit
+	if limit < 1 {
+		limit = 20
+	}
+
+	dir, op := 1, "$gt"
+	if opts.Backward {
+		dir, op = -1, "$lt"
+	}
+
+	filter := bson.M{}
+	for k, v := range opts.Filter {
+		filter[k] = v
+	}
+	if opts.Cursor != "" {
+		c, err := decodeCursor(opts.Cursor)
+		if err != nil {
+			return nil, err
+		}
+		after := bson.M{"_id": bson.M{op: c.Id}}
+		if field != "_id" {
+			after = bson.M{"$or": []bson.M{
+				{field: bson.M{op: c.Value}},
+				{field: c.Value, "_id": bson.M{op: c.Id}},
+			}}
+		}
+		filter = bson.M{"$and": []bson.M{filter, after}}
+	}
+
+	sort := bson.D{{Key: field, Value: dir}}
+	if field != "_id" {
+		sort = append(sort, bson.E{Key: "_id", Value: dir})
+	}
+
+	// one extra document tells whether there is a page after this one
+	stages := []bson.M{{"$match": filter}, {"$sort": sort}, {"$limit": limit + 1}}
+	if len(opts.Projection) > 0 {
+		stages = append(stages, bson.M{"$project": cursorProjection(opts.Projection, field)})
+	}
+	stages = append(stages, opts.PageStages...)
+	cursor, err := collection.Aggregate(ctx, stages)
+	if err != nil {
+		return nil, err
+	}
+	var raws []bson.Raw
+	if err = cursor.All(ctx, &raws); err != nil {
+		return nil, err
+	}
+
+	hasMore := len(raws) > limit
+	if hasMore {
+		raws = raws[:limit]
+	}
+	if opts.Backward {
+		for i, j := 0, len(raws)-1; i < j; i, j = i+1, j-1 {
+			raws[i], raws[j] = raws[j], raws[i]
+		}
+	}
+
+	result := &CursorListResult[T]{Data: make([]T, len(raws))}
+	for i, raw := range raws {
+		if err := bson.Unmarshal(raw, &result.Data[i]); err != nil {
+			return nil, err
+		}
+	}
+	if len(raws) == 0 {
+		return result, nil
+	}
+
+	if hasMore && !opts.Backward || opts.Backward && opts.Cursor != "" {
+		if result.NextCursor, err = encodeCursor(raws[len(raws)-1], field); err != nil {
+			return nil, err
+		}
+	}
+	if hasMore && opts.Backward || !opts.Backward && opts.Cursor != "" {
+		if result.PrevCursor, err = encodeCursor(raws[0], field); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+func cursorProjection(projection map[string]int, field string) map[string]int {
+	p := map[string]int{}
+	inclusive := false
+	for k, v := range projection {
+		p[k] = v
+		if v == 1 && k != "_id" {
+			inclusive = true
+		}
+	}
+	if inclusive {
+		p[field] = 1
+		p["_id"] = 1
+	} else {
+		delete(p, field)
+		delete(p, "_id")
+	}
+	return p
+}
+
+func encodeCursor(doc bson.Raw, field string) (string, error) {
+	value, err := doc.LookupErr(strings.Split(field, ".")...)
+	if err != nil {
+		return "", fmt.Errorf("sort field %s missing from document: %w", field, err)
+	}
+	raw, err := bson.Marshal(pageCursor{Value: value, Id: doc.Lookup("_id")})
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(raw), nil
+}
+
+func decodeCursor(token string) (*pageCursor, error) {
+	var c pageCursor
+	raw, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	// a token that decodes but isn't one of ours would turn into a bogus filter
+	if err := bson.Unmarshal(raw, &c); err != nil || c.Value.Type == 0 || c.Id.Type == 0 {
+		return nil, ErrInvalidCursor
+	}
+	return &c, nil
+}
@@ -0,0 +1,479 @@
+package builder
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"reflect"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+// The queries run against the driver's mock deployment: every test queues the replies
+// of the commands it expects, in order.
+
+var mockDB = mtest.NewOptions().ClientType(mtest.Mock)
+
+type scored struct {
+	Id    primitive.ObjectID `bson:"_id"`
+	Score int                `bson:"score"`
+}
+
+func cursorReply(t testing.TB, docs ...interface{}) bson.D {
+	t.Helper()
+	batch := make([]bson.D, 0, len(docs))
+	for _, doc := range docs {
+		raw, err := bson.Marshal(doc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var d bson.D
+		if err := bson.Unmarshal(raw, &d); err != nil {
+			t.Fatal(err)
+		}
+		batch = append(batch, d)
+	}
+	return mtest.CreateCursorResponse(0, "test.coll", mtest.FirstBatch, batch...)
+}
+
+func mustCursor(t testing.TB, doc interface{}, field string) string {
+	t.Helper()
+	raw, err := bson.Marshal(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := encodeCursor(raw, field)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestCursorRoundTrip(t *testing.T) {
+	id := primitive.NewObjectID()
+	tests := []struct {
+		name  string
+		doc   interface{}
+		field string
+		want  interface{}
+	}{
+		{"_id", bson.M{"_id": id}, "_id", id},
+		{"int", bson.M{"_id": id, "score": 7}, "score", int32(7)},
+		{"string", bson.M{"_id": id, "name": "alice"}, "name", "alice"},
+		{"nested", bson.M{"_id": id, "meta": bson.M{"rank": 2.5}}, "meta.rank", 2.5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := decodeCursor(mustCursor(t, tt.doc, tt.field))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if c.Id.ObjectID() != id {
+				t.Errorf("id %v, want %s", c.Id, id.Hex())
+			}
+			var value interface{}
+			if err := c.Value.Unmarshal(&value); err != nil {
+				t.Fatal(err)
+			}
+			if value != tt.want {
+				t.Errorf("value %v (%T), want %v (%T)", value, value, tt.want, tt.want)
+			}
+		})
+	}
+
+	t.Run("sort field missing", func(t *testing.T) {
+		raw, _ := bson.Marshal(bson.M{"_id": id})
+		if _, err := encodeCursor(raw, "score"); err == nil {
+			t.Error("want an error")
+		}
+	})
+}
+
+func TestDecodeCursorTampered(t *testing.T) {
+	valid := mustCursor(t, bson.M{"_id": primitive.NewObjectID(), "score": 1}, "score")
+	raw, _ := base64.RawURLEncoding.DecodeString(valid)
+	otherDoc, _ := bson.Marshal(bson.M{"admin": true})
+	noId, _ := bson.Marshal(bson.M{"v": 1})
+
+	tests := []struct {
+		name  string
+		token string
+	}{
+		{"not base64", "%%%"},
+		{"padded base64", base64.URLEncoding.EncodeToString(raw)},
+		{"truncated", base64.RawURLEncoding.EncodeToString(raw[:len(raw)-3])},
+		{"flipped length", base64.RawURLEncoding.EncodeToString(append([]byte{raw[0] + 1}, raw[1:]...))},
+		{"other document", base64.RawURLEncoding.EncodeToString(otherDoc)},
+		{"no id", base64.RawURLEncoding.EncodeToString(noId)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := decodeCursor(tt.token); !errors.Is(err, ErrInvalidCursor) {
+				t.Errorf("err %v, want ErrInvalidCursor", err)
+			}
+		})
+	}
+}
+
+func TestListCursor(t *testing.T) {
+	mt := mtest.New(t, mockDB)
+	defer mt.Close()
+
+	ids := make([]primitive.ObjectID, 4)
+	for i := range ids {
+		ids[i] = primitive.NewObjectID()
+	}
+	// the first three tie on score, only _id tells them apart
+	docs := []scored{{ids[0], 5}, {ids[1], 5}, {ids[2], 5}, {ids[3], 9}}
+
+	tests := []struct {
+		name       string
+		opts       CursorListOptions
+		reply      []interface{}
+		wantFilter bson.M
+		wantSort   bson.D
+		wantIds    []primitive.ObjectID
+		wantNext   *scored
+		wantPrev   *scored
+	}{
+		{
+			name:       "first page",
+			opts:       CursorListOptions{SortField: "score", Limit: 2},
+			reply:      []interface{}{docs[0], docs[1], docs[2]},
+			wantFilter: bson.M{},
+			wantSort:   bson.D{{Key: "score", Value: int32(1)}, {Key: "_id", Value: int32(1)}},
+			wantIds:    ids[:2],
+			wantNext:   &docs[1],
+		},
+		{
+			name:  "next page within a tie",
+			opts:  CursorListOptions{SortField: "score", Limit: 2, Cursor: mustCursor(t, docs[1], "score")},
+			reply: []interface{}{docs[2], docs[3]},
+			wantFilter: bson.M{"$and": bson.A{bson.M{}, bson.M{"$or": bson.A{
+				bson.M{"score": bson.M{"$gt": int32(5)}},
+				bson.M{"score": int32(5), "_id": bson.M{"$gt": ids[1]}},
+			}}}},
+			wantSort: bson.D{{Key: "score", Value: int32(1)}, {Key: "_id", Value: int32(1)}},
+			wantIds:  ids[2:],
+			wantPrev: &docs[2],
+		},
+		{
+			name: "previous page within a tie",
+			opts: CursorListOptions{SortField: "score", Limit: 2, Cursor: mustCursor(t, docs[2], "score"), Backward: true},
+			// newest first, the page comes back in sort order
+			reply: []interface{}{docs[1], docs[0]},
+			wantFilter: bson.M{"$and": bson.A{bson.M{}, bson.M{"$or": bson.A{
+				bson.M{"score": bson.M{"$lt": int32(5)}},
+				bson.M{"score": int32(5), "_id": bson.M{"$lt": ids[2]}},
+			}}}},
+			wantSort: bson.D{{Key: "score", Value: int32(-1)}, {Key: "_id", Value: int32(-1)}},
+			wantIds:  ids[:2],
+			wantNext: &docs[1],
+		},
+		{
+			name:       "by _id",
+			opts:       CursorListOptions{Limit: 3, Cursor: mustCursor(t, docs[0], "_id")},
+			reply:      []interface{}{docs[1], docs[2], docs[3]},
+			wantFilter: bson.M{"$and": bson.A{bson.M{}, bson.M{"_id": bson.M{"$gt": ids[0]}}}},
+			wantSort:   bson.D{{Key: "_id", Value: int32(1)}},
+			wantIds:    ids[1:],
+			wantPrev:   &docs[1],
+		},
+	}
+	for _, tt := range tests {
+		mt.Run(tt.name, func(mt *mtest.T) {
+			t := mt.T
+			mt.AddMockResponses(cursorReply(t, tt.reply...))
+
+			rs, err := ListCursor[scored](context.Background(), mt.Coll, tt.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var sent struct {
+				Pipeline []bson.Raw `bson:"pipeline"`
+			}
+			if err := bson.Unmarshal(mt.GetStartedEvent().Command, &sent); err != nil {
+				t.Fatal(err)
+			}
+			var match struct {
+				Filter bson.M `bson:"$match"`
+			}
+			var sort struct {
+				Sort bson.D `bson:"$sort"`
+			}
+			var limit struct {
+				Limit int32 `bson:"$limit"`
+			}
+			bson.Unmarshal(sent.Pipeline[0], &match)
+			bson.Unmarshal(sent.Pipeline[1], &sort)
+			bson.Unmarshal(sent.Pipeline[2], &limit)
+			if !reflect.DeepEqual(match.Filter, tt.wantFilter) {
+				t.Errorf("filter %v, want %v", match.Filter, tt.wantFilter)
+			}
+			if !reflect.DeepEqual(sort.Sort, tt.wantSort) {
+				t.Errorf("sort %v, want %v", sort.Sort, tt.wantSort)
+			}
+			if int(limit.Limit) != tt.opts.Limit+1 {
+				t.Errorf("limit %d, want %d", limit.Limit, tt.opts.Limit+1)
+			}
+
+			if len(rs.Data) != len(tt.wantIds) {
+				t.Fatalf("got %d documents, want %d", len(rs.Data), len(tt.wantIds))
+			}
+			for i, id := range tt.wantIds {
+				if rs.Data[i].Id != id {
+					t.Errorf("document %d is %s, want %s", i, rs.Data[i].Id.Hex(), id.Hex())
+				}
+			}
+			checkCursor(t, "next", rs.NextCursor, tt.wantNext, tt.opts.SortField)
+			checkCursor(t, "prev", rs.PrevCursor, tt.wantPrev, tt.opts.SortField)
+		})
+	}
+
+	mt.Run("invalid cursor", func(mt *mtest.T) {
+		t := mt.T
+		_, err := ListCursor[scored](context.Background(), mt.Coll, CursorListOptions{Cursor: "not-a-cursor"})
+		if !errors.Is(err, ErrInvalidCursor) {
+			t.Errorf("err %v, want ErrInvalidCursor", err)
+		}
+		if events := mt.GetAllStartedEvents(); len(events) != 0 {
+			t.Errorf("sent %d commands, want none", len(events))
+		}
+	})
+}
+
+// Pages must not overlap or leave gaps: walking forward with NextCursor visits every document once
+func TestListCursorWalk(t *testing.T) {
+	mt := mtest.New(t, mockDB)
+	defer mt.Close()
+
+	docs := make([]scored, 5)
+	for i := range docs {
+		docs[i] = scored{primitive.NewObjectID(), i / 2}
+	}
+
+	mt.Run("forward", func(mt *mtest.T) {
+		t := mt.T
+		var seen []primitive.ObjectID
+		opts := CursorListOptions{SortField: "score", Limit: 2}
+		for start := 0; ; start += 2 {
+			// what the server returns for a range filter starting right after the cursor
+			end := start + 3
+			if end > len(docs) {
+				end = len(docs)
+			}
+			page := make([]interface{}, 0, 3)
+			for _, d := range docs[start:end] {
+				page = append(page, d)
+			}
+			mt.AddMockResponses(cursorReply(t, page...))
+
+			rs, err := ListCursor[scored](context.Background(), mt.Coll, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, d := range rs.Data {
+				seen = append(seen, d.Id)
+			}
+			if rs.NextCursor == "" {
+				break
+			}
+			c, _ := decodeCursor(rs.NextCursor)
+			if last := rs.Data[len(rs.Data)-1]; c.Id.ObjectID() != last.Id {
+				t.Fatalf("next cursor points at %v, want the last document %s", c.Id, last.Id.Hex())
+			}
+			opts.Cursor = rs.NextCursor
+		}
+		if len(seen) != len(docs) {
+			t.Fatalf("visited %d documents, want %d", len(seen), len(docs))
+		}
+		for i, d := range docs {
+			if seen[i] != d.Id {
+				t.Errorf("document %d is %s, want %s", i, seen[i].Hex(), d.Id.Hex())
+			}
+		}
+	})
+}
+
+func checkCursor(t testing.TB, name string, token string, want *scored, field string) {
+	t.Helper()
+	if want == nil {
+		if token != "" {
+			t.Errorf("%s cursor %q, want none", name, token)
+		}
+		return
+	}
+	if field == "" {
+		field = "_id"
+	}
+	if token != mustCursor(t, want, field) {
+		t.Errorf("%s cursor does not point at %s", name, want.Id.Hex())
+	}
+}
+
+func TestCreateMany(t *testing.T) {
+	mt := mtest.New(t, mockDB)
+	defer mt.Close()
+
+	given := primitive.NewObjectID()
+	batch := func() []scored {
+		return []scored{{Score: 1}, {Id: given, Score: 2}, {Score: 3}}
+	}
+
+	mt.Run("empty", func(mt *mtest.T) {
+		t := mt.T
+		rs, err := CreateMany(context.Background(), mt.Coll, []scored{})
+		if err != nil || len(rs) != 0 {
+			t.Fatalf("got %v, %v, want nothing", rs, err)
+		}
+		if events := mt.GetAllStartedEvents(); len(events) != 0 {
+			t.Errorf("sent %d commands, want none", len(events))
+		}
+	})
+
+	mt.Run("ids filled in", func(mt *mtest.T) {
+		t := mt.T
+		mt.AddMockResponses(mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 3}))
+
+		rs, err := CreateMany(context.Background(), mt.Coll, batch())
+		if err != nil {
+			t.Fatal(err)
+		}
+		sent := mt.GetStartedEvent().Command
+		if ordered, ok := sent.Lookup("ordered").BooleanOK(); !ok || ordered {
+			t.Errorf("ordered %v, want false", sent.Lookup("ordered"))
+		}
+		stored, _ := sent.Lookup("documents").Array().Values()
+		if len(rs) != 3 || len(stored) != 3 {
+			t.Fatalf("got %d entities for %d documents, want 3", len(rs), len(stored))
+		}
+		for i, entity := range rs {
+			if entity.Id.IsZero() {
+				t.Errorf("entity %d has no id", i)
+			}
+			if id := stored[i].Document().Lookup("_id").ObjectID(); id != entity.Id {
+				t.Errorf("entity %d has id %s, stored as %s", i, entity.Id.Hex(), id.Hex())
+			}
+			if entity.Score != i+1 {
+				t.Errorf("entity %d has score %d, want %d", i, entity.Score, i+1)
+			}
+		}
+		if rs[1].Id != given {
+			t.Errorf("given id replaced by %s", rs[1].Id.Hex())
+		}
+	})
+
+	mt.Run("partial failure", func(mt *mtest.T) {
+		t := mt.T
+		// unordered: the document after the failing one is still inserted
+		mt.AddMockResponses(mtest.CreateWriteErrorsResponse(
+			mtest.WriteError{Index: 1, Code: 11000, Message: "E11000 duplicate key error"}))
+
+		rs, err := CreateMany(context.Background(), mt.Coll, batch())
+		var bulkErr mongo.BulkWriteException
+		if !errors.As(err, &bulkErr) || len(bulkErr.WriteErrors) != 1 || bulkErr.WriteErrors[0].Index != 1 {
+			t.Fatalf("err %v, want a bulk write error at index 1", err)
+		}
+		if len(rs) != 2 || rs[0].Score != 1 || rs[1].Score != 3 {
+			t.Fatalf("got %+v, want the first and last entity", rs)
+		}
+		if rs[0].Id.IsZero() || rs[1].Id.IsZero() {
+			t.Errorf("inserted entities without id: %+v", rs)
+		}
+	})
+
+	mt.Run("command error", func(mt *mtest.T) {
+		t := mt.T
+		mt.AddMockResponses(mtest.CreateCommandErrorResponse(mtest.CommandError{Code: 13, Name: "Unauthorized", Message: "not authorized"}))
+
+		rs, err := CreateMany(context.Background(), mt.Coll, batch())
+		if err == nil || rs != nil {
+			t.Errorf("got %v, %v, want only an error", rs, err)
+		}
+	})
+}
+
+func TestUpdateMany(t *testing.T) {
+	mt := mtest.New(t, mockDB)
+	defer mt.Close()
+
+	mt.Run("sets the fields", func(mt *mtest.T) {
+		t := mt.T
+		mt.AddMockResponses(mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 3}, bson.E{Key: "nModified", Value: 2}))
+
+		modified, err := UpdateMany(context.Background(), mt.Coll, bson.M{"score": 5}, bson.M{"score": 6})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if modified != 2 {
+			t.Errorf("modified %d, want 2", modified)
+		}
+		update := mt.GetStartedEvent().Command.Lookup("updates").Array().Index(0).Value().Document()
+		if multi, _ := update.Lookup("multi").BooleanOK(); !multi {
+			t.Error("not sent as a multi update")
+		}
+		if score := update.Lookup("u", "$set", "score").Int32(); score != 6 {
+			t.Errorf("$set score %d, want 6", score)
+		}
+	})
+}
+
+func TestUpdateVersioned(t *testing.T) {
+	mt := mtest.New(t, mockDB)
+	defer mt.Close()
+
+	id := primitive.NewObjectID()
+	updated := mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}, bson.E{Key: "nModified", Value: 1})
+	missed := mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 0}, bson.E{Key: "nModified", Value: 0})
+	exists := mtest.CreateCursorResponse(0, "test.coll", mtest.FirstBatch, bson.D{{Key: "_id", Value: 1}, {Key: "n", Value: 1}})
+	gone := mtest.CreateCursorResponse(0, "test.coll", mtest.FirstBatch)
+
+	tests := []struct {
+		name        string
+		expected    int64
+		replies     []bson.D
+		wantVersion int64
+		wantErr     error
+		wantFilter  interface{}
+	}{
+		{"fresh version", 3, []bson.D{updated}, 4, nil, int64(3)},
+		{"stale version", 2, []bson.D{missed, exists}, 0, ErrVersionConflict, int64(2)},
+		{"no such document", 3, []bson.D{missed, gone}, 0, mongo.ErrNoDocuments, int64(3)},
+		// written before the collection used versions
+		{"no version yet", 0, []bson.D{updated}, 1, nil, bson.M{"$in": bson.A{int32(0), nil}}},
+	}
+	for _, tt := range tests {
+		mt.Run(tt.name, func(mt *mtest.T) {
+			t := mt.T
+			mt.AddMockResponses(tt.replies...)
+
+			version, err := UpdateVersioned(context.Background(), mt.Coll, id.Hex(), bson.M{"score": 9}, tt.expected)
+			if !errors.Is(err, tt.wantErr) || version != tt.wantVersion {
+				t.Fatalf("got %d, %v, want %d, %v", version, err, tt.wantVersion, tt.wantErr)
+			}
+
+			var update struct {
+				Updates []struct {
+					Filter bson.M `bson:"q"`
+					Update bson.M `bson:"u"`
+				} `bson:"updates"`
+			}
+			if err := bson.Unmarshal(mt.GetStartedEvent().Command, &update); err != nil {
+				t.Fatal(err)
+			}
+			sent := update.Updates[0]
+			if sent.Filter["_id"] != id || !reflect.DeepEqual(sent.Filter["version"], tt.wantFilter) {
+				t.Errorf("filter %v, want _id %s and version %v", sent.Filter, id.Hex(), tt.wantFilter)
+			}
+			want := bson.M{"$set": bson.M{"score": int32(9)}, "$inc": bson.M{"version": int32(1)}}
+			if !reflect.DeepEqual(sent.Update, want) {
+				t.Errorf("update %v, want %v", sent.Update, want)
+			}
+		})
+	}
+}
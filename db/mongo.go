@@ -4,22 +4,110 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"main/db/builder"
+	"net/url"
 	"os"
+	"time"
 
 	"github.com/joho/godotenv"
+	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 	"go.mongodb.org/mongo-driver/mongo/readpref"
 )
 
+const DatabaseName = "surveyDB"
+
 var (
 	MongoClient   *mongo.Client
 	MongoDatabase *mongo.Database
+	// upper bound of a single database operation, DB_TIMEOUT (default 10s)
+	Timeout = 10 * time.Second
 )
 
+// Bounds a database operation, parent should be the request context so aborted requests cancel it
+func WithTimeout(parent context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(parent, Timeout)
+}
+
 func InitConnection() {
 	MongoClient = GetMongoEnv()
-	MongoDatabase = MongoClient.Database("surveyDB")
+	MongoDatabase = MongoClient.Database(DatabaseName)
+	ensureIndexes()
+}
+
+// Unique constraints the services rely on, plus indexes for the common lookups
+func ensureIndexes() {
+	indexes := map[string][]mongo.IndexModel{
+		"account": {
+			{Keys: bson.D{{Key: "username", Value: 1}}, Options: options.Index().SetUnique(true)},
+		},
+		"user": {
+			// users without an email don't take part in the uniqueness
+			{Keys: bson.D{{Key: "email", Value: 1}}, Options: options.Index().SetUnique(true).
+				SetPartialFilterExpression(bson.M{"email": bson.M{"$type": "string", "$gt": ""}})},
+			{Keys: bson.D{{Key: "accountId", Value: 1}}},
+			{Keys: bson.D{{Key: "fullName", Value: "text"}, {Key: "email", Value: "text"}}},
+		},
+		"project": {
+			{Keys: bson.D{{Key: "createBy", Value: 1}}},
+			{Keys: bson.D{{Key: "participants", Value: 1}}},
+		},
+		"formResponse": {
+			{Keys: bson.D{{Key: "formId", Value: 1}, {Key: "submittedAt", Value: -1}}},
+		},
+		"apiKey": {
+			{Keys: bson.D{{Key: "keyHash", Value: 1}}, Options: options.Index().SetUnique(true)},
+		},
+		"refreshToken": {
+			{Keys: bson.D{{Key: "tokenHash", Value: 1}}, Options: options.Index().SetUnique(true)},
+			{Keys: bson.D{{Key: "accountId", Value: 1}}},
+			// mongo drops expired tokens by itself
+			{Keys: bson.D{{Key: "expiresAt", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(0)},
+		},
+		"role": {
+			{Keys: bson.D{{Key: "name", Value: 1}}, Options: options.Index().SetUnique(true)},
+		},
+	}
+
+	for collection, models := range indexes {
+		ctx, cancel := WithTimeout(context.Background())
+		names, err := builder.EnsureIndexes(ctx, MongoDatabase.Collection(collection), models)
+		cancel()
+		if err != nil {
+			// most likely existing duplicates breaking a unique index, they have to be cleaned up first
+			log.Fatalf("Cannot create indexes on %s: %v", collection, err)
+		}
+		log.Printf("Indexes on %s: %v", collection, names)
+	}
+}
+
+// Only keeps scheme and host, credentials and options may hold secrets
+func RedactURI(uri string) string {
+	u, err := url.Parse(uri)
+	if err != nil || u.Host == "" {
+		return "<invalid uri>"
+	}
+	return u.Scheme + "://" + u.Host
+}
+
+/*
+* WithTransaction
+* Runs fn inside a transaction, committed when fn returns nil and aborted otherwise.
+* Only operations given sc as their context join the transaction, so every collection call
+* and builder helper inside fn must get sc, never context.TODO() or the outer ctx.
+ */
+func WithTransaction(ctx context.Context, fn func(sc mongo.SessionContext) error) error {
+	session, err := MongoClient.StartSession()
+	if err != nil {
+		return err
+	}
+	defer session.EndSession(ctx)
+
+	_, err = session.WithTransaction(ctx, func(sc mongo.SessionContext) (interface{}, error) {
+		return nil, fn(sc)
+	})
+	return err
 }
 
 func GetMongoEnv() *mongo.Client {
@@ -27,20 +115,30 @@ func GetMongoEnv() *mongo.Client {
 		log.Printf("No .env file found")
 	}
 
+	if timeout := os.Getenv("DB_TIMEOUT"); timeout != "" {
+		d, err := time.ParseDuration(timeout)
+		if err != nil || d <= 0 {
+			log.Fatalf("DB_TIMEOUT %q is not a valid duration", timeout)
+		}
+		Timeout = d
+	}
+
 	uri := os.Getenv("MONGODB_URI")
 
 	if uri == "" {
 		log.Fatal("MONGODB_URI is not set")
 	}
 
-	// The hell is TODO? Why TODO? WTF GO????
-	client, err := mongo.Connect(context.TODO(), options.Client().ApplyURI(uri))
+	ctx, cancel := WithTimeout(context.Background())
+	defer cancel()
+
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(uri))
 	if err != nil {
 		log.Fatalln("Cannot connect to mongodb")
 		log.Fatal(err)
 	}
 
-	if err := client.Ping(context.TODO(), readpref.Primary()); err != nil {
+	if err := client.Ping(ctx, readpref.Primary()); err != nil {
 		// Can't connect to Mongo
 		log.Fatal(err)
 	}
@@ -0,0 +1,59 @@
+package event
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// In-process pub/sub so handlers can hand side effects (audit, metrics, webhooks...) off the request path
+
+type Type string
+
+const (
+	LoginSucceeded Type = "login.succeeded"
+	LoginFailed    Type = "login.failed"
+	Registered     Type = "account.registered"
+)
+
+type Event struct {
+	Type Type
+	At   time.Time
+	Data map[string]interface{}
+}
+
+type Handler func(Event)
+
+var (
+	mu          sync.RWMutex
+	subscribers = map[Type][]Handler{}
+)
+
+func Subscribe(t Type, h Handler) {
+	mu.Lock()
+	defer mu.Unlock()
+	subscribers[t] = append(subscribers[t], h)
+}
+
+// Publish returns right away, every subscriber runs in its own goroutine
+func Publish(t Type, data map[string]interface{}) {
+	e := Event{Type: t, At: time.Now(), Data: data}
+
+	mu.RLock()
+	handlers := subscribers[t]
+	mu.RUnlock()
+
+	for _, h := range handlers {
+		go run(h, e)
+	}
+}
+
+// a panicking subscriber must not take the server down
+func run(h Handler, e Event) {
+	defer func() {
+		if rec := recover(); rec != nil {
+			log.Printf("event: subscriber of %s panicked: %v", e.Type, rec)
+		}
+	}()
+	h(e)
+}
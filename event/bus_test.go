@@ -0,0 +1,109 @@
+package event
+
+import (
+	"bytes"
+	"log"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Subscribers are global, every test publishes its own types
+func received(t *testing.T, ch <-chan Event) Event {
+	t.Helper()
+	select {
+	case e := <-ch:
+		return e
+	case <-time.After(time.Second):
+		t.Fatal("event not delivered")
+		return Event{}
+	}
+}
+
+func TestPublishToEverySubscriber(t *testing.T) {
+	const typ Type = "test.every"
+	first, second, other := make(chan Event, 1), make(chan Event, 1), make(chan Event, 1)
+	Subscribe(typ, func(e Event) { first <- e })
+	Subscribe(typ, func(e Event) { second <- e })
+	Subscribe("test.every.other", func(e Event) { other <- e })
+
+	Publish(typ, map[string]interface{}{"accountId": "42"})
+	for _, ch := range []chan Event{first, second} {
+		if e := received(t, ch); e.Type != typ || e.Data["accountId"] != "42" || e.At.IsZero() {
+			t.Errorf("got %+v", e)
+		}
+	}
+	select {
+	case e := <-other:
+		t.Errorf("subscriber of another type got %+v", e)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestPublishDoesNotWait(t *testing.T) {
+	const typ Type = "test.slow"
+	release, done := make(chan struct{}), make(chan struct{})
+	Subscribe(typ, func(Event) {
+		<-release
+		close(done)
+	})
+
+	returned := make(chan struct{})
+	go func() {
+		Publish(typ, nil)
+		close(returned)
+	}()
+	select {
+	case <-returned:
+	case <-time.After(time.Second):
+		t.Fatal("Publish waited for its subscriber")
+	}
+	close(release)
+	<-done
+}
+
+func TestPublishSurvivesPanickingSubscriber(t *testing.T) {
+	const typ Type = "test.panic"
+	var mu sync.Mutex
+	var logged bytes.Buffer
+	defer log.SetOutput(log.Writer())
+	log.SetOutput(writerFunc(func(p []byte) (int, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		return logged.Write(p)
+	}))
+
+	panicked, delivered := make(chan struct{}, 2), make(chan Event, 2)
+	Subscribe(typ, func(Event) {
+		panicked <- struct{}{}
+		panic("boom")
+	})
+	Subscribe(typ, func(e Event) { delivered <- e })
+
+	Publish(typ, nil)
+	<-panicked
+	received(t, delivered)
+
+	// the bus keeps working afterwards
+	Publish(typ, nil)
+	received(t, delivered)
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		mu.Lock()
+		out := logged.String()
+		mu.Unlock()
+		if strings.Contains(out, "subscriber of test.panic panicked: boom") {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("panic not logged: %q", out)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+type writerFunc func(p []byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) { return f(p) }
@@ -2,19 +2,98 @@ package main
 
 import (
 	"context"
+	"errors"
 	"log"
+	"main/audit"
+	"main/auth"
 	"main/db"
+	"main/event"
+	"main/metrics"
 	"main/router"
+	"main/service"
 	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
 	"github.com/go-chi/cors"
 )
 
+// set at build time, e.g.
+// go build -ldflags "-X main.version=1.0.0 -X main.commit=$(git rev-parse --short HEAD) -X main.buildTime=$(date -u +%FT%TZ)"
+var (
+	version   = "dev"
+	commit    = "unknown"
+	buildTime = "unknown"
+)
+
+// secrets are only ever reported as set or not
+func logStartupSummary(serverCfg router.ServerConfig, corsOptions cors.Options, metricsEnabled bool) {
+	secret := "random"
+	if os.Getenv("JWT_SECRET") != "" {
+		secret = "set"
+	}
+	defaultRole := os.Getenv("DEFAULT_ROLE")
+	if defaultRole == "" {
+		defaultRole = "user"
+	}
+	if deny, _ := strconv.ParseBool(os.Getenv("DENY_BY_DEFAULT")); deny {
+		defaultRole = "none (deny by default)"
+	}
+	welcome, _ := strconv.ParseBool(os.Getenv("ENABLE_WELCOME_ROUTE"))
+
+	log.Printf("startup: version %s (%s, built %s)", version, commit, buildTime)
+	log.Printf("startup: listening on %s, timeouts read %s, read header %s, write %s, idle %s, shutdown %s",
+		serverCfg.Addr, serverCfg.ReadTimeout, serverCfg.ReadHeaderTimeout, serverCfg.WriteTimeout, serverCfg.IdleTimeout, serverCfg.ShutdownTimeout)
+	log.Printf("startup: mongodb %s, database %s, timeout %s", db.RedactURI(os.Getenv("MONGODB_URI")), db.DatabaseName, db.Timeout)
+	log.Printf("startup: auth providers [local, api-key], jwt %s, ttl %s, secret %s", auth.SigningAlgorithm(), auth.TokenTTL, secret)
+	log.Printf("startup: cors origins %v, credentials %t", corsOptions.AllowedOrigins, corsOptions.AllowCredentials)
+	log.Printf("startup: metrics %t", metricsEnabled)
+	log.Printf("startup: default role %s, welcome route %t, app env %q", defaultRole, welcome, os.Getenv("APP_ENV"))
+}
+
 func main() {
 	// look weird but haven't figured a better way yet
 	db.InitConnection()
+	auth.InitJWT()
+
+	if _, err := service.LoadPasswordPolicy(); err != nil {
+		log.Fatal(err)
+	}
+
+	// registration hands out the default role, it has to exist before the first one
+	if err := service.NewAuthService().EnsureDefaultRole(context.Background()); err != nil {
+		log.Fatalf("Cannot create the default role: %v", err)
+	}
+
+	// fail fast on a broken role catalog instead of on the first /roles/sync
+	if path := os.Getenv("ROLE_CATALOG_PATH"); path != "" {
+		if _, err := service.LoadRoleCatalog(path); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// the events never carry passwords
+	for _, t := range []event.Type{event.LoginSucceeded, event.LoginFailed, event.Registered} {
+		event.Subscribe(t, func(e event.Event) {
+			audit.Default.Write(audit.Record{Time: e.At, Event: string(e.Type), Data: e.Data})
+		})
+	}
+	event.Subscribe(event.LoginSucceeded, func(e event.Event) { metrics.Logins.WithLabelValues("success").Inc() })
+	event.Subscribe(event.LoginFailed, func(e event.Event) { metrics.Logins.WithLabelValues("failure").Inc() })
+	metricsEnabled, _ := strconv.ParseBool(os.Getenv("ENABLE_METRICS"))
+
+	serverCfg, err := router.LoadServerConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+	corsOptions, err := router.LoadCORSOptions()
+	if err != nil {
+		log.Fatal(err)
+	}
 
 	r := chi.NewRouter()
 	qRouter := router.NewQRouter()
@@ -22,35 +101,81 @@ func main() {
 	roleRouter := router.NewRoleRouter()
 	userRouter := router.NewUserRouter()
 	projectRouter := router.NewProjectRouter()
+	formRouter := router.NewFormRouter()
+	apiKeyRouter := router.NewAPIKeyRouter()
+	healthRouter := router.NewHealthRouter(version, commit, buildTime)
+	requireAuth := router.RequireAuth(service.NewAuthService(), service.NewAPIKeyService())
 
-	r.Use(cors.Handler(cors.Options{
-		AllowedOrigins:   []string{"http://localhost:*"},
-		AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
-		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type", "X-CSRF-Token"},
-		ExposedHeaders:   []string{"Link"},
-		AllowCredentials: false,
-		MaxAge:           300, // Maximum value not ignored by any of major browsers
-	}))
+	r.Use(cors.Handler(corsOptions))
+	// before the loggers, so every log line of the request can carry its id
+	r.Use(router.RequestID)
 	r.Use(middleware.Logger)
+	r.Use(router.AuditLog(audit.Default))
+	if metricsEnabled {
+		r.Use(metrics.Middleware)
+	}
 	r.Use(middleware.Recoverer)
 	r.Use(middleware.CleanPath)
+	r.Use(router.Compress)
 	r.Use(middleware.SetHeader("Content-Type", "application/json"))
 
-	r.Get("/", func(w http.ResponseWriter, r *http.Request) {
-		w.Write([]byte("welcome"))
-	})
-	r.Mount("/questions", qRouter.Routes())
+	// the human welcome page is opt-in, deploy checks should use /health and /ready
+	if welcome, _ := strconv.ParseBool(os.Getenv("ENABLE_WELCOME_ROUTE")); welcome {
+		r.Get("/", func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("welcome"))
+		})
+	}
+	r.Get("/version", healthRouter.Version)
+	// METRICS_PATH moves it, e.g. somewhere only the scraper knows about
+	if metricsEnabled {
+		path := os.Getenv("METRICS_PATH")
+		if path == "" {
+			path = "/metrics"
+		}
+		r.Method(http.MethodGet, path, metrics.Handler())
+	}
+	r.Get("/health", healthRouter.Health)
+	r.Get("/ready", healthRouter.Ready)
 	r.Mount("/auth", authRouter.Routes())
-	r.Mount("/roles", roleRouter.Routes())
-	r.Mount("/users", userRouter.Routes())
-	r.Mount("/projects", projectRouter.Routes())
+	r.Mount("/api-keys", apiKeyRouter.Routes())
+	// everything else needs a token from /auth/login or an API key
+	r.Group(func(r chi.Router) {
+		r.Use(requireAuth)
+		r.Mount("/questions", qRouter.Routes())
+		r.Mount("/roles", roleRouter.Routes())
+		r.Mount("/users", userRouter.Routes())
+		r.Mount("/profiles", userRouter.ProfileRoutes())
+		r.Mount("/projects", projectRouter.Routes())
+		r.Mount("/forms", formRouter.Routes())
+	})
 
-	http.ListenAndServe(":3001", r)
+	logStartupSummary(serverCfg, corsOptions, metricsEnabled)
+	srv := &http.Server{
+		Addr:              serverCfg.Addr,
+		Handler:           r,
+		ReadTimeout:       serverCfg.ReadTimeout,
+		ReadHeaderTimeout: serverCfg.ReadHeaderTimeout,
+		WriteTimeout:      serverCfg.WriteTimeout,
+		IdleTimeout:       serverCfg.IdleTimeout,
+	}
 
-	// use when about to end the app
-	defer func() {
-		if err := db.MongoClient.Disconnect(context.TODO()); err != nil {
+	stop, cancelStop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancelStop()
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
 			log.Fatal(err)
 		}
 	}()
+	<-stop.Done()
+
+	// let in-flight requests finish, then close the database
+	log.Printf("shutting down, waiting up to %s", serverCfg.ShutdownTimeout)
+	ctx, cancel := context.WithTimeout(context.Background(), serverCfg.ShutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Printf("shutdown: %v", err)
+	}
+	if err := db.MongoClient.Disconnect(ctx); err != nil {
+		log.Printf("shutdown: %v", err)
+	}
 }
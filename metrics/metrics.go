@@ -0,0 +1,57 @@
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Prometheus metrics, served by Handler when ENABLE_METRICS=true
+
+var (
+	Logins = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "gogo_logins_total",
+		Help: "Login attempts by result (success, failure).",
+	}, []string{"result"})
+
+	TokenValidations = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "gogo_token_validations_total",
+		Help: "Credential checks by auth type (jwt, api-key) and result (valid, invalid).",
+	}, []string{"auth_type", "result"})
+
+	requestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "gogo_http_request_duration_seconds",
+		Help:    "HTTP request latency by method, route pattern and status.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"method", "route", "status"})
+)
+
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
+
+// Middleware times every request. Routes are labelled by their chi pattern
+// (/users/{uid}, not /users/62f...) to keep the number of series bounded.
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		next.ServeHTTP(ww, r)
+
+		route := "unmatched"
+		if rctx := chi.RouteContext(r.Context()); rctx != nil && rctx.RoutePattern() != "" {
+			route = rctx.RoutePattern()
+		}
+		status := ww.Status()
+		if status == 0 {
+			status = http.StatusOK
+		}
+		requestDuration.WithLabelValues(r.Method, route, strconv.Itoa(status)).Observe(time.Since(start).Seconds())
+	})
+}
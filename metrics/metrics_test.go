@@ -0,0 +1,63 @@
+package metrics
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+)
+
+func scrape(t *testing.T) string {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("scrape got %d", rec.Code)
+	}
+	body, _ := io.ReadAll(rec.Body)
+	return string(body)
+}
+
+func TestScrape(t *testing.T) {
+	r := chi.NewRouter()
+	r.Use(Middleware)
+	r.Get("/users/{uid}", func(w http.ResponseWriter, r *http.Request) {})
+	r.Post("/forms", func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusCreated) })
+	for _, req := range []*http.Request{
+		httptest.NewRequest(http.MethodGet, "/users/62f1a2b3c4d5e6f708192a3b", nil),
+		httptest.NewRequest(http.MethodPost, "/forms", nil),
+		httptest.NewRequest(http.MethodGet, "/nowhere/62f1a2b3c4d5e6f708192a3b", nil),
+	} {
+		r.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	Logins.WithLabelValues("success").Inc()
+	Logins.WithLabelValues("failure").Inc()
+	TokenValidations.WithLabelValues("jwt", "valid").Inc()
+	TokenValidations.WithLabelValues("api-key", "invalid").Inc()
+
+	out := scrape(t)
+	for _, want := range []string{
+		"# TYPE gogo_logins_total counter",
+		`gogo_logins_total{result="success"} 1`,
+		`gogo_logins_total{result="failure"} 1`,
+		"# TYPE gogo_token_validations_total counter",
+		`gogo_token_validations_total{auth_type="jwt",result="valid"} 1`,
+		`gogo_token_validations_total{auth_type="api-key",result="invalid"} 1`,
+		"# TYPE gogo_http_request_duration_seconds histogram",
+		// labelled by route pattern, never by the raw path
+		`gogo_http_request_duration_seconds_count{method="GET",route="/users/{uid}",status="200"} 1`,
+		`gogo_http_request_duration_seconds_count{method="POST",route="/forms",status="201"} 1`,
+		`gogo_http_request_duration_seconds_count{method="GET",route="unmatched",status="404"} 1`,
+		`gogo_http_request_duration_seconds_bucket{method="GET",route="/users/{uid}",status="200",le="+Inf"} 1`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("scrape has no %s", want)
+		}
+	}
+	if strings.Contains(out, "62f1a2b3c4d5e6f708192a3b") {
+		t.Error("a raw path ended up in a label")
+	}
+}
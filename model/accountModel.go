@@ -1,30 +1,73 @@
 package model
 
 import (
+	"crypto/subtle"
+	"strings"
+	"time"
+
 	"go.mongodb.org/mongo-driver/bson/primitive"
+	"golang.org/x/crypto/bcrypt"
 )
 
+// Sensitive fields are tagged json:"-" so they never reach a response, whatever the code path.
+// Request bodies carrying them (AccountRequest, AccountRegister) are separate types.
 type Account struct {
 	ID       primitive.ObjectID `json:"id," bson:"_id,omitempty"`
 	UserId   primitive.ObjectID `json:"userId," bson:"userId,omitempty"`
 	Username string             `json:"username" bson:"username"`
-	Password string             `json:"password" bson:"password"`
+	Password string             `json:"-" bson:"password"` // bcrypt hash, plain text for accounts older than hashing
 	Roles    []Role             `json:"roles" bson:"roles"`
+	// tokens issued before this are no longer accepted
+	PasswordChangedAt time.Time `json:"-" bson:"passwordChangedAt,omitempty"`
+	UpdatedAt         time.Time `json:"updatedAt" bson:"updatedAt,omitempty"`
+}
+
+// Usernames are stored trimmed and lower cased so "Alice" and "alice" are the same account
+func NormalizeUsername(username string) string {
+	return strings.ToLower(strings.TrimSpace(username))
+}
+
+func HashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+// Whether the stored password is still plain text and should be replaced by a hash
+func (a *Account) NeedsRehash() bool {
+	return !strings.HasPrefix(a.Password, "$2")
+}
+
+func (a *Account) CheckPassword(password string) bool {
+	if a.NeedsRehash() {
+		return subtle.ConstantTimeCompare([]byte(a.Password), []byte(password)) == 1
+	}
+	return bcrypt.CompareHashAndPassword([]byte(a.Password), []byte(password)) == nil
 }
 
 type AccountRequest struct {
-	Username string `json:"username"`
+	Username string `json:"username"` // or the email of the account's user
 	Password string `json:"password"`
 }
 
+type ChangePasswordRequest struct {
+	CurrentPassword string `json:"currentPassword"`
+	NewPassword     string `json:"newPassword"`
+}
+
+// No roles here, clients can't pick their own
 type AccountRegister struct {
 	Username string `json:"username"`
 	Password string `json:"password"`
-	Roles    []Role `json:"roles"`
 }
 
 type AccountResponse struct {
 	ID       primitive.ObjectID `json:"id," bson:"_id,omitempty" `
 	Username string             `json:"username"`
 	Roles    []Role             `json:"roles"`
+	Token    string             `json:"token,omitempty" bson:"-"` // only set on login
+	// only set on login and refresh, trade it on /auth/refresh for a new token
+	RefreshToken string `json:"refreshToken,omitempty" bson:"-"`
 }
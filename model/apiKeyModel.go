@@ -0,0 +1,40 @@
+package model
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Credential for service clients (webhooks, cron jobs...). Only a hash of the key is stored,
+// the key itself is shown once when it's created.
+type APIKey struct {
+	ID        primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+	Name      string             `json:"name" bson:"name"`
+	Prefix    string             `json:"prefix" bson:"prefix"` // first characters of the key, to tell keys apart
+	KeyHash   string             `json:"-" bson:"keyHash"`
+	Scopes    []string           `json:"scopes" bson:"scopes"`
+	ExpiresAt *time.Time         `json:"expiresAt,omitempty" bson:"expiresAt,omitempty"`
+	Revoked   bool               `json:"revoked" bson:"revoked"`
+	CreateAt  time.Time          `json:"createAt" bson:"createAt"`
+}
+
+type APIKeyRequest struct {
+	Name      string     `json:"name"`
+	Scopes    []string   `json:"scopes"`
+	ExpiresAt *time.Time `json:"expiresAt"`
+}
+
+type APIKeyCreated struct {
+	APIKey
+	Key string `json:"key"`
+}
+
+func (k *APIKey) HasScope(scope string) bool {
+	for _, s := range k.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
@@ -16,11 +16,25 @@ type Form struct {
 	Questions   []primitive.ObjectID `json:"questions" bson:"questions"` // list of question id (new id for each form)
 }
 
+// Only the fields that are set get updated
+type FormUpdateRequest struct {
+	Name        *string               `json:"name"`
+	Description *string               `json:"description"`
+	Questions   *[]primitive.ObjectID `json:"questions"`
+}
+
+type FormQuestionRequest struct {
+	QuestionId primitive.ObjectID `json:"questionId"`
+}
+
 func (f *Form) MarshalBSON() ([]byte, error) {
 	if f.CreateAt.IsZero() {
 		f.CreateAt = time.Now()
 	}
 	f.UpdateAt = time.Now()
+	if f.Questions == nil {
+		f.Questions = []primitive.ObjectID{}
+	}
 	type my Form
 	return bson.Marshal((*my)(f))
 }
@@ -0,0 +1,34 @@
+package model
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type FormResponse struct {
+	ID           primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+	FormId       primitive.ObjectID `json:"formId" bson:"formId"`
+	RespondentId primitive.ObjectID `json:"respondentId" bson:"respondentId,omitempty"` // user id, empty when anonymous
+	Answers      []Answer           `json:"answers" bson:"answers"`
+	SubmittedAt  time.Time          `json:"submittedAt" bson:"submittedAt"`
+}
+
+type Answer struct {
+	QuestionId primitive.ObjectID `json:"questionId" bson:"questionId"`
+	Value      interface{}        `json:"value" bson:"value"` // shape depends on the question type
+}
+
+// The respondent is always the caller, it can't be picked
+type FormResponseRequest struct {
+	Answers []Answer `json:"answers"`
+}
+
+func (fr *FormResponse) MarshalBSON() ([]byte, error) {
+	if fr.SubmittedAt.IsZero() {
+		fr.SubmittedAt = time.Now()
+	}
+	type my FormResponse
+	return bson.Marshal((*my)(fr))
+}
@@ -0,0 +1,36 @@
+package model
+
+// PagedResponse is the body of every list endpoint, new list endpoints should return it too
+//
+//	{"data": [...], "pagination": {"page": 1, "limit": 20, "total": 42, "totalPages": 3}}
+type PagedResponse[T any] struct {
+	Data       []T        `json:"data"`
+	Pagination Pagination `json:"pagination"`
+}
+
+type Pagination struct {
+	Page       int   `json:"page"`
+	Limit      int   `json:"limit"`
+	Total      int64 `json:"total"`
+	TotalPages int64 `json:"totalPages"`
+}
+
+func NewPagedResponse[T any](data []T, page int, limit int, total int64) *PagedResponse[T] {
+	// keep "data": [] instead of null for empty pages
+	if data == nil {
+		data = []T{}
+	}
+	var totalPages int64
+	if limit > 0 {
+		totalPages = (total + int64(limit) - 1) / int64(limit)
+	}
+	return &PagedResponse[T]{
+		Data: data,
+		Pagination: Pagination{
+			Page:       page,
+			Limit:      limit,
+			Total:      total,
+			TotalPages: totalPages,
+		},
+	}
+}
@@ -16,6 +16,23 @@ type Project struct {
 	UpdateAt     time.Time            `json:"updateAt" bson:"updateAt"`
 	Participants []primitive.ObjectID `json:"participants" bson:"participants"` // list of user id
 	Forms        []primitive.ObjectID `json:"forms" bson:"forms"`               // list of form id
+	Version      int64                `json:"version" bson:"version"`
+	Orphaned     bool                 `json:"orphaned,omitempty" bson:"orphaned,omitempty"` // its creator deleted their account
+}
+
+type ProjectQuery struct {
+	Name      string // case-insensitive substring of the name
+	SortField string
+	SortOrder int // 1 ascending, -1 descending
+}
+
+// Only the fields that are set get updated, pass the version read to guard against concurrent edits
+type ProjectUpdateRequest struct {
+	Name         *string               `json:"name"`
+	Description  *string               `json:"description"`
+	Participants *[]primitive.ObjectID `json:"participants"`
+	Forms        *[]primitive.ObjectID `json:"forms"`
+	Version      *int64                `json:"version"`
 }
 
 type ProjectResponse struct {
@@ -29,11 +46,21 @@ type ProjectResponse struct {
 	// Forms        []primitive.ObjectID `json:"forms" bson:"forms"`               // list of form id
 }
 
+type ProjectParticipantRequest struct {
+	UserId primitive.ObjectID `json:"userId"`
+}
+
 func (p *Project) MarshalBSON() ([]byte, error) {
 	if p.CreateAt.IsZero() {
 		p.CreateAt = time.Now()
 	}
 	p.UpdateAt = time.Now()
+	if p.Participants == nil {
+		p.Participants = []primitive.ObjectID{}
+	}
+	if p.Forms == nil {
+		p.Forms = []primitive.ObjectID{}
+	}
 	type my Project
 	return bson.Marshal((*my)(p))
 }
@@ -8,15 +8,45 @@ import (
 )
 
 type Question struct {
-	Id          primitive.ObjectID `json:"id" bson:"_id,omitempty"`
-	Uuid        string             `json:"uuid" bson:"uuid"`
-	Content     string             `json:"content"`
-	Description string             `json:"description" bson:"description,omitempty"`
-	Type        string             `json:"type" bson:"type"`
-	CreateBy    primitive.ObjectID `json:"createBy" bson:"createBy"` // user id
-	CreateAt    time.Time          `json:"createAt" bson:"createAt"`
-	UpdateAt    time.Time          `json:"updateAt" bson:"updateAt"`
-	Trait       primitive.M        `json:"trait" bson:",inline"`
+	Id          primitive.ObjectID  `json:"id" bson:"_id,omitempty"`
+	Uuid        string              `json:"uuid" bson:"uuid"`
+	Content     string              `json:"content"`
+	Description string              `json:"description" bson:"description,omitempty"`
+	Type        string              `json:"type" bson:"type"`
+	CreateBy    primitive.ObjectID  `json:"createBy" bson:"createBy"` // user id
+	CreateAt    time.Time           `json:"createAt" bson:"createAt"`
+	UpdateAt    time.Time           `json:"updateAt" bson:"updateAt"`
+	Validation  *QuestionValidation `json:"validation,omitempty" bson:"validation,omitempty"`
+	Trait       primitive.M         `json:"trait" bson:",inline"`
+}
+
+// Question types answers are validated against, other types only get the Required check
+const (
+	QuestionText           = "text"
+	QuestionNumber         = "number"
+	QuestionSingleChoice   = "single-choice"
+	QuestionMultipleChoice = "multi-choice"
+)
+
+// All rules are optional, each only applies to the types noted
+type QuestionValidation struct {
+	Required  bool     `json:"required" bson:"required"`
+	MinLength *int     `json:"minLength,omitempty" bson:"minLength,omitempty"` // text: characters, multi-choice: picked options
+	MaxLength *int     `json:"maxLength,omitempty" bson:"maxLength,omitempty"` // text: characters, multi-choice: picked options
+	Pattern   string   `json:"pattern,omitempty" bson:"pattern,omitempty"`     // text, Go regexp syntax
+	Min       *float64 `json:"min,omitempty" bson:"min,omitempty"`             // number
+	Max       *float64 `json:"max,omitempty" bson:"max,omitempty"`             // number
+	Options   []string `json:"options,omitempty" bson:"options,omitempty"`     // choices, falls back to trait "options"
+}
+
+type QuestionBatchRequest struct {
+	Questions []Question `json:"questions"`
+}
+
+// questions as stored, the ones that couldn't be inserted are listed in errors by their index in the request
+type QuestionBatchResponse struct {
+	Questions []Question     `json:"questions"`
+	Errors    map[int]string `json:"errors"`
 }
 
 func (q *Question) MarshalBSON() ([]byte, error) {
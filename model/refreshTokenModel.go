@@ -0,0 +1,22 @@
+package model
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Server-side record of a refresh token, only its hash is stored. Each one is used once:
+// refreshing revokes it and hands out a new one.
+type RefreshToken struct {
+	ID        primitive.ObjectID `bson:"_id,omitempty"`
+	AccountId primitive.ObjectID `bson:"accountId"`
+	TokenHash string             `bson:"tokenHash"`
+	ExpiresAt time.Time          `bson:"expiresAt"`
+	Revoked   bool               `bson:"revoked"`
+	CreateAt  time.Time          `bson:"createAt"`
+}
+
+type RefreshRequest struct {
+	RefreshToken string `json:"refreshToken"`
+}
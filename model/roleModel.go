@@ -3,6 +3,40 @@ package model
 import "go.mongodb.org/mongo-driver/bson/primitive"
 
 type Role struct {
-	Id   primitive.ObjectID `json:"id" bson:"_id,omitempty"`
-	Name string             `json:"name" bson:"name"`
+	Id          primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+	Name        string             `json:"name" bson:"name"`
+	Permissions []string           `json:"permissions,omitempty" bson:"permissions,omitempty"`
+}
+
+// Permissions the routes check: users get them through their roles, service clients
+// carry them as API key scopes
+const (
+	PermissionReadForms       = "read:forms"
+	PermissionCreateForms     = "create:forms"
+	PermissionUpdateForms     = "update:forms"
+	PermissionDeleteForms     = "delete:forms"
+	PermissionSubmitResponses = "submit:responses"
+	PermissionReadResponses   = "read:responses"
+)
+
+// Only the fields that are set get updated
+type RoleUpdateRequest struct {
+	Name        *string   `json:"name"`
+	Permissions *[]string `json:"permissions"`
+}
+
+// Declarative role catalog, every permission used by a role must be listed in Permissions
+//
+//	{"permissions": ["read:projects"], "roles": [{"name": "user", "permissions": ["read:projects"]}]}
+type RoleCatalog struct {
+	Permissions []string `json:"permissions"`
+	Roles       []Role   `json:"roles"`
+}
+
+type RoleSyncResult struct {
+	Upserted int64 `json:"upserted"`
+	Modified int64 `json:"modified"`
+	Pruned   int64 `json:"pruned"`
+	// missing from the catalog but still given to an account, take them away first
+	Kept []string `json:"kept"`
 }
@@ -2,6 +2,7 @@ package model
 
 import (
 	// "main/model/model"
+	"strings"
 
 	"go.mongodb.org/mongo-driver/bson/primitive"
 )
@@ -29,6 +30,47 @@ type UserResponse struct {
 	Avatar   string          `json:"avatar" bson:"avatar,omitempty"`
 	Status   string          `json:"status" bson:"status"`
 	Account  AccountResponse `json:"account" bson:"account"`
+	// computed by FillCompleteness, not stored
+	Completeness  int      `json:"completeness" bson:"-"`
+	MissingFields []string `json:"missingFields" bson:"-"`
+}
+
+// Emails are stored trimmed and lower cased, the unique index then catches case variants
+func NormalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// How much each profile field counts towards completeness, adds up to 100
+var completenessWeights = []struct {
+	field  string
+	weight int
+}{
+	{"fullName", 20},
+	{"email", 20},
+	{"phone", 15},
+	{"address", 15},
+	{"dob", 15},
+	{"avatar", 15},
+}
+
+// Scores the profile from 0 to 100 and lists the fields still blank, in weight order
+func (u *UserResponse) FillCompleteness() {
+	values := map[string]string{
+		"fullName": u.Fullname,
+		"email":    u.Email,
+		"phone":    u.Phone,
+		"address":  u.Address,
+		"dob":      u.DOB,
+		"avatar":   u.Avatar,
+	}
+	u.Completeness, u.MissingFields = 0, []string{}
+	for _, w := range completenessWeights {
+		if strings.TrimSpace(values[w.field]) != "" {
+			u.Completeness += w.weight
+		} else {
+			u.MissingFields = append(u.MissingFields, w.field)
+		}
+	}
 }
 
 type UserResponseWithoutAcc struct {
@@ -52,3 +94,18 @@ type UserRequest struct {
 	Avatar    string             `json:"avatar"`
 	Status    string             `json:"status"`
 }
+
+type UserMergeRequest struct {
+	PrimaryId   string `json:"primaryId"`
+	SecondaryId string `json:"secondaryId"`
+}
+
+type UserBatchRequest struct {
+	Ids []string `json:"ids"`
+}
+
+// users found by id, ids that couldn't be fetched are listed in errors with the reason
+type UserBatchResponse struct {
+	Users  map[string]UserResponse `json:"users"`
+	Errors map[string]string       `json:"errors"`
+}
@@ -0,0 +1,41 @@
+package model
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestFillCompleteness(t *testing.T) {
+	full := UserResponse{Fullname: "Alice", Email: "alice@example.com", Phone: "111", Address: "1 Main St", DOB: "1990-01-01", Avatar: "a.png"}
+	tests := []struct {
+		name        string
+		user        UserResponse
+		wantScore   int
+		wantMissing []string
+	}{
+		{"empty", UserResponse{}, 0, []string{"fullName", "email", "phone", "address", "dob", "avatar"}},
+		{"blank counts as missing", UserResponse{Fullname: "  ", Email: "\t"}, 0, []string{"fullName", "email", "phone", "address", "dob", "avatar"}},
+		{"full", full, 100, []string{}},
+		{"partial", UserResponse{Fullname: "Alice", Phone: "111", Avatar: "a.png"}, 50, []string{"email", "address", "dob"}},
+		{"only the heaviest", UserResponse{Fullname: "Alice", Email: "alice@example.com"}, 40, []string{"phone", "address", "dob", "avatar"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u := tt.user
+			// stale values from an earlier call are replaced
+			u.Completeness, u.MissingFields = 77, []string{"stale"}
+			u.FillCompleteness()
+			if u.Completeness != tt.wantScore || !reflect.DeepEqual(u.MissingFields, tt.wantMissing) {
+				t.Errorf("got %d %v, want %d %v", u.Completeness, u.MissingFields, tt.wantScore, tt.wantMissing)
+			}
+		})
+	}
+
+	total := 0
+	for _, w := range completenessWeights {
+		total += w.weight
+	}
+	if total != 100 {
+		t.Errorf("weights add up to %d, want 100", total)
+	}
+}
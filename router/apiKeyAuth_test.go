@@ -0,0 +1,96 @@
+package router
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"main/model"
+	"main/service"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+func TestAPIKeyAuth(t *testing.T) {
+	mt := mtest.New(t, mockDB)
+	defer mt.Close()
+
+	const key = "gk_0123456789abcdef"
+	sum := sha256.Sum256([]byte(key))
+	stored := func(change func(k *model.APIKey)) bson.D {
+		k := model.APIKey{ID: primitive.NewObjectID(), Name: "ci", KeyHash: hex.EncodeToString(sum[:]), Scopes: []string{userAdminScope}}
+		if change != nil {
+			change(&k)
+		}
+		return cursorReply(t, "apiKey", k)
+	}
+	past, future := time.Now().Add(-time.Hour), time.Now().Add(time.Hour)
+
+	tests := []struct {
+		name       string
+		key        string
+		reply      bson.D // nil when no lookup is expected
+		wantStatus int
+		wantCode   string
+	}{
+		{"valid key", key, stored(nil), http.StatusOK, ""},
+		{"valid key with expiry", key, stored(func(k *model.APIKey) { k.ExpiresAt = &future }), http.StatusOK, ""},
+		{"unknown key", "gk_unknown", cursorReply(t, "apiKey"), http.StatusUnauthorized, "INVALID_API_KEY"},
+		{"revoked key", key, stored(func(k *model.APIKey) { k.Revoked = true }), http.StatusUnauthorized, "INVALID_API_KEY"},
+		{"expired key", key, stored(func(k *model.APIKey) { k.ExpiresAt = &past }), http.StatusUnauthorized, "INVALID_API_KEY"},
+		{"wrong scope", key, stored(func(k *model.APIKey) { k.Scopes = []string{"read:responses"} }), http.StatusForbidden, CodeForbidden},
+		{"no key", "", nil, http.StatusForbidden, CodeForbidden},
+	}
+	for _, tt := range tests {
+		mt.Run(tt.name, func(mt *mtest.T) {
+			t := mt.T
+			useMock(mt)
+			if tt.reply != nil {
+				mt.AddMockResponses(tt.reply)
+			}
+			var seen *model.APIKey
+			ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				seen = APIKeyFromContext(r.Context())
+				w.WriteHeader(http.StatusOK)
+			})
+			h := APIKeyAuth(service.NewAPIKeyService())(RequireRoleOrScope("admin", userAdminScope)(ok))
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.key != "" {
+				req.Header.Set("X-API-Key", tt.key)
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+			if tt.wantCode != "" {
+				var body errorResponse
+				json.Unmarshal(rec.Body.Bytes(), &body)
+				if body.Code != tt.wantCode {
+					t.Errorf("code %q, want %q", body.Code, tt.wantCode)
+				}
+			} else if seen == nil || !seen.HasScope(userAdminScope) {
+				t.Errorf("key in context %+v, want the stored one", seen)
+			}
+			if tt.reply == nil {
+				if n := len(mt.GetAllStartedEvents()); n != 0 {
+					t.Errorf("sent %d commands, want none", n)
+				}
+				return
+			}
+			// only the hash is ever looked up
+			hash := sentCommand(t, mt, "find").Lookup("filter", "keyHash").StringValue()
+			if want := sha256.Sum256([]byte(tt.key)); hash != hex.EncodeToString(want[:]) {
+				t.Errorf("looked up %q, want the key hash", hash)
+			}
+		})
+	}
+}
@@ -0,0 +1,65 @@
+package router
+
+import (
+	"main/model"
+	"main/service"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// scope a service client needs to manage keys, users need the admin role
+const apiKeyAdminScope = "admin:api-keys"
+
+type APIKeyRouter struct {
+	apiKeyService *service.APIKeyService
+	authService   *service.AuthService
+}
+
+func NewAPIKeyRouter() *APIKeyRouter {
+	return &APIKeyRouter{
+		apiKeyService: service.NewAPIKeyService(),
+		authService:   service.NewAuthService(),
+	}
+}
+
+func (ar *APIKeyRouter) Routes() chi.Router {
+	r := chi.NewRouter()
+	r.Use(RequireAuth(ar.authService, ar.apiKeyService))
+	r.Use(RequireRoleOrScope("admin", apiKeyAdminScope))
+	r.Get("/", ar.getAPIKeys)
+	r.Post("/", ar.createAPIKey)
+	r.Delete("/{id}", ar.revokeAPIKey)
+	return r
+}
+
+func (ar *APIKeyRouter) getAPIKeys(w http.ResponseWriter, r *http.Request) {
+	page, limit := getPagination(r)
+	keys, err := ar.apiKeyService.GetAPIKeys(r.Context(), page, limit)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	writeJSON(w, r, http.StatusOK, keys)
+}
+
+func (ar *APIKeyRouter) createAPIKey(w http.ResponseWriter, r *http.Request) {
+	var req model.APIKeyRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	key, err := ar.apiKeyService.CreateAPIKey(r.Context(), &req)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	writeJSON(w, r, http.StatusCreated, key)
+}
+
+func (ar *APIKeyRouter) revokeAPIKey(w http.ResponseWriter, r *http.Request) {
+	if err := ar.apiKeyService.RevokeAPIKey(r.Context(), chi.URLParam(r, "id")); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,62 @@
+package router
+
+import (
+	"context"
+	"main/audit"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+// Filled in by whichever authentication middleware accepts the request. It's created up front
+// by AuditLog because context values set further down the chain never make it back up.
+type identity struct {
+	UserId   string
+	AuthType string
+}
+
+type identityContextKey struct{}
+
+func setIdentity(ctx context.Context, userId string, authType string) {
+	if id, ok := ctx.Value(identityContextKey{}).(*identity); ok {
+		id.UserId, id.AuthType = userId, authType
+	}
+}
+
+// AuditLog writes one record per request to sink, once the response is written
+func AuditLog(sink audit.Sink) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+			id := &identity{}
+			next.ServeHTTP(ww, r.WithContext(context.WithValue(r.Context(), identityContextKey{}, id)))
+
+			status := ww.Status()
+			if status == 0 {
+				status = http.StatusOK
+			}
+			sink.Write(audit.Record{
+				Time:      start,
+				RequestId: middleware.GetReqID(r.Context()),
+				Method:    r.Method,
+				Path:      r.URL.Path,
+				Status:    status,
+				LatencyMs: float64(time.Since(start).Microseconds()) / 1000,
+				UserId:    id.UserId,
+				AuthType:  id.AuthType,
+				ClientIP:  clientIP(r),
+			})
+		})
+	}
+}
+
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
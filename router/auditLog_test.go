@@ -0,0 +1,80 @@
+package router
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"main/audit"
+)
+
+func TestAuditLog(t *testing.T) {
+	tests := []struct {
+		name         string
+		identity     *identity // what the authentication middleware reports, nil for none
+		status       int       // 0 when the handler never sets one
+		wantStatus   int
+		wantUserId   string
+		wantAuthType string
+	}{
+		{"user", &identity{UserId: "6650f0c2a1b2c3d4e5f60718", AuthType: "jwt"}, http.StatusCreated, http.StatusCreated,
+			"6650f0c2a1b2c3d4e5f60718", "jwt"},
+		{"service client", &identity{UserId: "6650f0c2a1b2c3d4e5f60719", AuthType: "api-key"}, http.StatusForbidden, http.StatusForbidden,
+			"6650f0c2a1b2c3d4e5f60719", "api-key"},
+		{"anonymous, implicit 200", nil, 0, http.StatusOK, "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			h := RequestID(AuditLog(audit.NewJSONSink(&out))(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if tt.identity != nil {
+					setIdentity(r.Context(), tt.identity.UserId, tt.identity.AuthType)
+				}
+				if tt.status != 0 {
+					w.WriteHeader(tt.status)
+				}
+				w.Write([]byte(`{}`))
+			})))
+			req := httptest.NewRequest(http.MethodPost, "/forms/42/responses?draft=true", strings.NewReader(`{"password":"hunter2"}`))
+			req.Header.Set(requestIDHeader, "req-1")
+			req.Header.Set("Authorization", "Bearer secret-token")
+			req.RemoteAddr = "203.0.113.7:51234"
+			h.ServeHTTP(httptest.NewRecorder(), req)
+
+			if lines := strings.Count(out.String(), "\n"); lines != 1 {
+				t.Fatalf("%d records, want 1: %s", lines, out.String())
+			}
+			var rec map[string]interface{}
+			if err := json.Unmarshal(out.Bytes(), &rec); err != nil {
+				t.Fatalf("record is not JSON: %s", out.String())
+			}
+			want := map[string]interface{}{
+				"requestId": "req-1",
+				"method":    http.MethodPost,
+				"path":      "/forms/42/responses",
+				"status":    float64(tt.wantStatus),
+				"clientIp":  "203.0.113.7",
+			}
+			if tt.wantUserId != "" {
+				want["userId"], want["authType"] = tt.wantUserId, tt.wantAuthType
+			}
+			for field, value := range want {
+				if rec[field] != value {
+					t.Errorf("%s %v, want %v", field, rec[field], value)
+				}
+			}
+			if tt.wantUserId == "" && (rec["userId"] != nil || rec["authType"] != nil) {
+				t.Errorf("anonymous request has an actor: %v", rec)
+			}
+			if rec["time"] == nil {
+				t.Errorf("time missing: %v", rec)
+			}
+			if strings.Contains(out.String(), "hunter2") || strings.Contains(out.String(), "secret-token") || strings.Contains(out.String(), "draft") {
+				t.Errorf("record carries request content: %s", out.String())
+			}
+		})
+	}
+}
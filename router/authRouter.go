@@ -1,7 +1,7 @@
 package router
 
 import (
-	"encoding/json"
+	"main/event"
 	"main/model"
 	"main/service"
 	"net/http"
@@ -13,72 +13,113 @@ import (
 type AuthRouter struct {
 	authService *service.AuthService
 	userService *service.UserService
+	rateLimit   RateLimitStore
+	idempotency IdempotencyStore
 }
 
 func NewAuthRouter() *AuthRouter {
 	return &AuthRouter{
 		authService: service.NewAuthService(),
 		userService: service.NewUserService(),
+		rateLimit:   NewMemoryRateLimitStore(envInt("AUTH_RATE_LIMIT_RPM", 10), envInt("AUTH_RATE_LIMIT_BURST", 5)),
+		idempotency: NewMemoryIdempotencyStore(idempotencyTTL),
 	}
 }
 
 func (ar *AuthRouter) Routes() chi.Router {
 	r := chi.NewRouter()
+	// brute force protection
+	r.Use(RateLimit(ar.rateLimit))
 	r.Post("/login", ar.login)
-	r.Post("/register", ar.register)
+	r.With(Idempotency(ar.idempotency)).Post("/register", ar.register)
+	r.With(Authenticate(ar.authService)).Post("/change-password", ar.changePassword)
+	r.Post("/refresh", ar.refresh)
+	r.Post("/logout", ar.logout)
 	return r
 }
 
 func (ar *AuthRouter) login(w http.ResponseWriter, r *http.Request) {
 	var authReq model.AccountRequest
-	err := json.NewDecoder(r.Body).Decode(&authReq)
-
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(err.Error()))
+	if !decodeJSON(w, r, &authReq) {
 		return
 	}
 
-	account, err := ar.authService.Login(authReq.Username, authReq.Password)
+	account, err := ar.authService.Login(r.Context(), authReq.Username, authReq.Password)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(err.Error()))
+		event.Publish(event.LoginFailed, map[string]interface{}{"username": authReq.Username, "clientIp": clientIP(r)})
+		writeError(w, r, err)
 		return
 	}
-	user, usrErr := ar.userService.GetUserByID(account.ID.Hex(), true)
+	event.Publish(event.LoginSucceeded, map[string]interface{}{"accountId": account.ID.Hex(), "username": account.Username, "clientIp": clientIP(r)})
+
+	user, usrErr := ar.userService.GetUserByID(r.Context(), account.ID.Hex(), true)
 
 	if usrErr != nil {
 		//TODO: incomplete information. This one should be an error
 		if usrErr == mongo.ErrNoDocuments {
-			w.WriteHeader(http.StatusOK)
-			json.NewEncoder(w).Encode(account)
+			writeJSON(w, r, http.StatusOK, account)
 			return
 		}
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(usrErr.Error()))
+		writeError(w, r, usrErr)
 		return
 	}
 
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(user)
+	user.Account.Token = account.Token
+	user.Account.RefreshToken = account.RefreshToken
+	writeJSON(w, r, http.StatusOK, user)
 }
 
 func (ar *AuthRouter) register(w http.ResponseWriter, r *http.Request) {
 	var authRegis model.AccountRegister
-	err := json.NewDecoder(r.Body).Decode(&authRegis)
+	if !decodeJSON(w, r, &authRegis) {
+		return
+	}
 
+	rs, err := ar.authService.Register(r.Context(), authRegis.Username, authRegis.Password)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte("Decode err: " + err.Error()))
+		writeError(w, r, err)
+		return
+	}
+	event.Publish(event.Registered, map[string]interface{}{"accountId": rs.InsertedID, "username": authRegis.Username})
+	writeJSON(w, r, http.StatusOK, rs)
+}
+
+// Logs out every session: tokens issued before the change are rejected from now on
+func (ar *AuthRouter) changePassword(w http.ResponseWriter, r *http.Request) {
+	var req model.ChangePasswordRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	claims := ClaimsFromContext(r.Context())
+	if err := ar.authService.ChangePassword(r.Context(), claims.AccountId, req.CurrentPassword, req.NewPassword); err != nil {
+		writeError(w, r, err)
 		return
 	}
+	w.WriteHeader(http.StatusNoContent)
+}
 
-	rs, err := ar.authService.Register(authRegis.Username, authRegis.Password, authRegis.Roles)
+func (ar *AuthRouter) refresh(w http.ResponseWriter, r *http.Request) {
+	var req model.RefreshRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	account, err := ar.authService.Refresh(r.Context(), req.RefreshToken)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(err.Error()))
+		writeError(w, r, err)
+		return
+	}
+	writeJSON(w, r, http.StatusOK, account)
+}
+
+// The access token stays valid until it expires, keep its lifetime short
+func (ar *AuthRouter) logout(w http.ResponseWriter, r *http.Request) {
+	var req model.RefreshRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	if err := ar.authService.Logout(r.Context(), req.RefreshToken); err != nil {
+		writeError(w, r, err)
 		return
 	}
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(rs)
+	w.WriteHeader(http.StatusNoContent)
 }
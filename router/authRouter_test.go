@@ -0,0 +1,87 @@
+package router
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"main/model"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+func TestRegister(t *testing.T) {
+	mt := mtest.New(t, mockDB)
+	defer mt.Close()
+
+	taken := func(n int) bson.D {
+		if n == 0 {
+			return cursorReply(t, "account")
+		}
+		return cursorReply(t, "account", bson.M{"_id": 1, "n": n})
+	}
+	userRole := cursorReply(t, "role", model.Role{Id: primitive.NewObjectID(), Name: "user"})
+	duplicateKey := mtest.CreateWriteErrorsResponse(mtest.WriteError{Index: 0, Code: 11000, Message: "E11000 duplicate key error"})
+
+	tests := []struct {
+		name       string
+		body       string
+		replies    []bson.D
+		wantStatus int
+		wantCode   string
+	}{
+		{"registered", `{"username":" Alice ","password":"Corr3ct-horse"}`,
+			[]bson.D{taken(0), userRole, mtest.CreateSuccessResponse()}, http.StatusOK, ""},
+		{"name taken in another case", `{"username":"Alice","password":"Corr3ct-horse"}`,
+			[]bson.D{taken(1)}, http.StatusConflict, "DUPLICATE_USERNAME"},
+		{"name taken by a concurrent registration", `{"username":"alice","password":"Corr3ct-horse"}`,
+			[]bson.D{taken(0), userRole, duplicateKey}, http.StatusConflict, "DUPLICATE_USERNAME"},
+		{"weak password", `{"username":"alice","password":"short"}`,
+			nil, http.StatusBadRequest, CodeValidation},
+	}
+	for _, tt := range tests {
+		mt.Run(tt.name, func(mt *mtest.T) {
+			t := mt.T
+			useMock(mt)
+			mt.AddMockResponses(tt.replies...)
+
+			rec := serve(NewAuthRouter().Routes(), anonymous, http.MethodPost, "/register", tt.body)
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+			if tt.wantCode != "" {
+				var body errorResponse
+				json.Unmarshal(rec.Body.Bytes(), &body)
+				if body.Code != tt.wantCode {
+					t.Errorf("code %q, want %q", body.Code, tt.wantCode)
+				}
+			}
+			if tt.replies == nil {
+				return
+			}
+
+			// the name is checked lower cased, ignoring case for accounts stored before normalization
+			count := sentCommand(t, mt, "aggregate")
+			match := count.Lookup("pipeline", "0", "$match").Document()
+			if username := match.Lookup("username").StringValue(); username != "alice" {
+				t.Errorf("checked username %q, want alice", username)
+			}
+			if strength, ok := count.Lookup("collation", "strength").AsInt64OK(); !ok || strength != 2 {
+				t.Errorf("collation %v, want case insensitive", count.Lookup("collation"))
+			}
+			if rec.Code != http.StatusOK {
+				return
+			}
+			var account model.Account
+			if err := bson.Unmarshal(sentCommand(t, mt, "insert").Lookup("documents", "0").Document(), &account); err != nil {
+				t.Fatal(err)
+			}
+			if account.Username != "alice" || len(account.Roles) != 1 || account.Roles[0].Name != "user" ||
+				account.NeedsRehash() || !account.CheckPassword("Corr3ct-horse") {
+				t.Errorf("stored %+v", account)
+			}
+		})
+	}
+}
@@ -0,0 +1,138 @@
+package router
+
+import (
+	"context"
+	"errors"
+	"main/auth"
+	"main/metrics"
+	"main/service"
+	"net/http"
+	"strings"
+)
+
+type claimsContextKey struct{}
+
+// Authenticate requires a valid "Authorization: Bearer <jwt>", the claims end up in the request context
+func Authenticate(authService *service.AuthService) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			token, ok := bearerToken(r)
+			if !ok {
+				writeErrorWithCode(w, r, http.StatusUnauthorized, CodeUnauthorized, "authentication required")
+				return
+			}
+			claims, err := authService.VerifyToken(r.Context(), token)
+			if err != nil {
+				if errors.Is(err, auth.ErrInvalidToken) {
+					metrics.TokenValidations.WithLabelValues("jwt", "invalid").Inc()
+				}
+				writeError(w, r, err)
+				return
+			}
+			metrics.TokenValidations.WithLabelValues("jwt", "valid").Inc()
+			setIdentity(r.Context(), claims.AccountId, "jwt")
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), claimsContextKey{}, claims)))
+		})
+	}
+}
+
+func bearerToken(r *http.Request) (string, bool) {
+	header := r.Header.Get("Authorization")
+	if len(header) < 7 || !strings.EqualFold(header[:7], "bearer ") {
+		return "", false
+	}
+	token := strings.TrimSpace(header[7:])
+	return token, token != ""
+}
+
+// Claims of the logged in account, nil when the request didn't go through Authenticate
+func ClaimsFromContext(ctx context.Context) *auth.JWTClaims {
+	claims, _ := ctx.Value(claimsContextKey{}).(*auth.JWTClaims)
+	return claims
+}
+
+/*
+* RequireAuth
+* For routes open to both users and service clients: a bearer token is checked like Authenticate,
+* otherwise an X-API-Key like APIKeyAuth. Requests with neither get 401.
+ */
+func RequireAuth(authService *service.AuthService, apiKeyService *service.APIKeyService) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		withToken := Authenticate(authService)(next)
+		withAPIKey := APIKeyAuth(apiKeyService)(next)
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch {
+			case r.Header.Get("Authorization") != "":
+				withToken.ServeHTTP(w, r)
+			case r.Header.Get("X-API-Key") != "":
+				withAPIKey.ServeHTTP(w, r)
+			default:
+				writeErrorWithCode(w, r, http.StatusUnauthorized, CodeUnauthorized, "authentication required")
+			}
+		})
+	}
+}
+
+// Lets users holding role and service clients with scope through, anyone else gets 403.
+// Roles are the account's current ones, Authenticate reads them on every request (see hasRole).
+func RequireRoleOrScope(role string, scope string) func(http.Handler) http.Handler {
+	return RequireAnyRoleOrScope([]string{role}, scope)
+}
+
+// Same as RequireRoleOrScope, any of roles will do. A role granted or revoked takes effect
+// on the next request, tokens issued before keep working with the new roles.
+func RequireAnyRoleOrScope(roles []string, scope string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if claims := ClaimsFromContext(r.Context()); claims != nil {
+				for _, role := range roles {
+					if hasRole(claims, role) {
+						next.ServeHTTP(w, r)
+						return
+					}
+				}
+			}
+			if apiKey := APIKeyFromContext(r.Context()); apiKey != nil && apiKey.HasScope(scope) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			writeErrorWithCode(w, r, http.StatusForbidden, CodeForbidden, "not allowed")
+		})
+	}
+}
+
+// Lets users whose roles grant permission and service clients with it as a scope through, anyone else gets 403
+func RequirePermission(permission string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if claims := ClaimsFromContext(r.Context()); claims != nil && hasPermission(claims, permission) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if apiKey := APIKeyFromContext(r.Context()); apiKey != nil && apiKey.HasScope(permission) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			writeErrorWithCode(w, r, http.StatusForbidden, CodeForbidden, "not allowed")
+		})
+	}
+}
+
+func hasPermission(claims *auth.JWTClaims, permission string) bool {
+	for _, p := range claims.Permissions {
+		if p == permission {
+			return true
+		}
+	}
+	return false
+}
+
+// Checks the roles VerifyToken put in the claims from the account, not the ones signed into the token
+func hasRole(claims *auth.JWTClaims, role string) bool {
+	for _, r := range claims.Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,13 @@
+package router
+
+import (
+	"net/http"
+
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+// Compresses JSON responses for clients that accept gzip or deflate.
+// Already compressed content like images passes through untouched.
+func Compress(next http.Handler) http.Handler {
+	return middleware.Compress(5, "application/json")(next)
+}
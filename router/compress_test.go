@@ -0,0 +1,65 @@
+package router
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCompress(t *testing.T) {
+	body := `{"data":[` + strings.Repeat(`{"title":"Survey"},`, 100) + `{}]}`
+	tests := []struct {
+		name           string
+		acceptEncoding string
+		contentType    string
+		wantGzip       bool
+	}{
+		{"gzip accepted", "gzip", "application/json", true},
+		{"gzip among others", "br;q=1.0, gzip;q=0.8", "application/json", true},
+		{"nothing accepted", "", "application/json", false},
+		{"unsupported encoding only", "br", "application/json", false},
+		{"not JSON", "gzip", "image/png", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := Compress(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", tt.contentType)
+				io.WriteString(w, body)
+			}))
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.acceptEncoding != "" {
+				req.Header.Set("Accept-Encoding", tt.acceptEncoding)
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+
+			if gzipped := rec.Header().Get("Content-Encoding") == "gzip"; gzipped != tt.wantGzip {
+				t.Fatalf("Content-Encoding %q, want gzip %t", rec.Header().Get("Content-Encoding"), tt.wantGzip)
+			}
+			got := rec.Body.String()
+			if tt.wantGzip {
+				if !strings.Contains(rec.Header().Get("Vary"), "Accept-Encoding") {
+					t.Errorf("Vary %q, caches would mix up encodings", rec.Header().Get("Vary"))
+				}
+				if rec.Body.Len() >= len(body) {
+					t.Errorf("%d bytes gzipped, %d plain", rec.Body.Len(), len(body))
+				}
+				zr, err := gzip.NewReader(rec.Body)
+				if err != nil {
+					t.Fatal(err)
+				}
+				plain, err := io.ReadAll(zr)
+				if err != nil {
+					t.Fatal(err)
+				}
+				got = string(plain)
+			}
+			if got != body {
+				t.Errorf("body %q, want %q", got, body)
+			}
+		})
+	}
+}
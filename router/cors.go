@@ -0,0 +1,69 @@
+package router
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/go-chi/cors"
+)
+
+/*
+* LoadCORSOptions
+* Builds the CORS policy from env, anything unset keeps the local development default
+* CORS_ALLOWED_ORIGINS, CORS_ALLOWED_METHODS, CORS_ALLOWED_HEADERS, CORS_EXPOSED_HEADERS: comma-separated lists
+* CORS_ALLOW_CREDENTIALS: true/false, can't be used with a * origin
+* CORS_MAX_AGE: seconds browsers may cache a preflight
+ */
+func LoadCORSOptions() (cors.Options, error) {
+	opts := cors.Options{
+		AllowedOrigins:   envList("CORS_ALLOWED_ORIGINS", []string{"http://localhost:*"}),
+		AllowedMethods:   envList("CORS_ALLOWED_METHODS", []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"}),
+		AllowedHeaders:   envList("CORS_ALLOWED_HEADERS", []string{"Accept", "Authorization", "Content-Type", "X-CSRF-Token", "X-API-Key", "X-Request-ID", "Idempotency-Key"}),
+		ExposedHeaders:   envList("CORS_EXPOSED_HEADERS", []string{"Link", "X-Request-ID"}),
+		AllowCredentials: false,
+		MaxAge:           300, // Maximum value not ignored by any of major browsers
+	}
+
+	if v := os.Getenv("CORS_ALLOW_CREDENTIALS"); v != "" {
+		allow, err := strconv.ParseBool(v)
+		if err != nil {
+			return opts, fmt.Errorf("CORS_ALLOW_CREDENTIALS: %w", err)
+		}
+		opts.AllowCredentials = allow
+	}
+	if v := os.Getenv("CORS_MAX_AGE"); v != "" {
+		maxAge, err := strconv.Atoi(v)
+		if err != nil || maxAge < 0 {
+			return opts, fmt.Errorf("CORS_MAX_AGE: %q is not a number of seconds", v)
+		}
+		opts.MaxAge = maxAge
+	}
+
+	// browsers refuse credentials for a wildcard origin, it would also let any site act as the user
+	if opts.AllowCredentials {
+		for _, origin := range opts.AllowedOrigins {
+			if origin == "*" {
+				return opts, errors.New("CORS_ALLOW_CREDENTIALS cannot be combined with a * origin")
+			}
+		}
+	}
+	return opts, nil
+}
+
+// comma-separated values, def when unset
+func envList(key string, def []string) []string {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	var list []string
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
@@ -0,0 +1,173 @@
+package router
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/go-chi/cors"
+)
+
+func TestEnvList(t *testing.T) {
+	def := []string{"default"}
+	tests := []struct {
+		name  string
+		value string
+		want  []string
+	}{
+		{"unset", "", def},
+		{"single", "https://a.example", []string{"https://a.example"}},
+		{"trimmed", " https://a.example , https://b.example ", []string{"https://a.example", "https://b.example"}},
+		{"empty items skipped", "https://a.example,,", []string{"https://a.example"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("CORS_TEST_LIST", tt.value)
+			if got := envList("CORS_TEST_LIST", def); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadCORSOptions(t *testing.T) {
+	tests := []struct {
+		name        string
+		env         map[string]string
+		origins     []string
+		credentials bool
+		maxAge      int
+		wantErr     bool
+	}{
+		{"defaults", nil, []string{"http://localhost:*"}, false, 300, false},
+		{"origins list", map[string]string{"CORS_ALLOWED_ORIGINS": "https://a.example,https://b.example"},
+			[]string{"https://a.example", "https://b.example"}, false, 300, false},
+		{"credentials", map[string]string{"CORS_ALLOWED_ORIGINS": "https://a.example", "CORS_ALLOW_CREDENTIALS": "true"},
+			[]string{"https://a.example"}, true, 300, false},
+		{"max age", map[string]string{"CORS_MAX_AGE": "60"}, []string{"http://localhost:*"}, false, 60, false},
+		{"credentials with wildcard", map[string]string{"CORS_ALLOWED_ORIGINS": "*", "CORS_ALLOW_CREDENTIALS": "true"}, nil, false, 0, true},
+		{"bad credentials flag", map[string]string{"CORS_ALLOW_CREDENTIALS": "sometimes"}, nil, false, 0, true},
+		{"negative max age", map[string]string{"CORS_MAX_AGE": "-1"}, nil, false, 0, true},
+		{"max age not a number", map[string]string{"CORS_MAX_AGE": "5m"}, nil, false, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, key := range []string{"CORS_ALLOWED_ORIGINS", "CORS_ALLOW_CREDENTIALS", "CORS_MAX_AGE"} {
+				t.Setenv(key, tt.env[key])
+			}
+			opts, err := LoadCORSOptions()
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("got no error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(opts.AllowedOrigins, tt.origins) || opts.AllowCredentials != tt.credentials || opts.MaxAge != tt.maxAge {
+				t.Errorf("got origins %q, credentials %t, max age %d", opts.AllowedOrigins, opts.AllowCredentials, opts.MaxAge)
+			}
+		})
+	}
+}
+
+func TestCORSOriginMatching(t *testing.T) {
+	t.Setenv("CORS_ALLOWED_ORIGINS", "https://app.example,http://localhost:*")
+	opts, err := LoadCORSOptions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := cors.Handler(opts)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	tests := []struct {
+		origin  string
+		allowed bool
+	}{
+		{"https://app.example", true},
+		{"http://localhost:3000", true},
+		{"http://localhost:8080", true},
+		{"https://evil.example", false},
+		{"http://app.example", false},
+		{"https://app.example.evil", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.origin, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/projects", nil)
+			req.Header.Set("Origin", tt.origin)
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			want := ""
+			if tt.allowed {
+				want = tt.origin
+			}
+			if got := rec.Header().Get("Access-Control-Allow-Origin"); got != want {
+				t.Errorf("Access-Control-Allow-Origin %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestCORSPreflight(t *testing.T) {
+	t.Setenv("CORS_ALLOWED_ORIGINS", "https://app.example")
+	t.Setenv("CORS_ALLOW_CREDENTIALS", "true")
+	opts, err := LoadCORSOptions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	reached := false
+	handler := cors.Handler(opts)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reached = true
+	}))
+
+	tests := []struct {
+		name    string
+		origin  string
+		method  string
+		headers string
+		allowed bool
+	}{
+		{"allowed", "https://app.example", http.MethodPut, "Authorization, Idempotency-Key", true},
+		{"unknown origin", "https://evil.example", http.MethodPut, "Authorization", false},
+		{"method not allowed", "https://app.example", http.MethodPatch, "Authorization", false},
+		{"header not allowed", "https://app.example", http.MethodPost, "X-Secret", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reached = false
+			req := httptest.NewRequest(http.MethodOptions, "/projects/1", nil)
+			req.Header.Set("Origin", tt.origin)
+			req.Header.Set("Access-Control-Request-Method", tt.method)
+			req.Header.Set("Access-Control-Request-Headers", tt.headers)
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			if reached {
+				t.Error("preflight reached the handler")
+			}
+			gotOrigin := rec.Header().Get("Access-Control-Allow-Origin")
+			if !tt.allowed {
+				if gotOrigin != "" {
+					t.Errorf("Access-Control-Allow-Origin %q, want none", gotOrigin)
+				}
+				return
+			}
+			if gotOrigin != tt.origin {
+				t.Errorf("Access-Control-Allow-Origin %q, want %q", gotOrigin, tt.origin)
+			}
+			if got := rec.Header().Get("Access-Control-Allow-Methods"); got != tt.method {
+				t.Errorf("Access-Control-Allow-Methods %q, want %q", got, tt.method)
+			}
+			if got := rec.Header().Get("Access-Control-Allow-Credentials"); got != "true" {
+				t.Errorf("Access-Control-Allow-Credentials %q, want true", got)
+			}
+			if got := rec.Header().Get("Access-Control-Max-Age"); got != "300" {
+				t.Errorf("Access-Control-Max-Age %q, want 300", got)
+			}
+		})
+	}
+}
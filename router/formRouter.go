@@ -0,0 +1,144 @@
+package router
+
+import (
+	"main/model"
+	"main/service"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+)
+
+type FormRouter struct {
+	formService         *service.FormService
+	formResponseService *service.FormResponseService
+	idempotency         IdempotencyStore
+}
+
+func NewFormRouter() *FormRouter {
+	return &FormRouter{
+		formService:         service.NewFormService(),
+		formResponseService: service.NewFormResponseService(),
+		idempotency:         NewMemoryIdempotencyStore(idempotencyTTL),
+	}
+}
+
+func (fr *FormRouter) Routes() chi.Router {
+	r := chi.NewRouter()
+	r.With(RequirePermission(model.PermissionReadForms)).Get("/", fr.getForms)
+	r.With(RequirePermission(model.PermissionReadForms)).Get("/{id}", fr.getFormById)
+	r.With(RequirePermission(model.PermissionCreateForms), Idempotency(fr.idempotency)).Post("/", fr.createForm)
+	r.Group(func(r chi.Router) {
+		r.Use(RequirePermission(model.PermissionUpdateForms))
+		r.Put("/{id}", fr.updateForm)
+		r.Post("/{id}/questions", fr.addQuestion)
+		r.Delete("/{id}/questions/{questionId}", fr.removeQuestion)
+	})
+	r.With(RequirePermission(model.PermissionDeleteForms)).Delete("/{id}", fr.deleteForm)
+	r.With(RequirePermission(model.PermissionSubmitResponses), Idempotency(fr.idempotency)).
+		Post("/{id}/responses", fr.submitResponse)
+	r.With(RequirePermission(model.PermissionReadResponses)).Get("/{id}/responses", fr.getResponses)
+	return r
+}
+
+func (fr *FormRouter) getForms(w http.ResponseWriter, r *http.Request) {
+	page, limit := getPagination(r)
+	forms, err := fr.formService.GetForms(r.Context(), page, limit)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	writeJSON(w, r, http.StatusOK, forms)
+}
+
+func (fr *FormRouter) getFormById(w http.ResponseWriter, r *http.Request) {
+	form, err := fr.formService.GetFormById(r.Context(), chi.URLParam(r, "id"))
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	writeJSONWithETag(w, r, form)
+}
+
+func (fr *FormRouter) createForm(w http.ResponseWriter, r *http.Request) {
+	var form model.Form
+	if !decodeJSON(w, r, &form) {
+		return
+	}
+	rs, err := fr.formService.CreateForm(r.Context(), &form)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	writeJSON(w, r, http.StatusOK, rs)
+}
+
+func (fr *FormRouter) updateForm(w http.ResponseWriter, r *http.Request) {
+	var req model.FormUpdateRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	form, err := fr.formService.UpdateForm(r.Context(), chi.URLParam(r, "id"), &req)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	writeJSON(w, r, http.StatusOK, form)
+}
+
+func (fr *FormRouter) deleteForm(w http.ResponseWriter, r *http.Request) {
+	err := fr.formService.DeleteForm(r.Context(), chi.URLParam(r, "id"))
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (fr *FormRouter) addQuestion(w http.ResponseWriter, r *http.Request) {
+	var req model.FormQuestionRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	form, err := fr.formService.AddQuestion(r.Context(), chi.URLParam(r, "id"), req.QuestionId)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	writeJSON(w, r, http.StatusOK, form)
+}
+
+func (fr *FormRouter) removeQuestion(w http.ResponseWriter, r *http.Request) {
+	form, err := fr.formService.RemoveQuestion(r.Context(), chi.URLParam(r, "id"), chi.URLParam(r, "questionId"))
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	writeJSON(w, r, http.StatusOK, form)
+}
+
+func (fr *FormRouter) submitResponse(w http.ResponseWriter, r *http.Request) {
+	var req model.FormResponseRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	var accountId string
+	if claims := ClaimsFromContext(r.Context()); claims != nil {
+		accountId = claims.AccountId
+	}
+	rs, err := fr.formResponseService.SubmitResponse(r.Context(), chi.URLParam(r, "id"), accountId, &req)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	writeJSON(w, r, http.StatusOK, rs)
+}
+
+func (fr *FormRouter) getResponses(w http.ResponseWriter, r *http.Request) {
+	page, limit := getPagination(r)
+	responses, err := fr.formResponseService.GetResponses(r.Context(), chi.URLParam(r, "id"), page, limit)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	writeJSON(w, r, http.StatusOK, responses)
+}
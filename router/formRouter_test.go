@@ -0,0 +1,320 @@
+package router
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"main/model"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+func TestFormResponsesForbidden(t *testing.T) {
+	mt := mtest.New(t, mockDB)
+	defer mt.Close()
+
+	formId := primitive.NewObjectID().Hex()
+	tests := []struct {
+		name   string
+		as     caller
+		method string
+	}{
+		{"submit without permissions", asUserWith(primitive.NewObjectID()), http.MethodPost},
+		{"submit with roles only", asUser(primitive.NewObjectID(), "user", "admin"), http.MethodPost},
+		{"submit with an unrelated scope", asAPIKey(model.PermissionReadResponses), http.MethodPost},
+		{"list as a respondent", asUserWith(primitive.NewObjectID(), model.PermissionReadForms, model.PermissionSubmitResponses), http.MethodGet},
+		{"list with an unrelated scope", asAPIKey(model.PermissionSubmitResponses, "manage:projects"), http.MethodGet},
+		{"list unauthenticated", anonymous, http.MethodGet},
+	}
+	for _, tt := range tests {
+		mt.Run(tt.name, func(mt *mtest.T) {
+			t := mt.T
+			useMock(mt)
+			// no replies queued, reaching the database fails the request with a 500
+			rec := serve(NewFormRouter().Routes(), tt.as, tt.method, "/"+formId+"/responses", `{"answers": []}`)
+			if rec.Code != http.StatusForbidden {
+				t.Fatalf("status %d, want 403: %s", rec.Code, rec.Body)
+			}
+			if len(mt.GetAllStartedEvents()) > 0 {
+				t.Errorf("the database was queried")
+			}
+		})
+	}
+}
+
+func TestSubmitFormResponse(t *testing.T) {
+	mt := mtest.New(t, mockDB)
+	defer mt.Close()
+
+	accountId, userId := primitive.NewObjectID(), primitive.NewObjectID()
+	question := model.Question{Id: primitive.NewObjectID(), Type: model.QuestionText, Validation: &model.QuestionValidation{Required: true}}
+	form := model.Form{ID: primitive.NewObjectID(), Name: "feedback", Questions: []primitive.ObjectID{question.Id}}
+	body := `{"answers": [{"questionId": "` + question.Id.Hex() + `", "value": "great"}]}`
+
+	tests := []struct {
+		name           string
+		as             caller
+		wantRespondent primitive.ObjectID
+	}{
+		{"user answers as themselves", asUserWith(accountId, model.PermissionSubmitResponses), userId},
+		{"service client answers anonymously", asAPIKey(model.PermissionSubmitResponses), primitive.NilObjectID},
+	}
+	for _, tt := range tests {
+		mt.Run(tt.name, func(mt *mtest.T) {
+			t := mt.T
+			useMock(mt)
+			if tt.wantRespondent != primitive.NilObjectID {
+				mt.AddMockResponses(cursorReply(t, "user", bson.M{"_id": userId}))
+			}
+			mt.AddMockResponses(
+				cursorReply(t, "form", form),
+				cursorReply(t, "question", question),
+				mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}),
+			)
+
+			rec := serve(NewFormRouter().Routes(), tt.as, http.MethodPost, "/"+form.ID.Hex()+"/responses", body)
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status %d: %s", rec.Code, rec.Body)
+			}
+			inserted := sentCommand(t, mt, "insert").Lookup("documents").Array().Index(0).Value().Document()
+			var response model.FormResponse
+			if err := bson.Unmarshal(inserted, &response); err != nil {
+				t.Fatal(err)
+			}
+			if response.FormId != form.ID || response.RespondentId != tt.wantRespondent || len(response.Answers) != 1 {
+				t.Errorf("stored %+v", response)
+			}
+		})
+	}
+}
+
+func TestGetFormResponses(t *testing.T) {
+	mt := mtest.New(t, mockDB)
+	defer mt.Close()
+
+	formId := primitive.NewObjectID()
+	stored := model.FormResponse{ID: primitive.NewObjectID(), FormId: formId, Answers: []model.Answer{{QuestionId: primitive.NewObjectID(), Value: "great"}}}
+
+	tests := []struct {
+		name string
+		as   caller
+	}{
+		{"user", asUserWith(primitive.NewObjectID(), model.PermissionReadForms, model.PermissionReadResponses)},
+		{"service client", asAPIKey(model.PermissionReadResponses)},
+	}
+	for _, tt := range tests {
+		mt.Run(tt.name, func(mt *mtest.T) {
+			t := mt.T
+			useMock(mt)
+			mt.AddMockResponses(pageReply(t, "formResponse", 1, stored))
+
+			rec := serve(NewFormRouter().Routes(), tt.as, http.MethodGet, "/"+formId.Hex()+"/responses", "")
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status %d: %s", rec.Code, rec.Body)
+			}
+			var page model.PagedResponse[model.FormResponse]
+			if err := json.Unmarshal(rec.Body.Bytes(), &page); err != nil {
+				t.Fatal(err)
+			}
+			if len(page.Data) != 1 || page.Data[0].ID != stored.ID || page.Pagination.Total != 1 {
+				t.Errorf("got %+v", page)
+			}
+			match := sentCommand(t, mt, "aggregate").Lookup("pipeline").Array().Index(0).Value().Document().Lookup("$match", "formId")
+			if id, ok := match.ObjectIDOK(); !ok || id != formId {
+				t.Errorf("responses of %v listed, want %s", match, formId.Hex())
+			}
+		})
+	}
+}
+
+func TestFormCRUD(t *testing.T) {
+	mt := mtest.New(t, mockDB)
+	defer mt.Close()
+
+	questionId := primitive.NewObjectID()
+	form := model.Form{ID: primitive.NewObjectID(), Name: "feedback", Questions: []primitive.ObjectID{questionId}}
+	renamed := form
+	renamed.Name = "survey"
+	path := "/" + form.ID.Hex()
+	editor := asUserWith(primitive.NewObjectID(), model.PermissionReadForms, model.PermissionCreateForms,
+		model.PermissionUpdateForms, model.PermissionDeleteForms)
+	countReply := cursorReply(t, "question", bson.M{"_id": 1, "n": 1})
+
+	decodeForm := func(t testing.TB, rec *httptest.ResponseRecorder) model.Form {
+		t.Helper()
+		var got model.Form
+		if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+			t.Fatal(err)
+		}
+		return got
+	}
+
+	tests := []struct {
+		name       string
+		as         caller
+		method     string
+		target     string
+		body       string
+		replies    []bson.D
+		wantStatus int
+		check      func(t testing.TB, mt *mtest.T, rec *httptest.ResponseRecorder)
+	}{
+		{"create", editor, http.MethodPost, "/", `{"name": "feedback", "questions": ["` + questionId.Hex() + `"]}`,
+			[]bson.D{countReply, mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1})}, http.StatusOK,
+			func(t testing.TB, mt *mtest.T, rec *httptest.ResponseRecorder) {
+				var stored model.Form
+				bson.Unmarshal(sentCommand(t, mt, "insert").Lookup("documents").Array().Index(0).Value().Document(), &stored)
+				if stored.Name != "feedback" || len(stored.Questions) != 1 || stored.Questions[0] != questionId {
+					t.Errorf("stored %+v", stored)
+				}
+			}},
+		{"create with an unknown question", editor, http.MethodPost, "/", `{"name": "feedback", "questions": ["` + questionId.Hex() + `"]}`,
+			[]bson.D{cursorReply(t, "question")}, http.StatusNotFound, nil},
+		{"list", editor, http.MethodGet, "/", "", []bson.D{pageReply(t, "form", 1, form)}, http.StatusOK,
+			func(t testing.TB, mt *mtest.T, rec *httptest.ResponseRecorder) {
+				var page model.PagedResponse[model.Form]
+				json.Unmarshal(rec.Body.Bytes(), &page)
+				if len(page.Data) != 1 || page.Data[0].ID != form.ID {
+					t.Errorf("got %+v", page)
+				}
+			}},
+		{"get", editor, http.MethodGet, path, "", []bson.D{cursorReply(t, "form", form)}, http.StatusOK,
+			func(t testing.TB, mt *mtest.T, rec *httptest.ResponseRecorder) {
+				if got := decodeForm(t, rec); got.ID != form.ID || rec.Header().Get("ETag") == "" {
+					t.Errorf("got %+v with ETag %q", got, rec.Header().Get("ETag"))
+				}
+			}},
+		{"get unknown", editor, http.MethodGet, path, "", []bson.D{cursorReply(t, "form")}, http.StatusNotFound, nil},
+		{"update", editor, http.MethodPut, path, `{"name": "survey"}`, []bson.D{findAndModifyReply(t, renamed)}, http.StatusOK,
+			func(t testing.TB, mt *mtest.T, rec *httptest.ResponseRecorder) {
+				if got := decodeForm(t, rec); got.Name != "survey" {
+					t.Errorf("got %+v", got)
+				}
+				set := sentCommand(t, mt, "findAndModify").Lookup("update", "$set")
+				if name := set.Document().Lookup("name").StringValue(); name != "survey" {
+					t.Errorf("$set %v", set)
+				}
+			}},
+		{"attach a question", editor, http.MethodPost, path + "/questions", `{"questionId": "` + questionId.Hex() + `"}`,
+			[]bson.D{countReply, findAndModifyReply(t, form)}, http.StatusOK,
+			func(t testing.TB, mt *mtest.T, rec *httptest.ResponseRecorder) {
+				added := sentCommand(t, mt, "findAndModify").Lookup("update", "$addToSet", "questions")
+				if id, _ := added.ObjectIDOK(); id != questionId {
+					t.Errorf("$addToSet %v", added)
+				}
+			}},
+		{"detach a question", editor, http.MethodDelete, path + "/questions/" + questionId.Hex(), "",
+			[]bson.D{findAndModifyReply(t, renamed)}, http.StatusOK,
+			func(t testing.TB, mt *mtest.T, rec *httptest.ResponseRecorder) {
+				pulled := sentCommand(t, mt, "findAndModify").Lookup("update", "$pull", "questions")
+				if id, _ := pulled.ObjectIDOK(); id != questionId {
+					t.Errorf("$pull %v", pulled)
+				}
+			}},
+		{"delete", editor, http.MethodDelete, path, "", []bson.D{
+			mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}),
+			mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}, bson.E{Key: "nModified", Value: 1}),
+			mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 3}),
+			mtest.CreateSuccessResponse(), // commitTransaction
+		}, http.StatusNoContent,
+			func(t testing.TB, mt *mtest.T, rec *httptest.ResponseRecorder) {
+				var responses bson.Raw
+				for _, e := range mt.GetAllStartedEvents() {
+					if e.CommandName == "delete" && e.Command.Lookup("delete").StringValue() == "formResponse" {
+						responses = e.Command.Lookup("deletes").Array().Index(0).Value().Document()
+					}
+				}
+				if responses == nil {
+					t.Fatal("responses of the form not deleted")
+				}
+				if id, _ := responses.Lookup("q", "formId").ObjectIDOK(); id != form.ID {
+					t.Errorf("deleted responses of %v", responses.Lookup("q"))
+				}
+				if limit := responses.Lookup("limit").Int32(); limit != 0 {
+					t.Errorf("only %d response deleted", limit)
+				}
+			}},
+		{"delete unknown", editor, http.MethodDelete, path, "", []bson.D{
+			mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 0}),
+			mtest.CreateSuccessResponse(), // abortTransaction
+		}, http.StatusNotFound,
+			func(t testing.TB, mt *mtest.T, rec *httptest.ResponseRecorder) {
+				for _, e := range mt.GetAllStartedEvents() {
+					if e.CommandName == "delete" && e.Command.Lookup("delete").StringValue() == "formResponse" {
+						t.Error("responses deleted for a form that doesn't exist")
+					}
+				}
+			}},
+	}
+	for _, tt := range tests {
+		mt.Run(tt.name, func(mt *mtest.T) {
+			t := mt.T
+			useMock(mt)
+			mt.AddMockResponses(tt.replies...)
+
+			rec := serve(NewFormRouter().Routes(), tt.as, tt.method, tt.target, tt.body)
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+			if tt.check != nil {
+				tt.check(t, mt, rec)
+			}
+		})
+	}
+}
+
+func TestFormRoutesForbidden(t *testing.T) {
+	mt := mtest.New(t, mockDB)
+	defer mt.Close()
+
+	path := "/" + primitive.NewObjectID().Hex()
+	// every permission but the one the route needs
+	allBut := func(permission string) caller {
+		var granted []string
+		for _, p := range []string{model.PermissionReadForms, model.PermissionCreateForms, model.PermissionUpdateForms,
+			model.PermissionDeleteForms, model.PermissionSubmitResponses, model.PermissionReadResponses} {
+			if p != permission {
+				granted = append(granted, p)
+			}
+		}
+		return asUserWith(primitive.NewObjectID(), granted...)
+	}
+
+	tests := []struct {
+		method     string
+		target     string
+		permission string
+	}{
+		{http.MethodGet, "/", model.PermissionReadForms},
+		{http.MethodGet, path, model.PermissionReadForms},
+		{http.MethodPost, "/", model.PermissionCreateForms},
+		{http.MethodPut, path, model.PermissionUpdateForms},
+		{http.MethodPost, path + "/questions", model.PermissionUpdateForms},
+		{http.MethodDelete, path + "/questions/" + primitive.NewObjectID().Hex(), model.PermissionUpdateForms},
+		{http.MethodDelete, path, model.PermissionDeleteForms},
+	}
+	for _, tt := range tests {
+		for name, as := range map[string]caller{
+			"user without " + tt.permission: allBut(tt.permission),
+			"admin role only":               asUser(primitive.NewObjectID(), "admin"),
+			"other scopes":                  asAPIKey(model.PermissionSubmitResponses),
+			"unauthenticated":               anonymous,
+		} {
+			mt.Run(tt.method+" "+tt.target+" as "+name, func(mt *mtest.T) {
+				t := mt.T
+				useMock(mt)
+				rec := serve(NewFormRouter().Routes(), as, tt.method, tt.target, `{}`)
+				if rec.Code != http.StatusForbidden {
+					t.Errorf("status %d, want 403", rec.Code)
+				}
+				if len(mt.GetAllStartedEvents()) > 0 {
+					t.Errorf("the database was queried")
+				}
+			})
+		}
+	}
+}
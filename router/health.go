@@ -0,0 +1,87 @@
+package router
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"main/db"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi/v5/middleware"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+)
+
+type HealthRouter struct {
+	// build info, see main.version
+	version   string
+	commit    string
+	buildTime string
+	startTime time.Time
+	// dependencies /ready checks, by name
+	checks map[string]func(ctx context.Context) error
+}
+
+func NewHealthRouter(version string, commit string, buildTime string) *HealthRouter {
+	return &HealthRouter{
+		version:   version,
+		commit:    commit,
+		buildTime: buildTime,
+		startTime: time.Now(),
+		checks: map[string]func(ctx context.Context) error{
+			"mongodb": func(ctx context.Context) error {
+				return db.MongoClient.Ping(ctx, readpref.Primary())
+			},
+		},
+	}
+}
+
+type dependencyStatus struct {
+	Status string `json:"status"`
+}
+
+// Liveness, the process is up. Never touches a dependency so it stays cheap.
+func (hr *HealthRouter) Health(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":  "ok",
+		"version": hr.version,
+		"uptime":  time.Since(hr.startTime).Round(time.Second).String(),
+	})
+}
+
+// What is deployed, for support requests and deploy checks
+func (hr *HealthRouter) Version(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"version":       hr.version,
+		"commit":        hr.commit,
+		"buildTime":     hr.buildTime,
+		"authProviders": []string{"local", "api-key"},
+	})
+}
+
+// Readiness, every dependency answers. 503 as soon as one doesn't.
+// It's open to anyone, why a dependency is down only goes to the log.
+func (hr *HealthRouter) Ready(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := db.WithTimeout(r.Context())
+	defer cancel()
+
+	status, code := "ok", http.StatusOK
+	dependencies := map[string]dependencyStatus{}
+	for name, check := range hr.checks {
+		if err := check(ctx); err != nil {
+			log.Printf("[%s] readiness: %s is down: %v", middleware.GetReqID(r.Context()), name, err)
+			dependencies[name] = dependencyStatus{Status: "down"}
+			status, code = "unavailable", http.StatusServiceUnavailable
+			continue
+		}
+		dependencies[name] = dependencyStatus{Status: "ok"}
+	}
+
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":       status,
+		"version":      hr.version,
+		"uptime":       time.Since(hr.startTime).Round(time.Second).String(),
+		"dependencies": dependencies,
+	})
+}
@@ -0,0 +1,115 @@
+package router
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"main/auth"
+	"main/db"
+	"main/model"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+// Shared by the router tests. Handlers touching the database run against the driver's mock
+// deployment: every test queues the replies of the commands it expects, in order.
+
+var mockDB = mtest.NewOptions().ClientType(mtest.Mock)
+
+// Points the db package at the mock deployment, routers and services have to be created after
+func useMock(mt *mtest.T) {
+	db.MongoClient = mt.Client
+	db.MongoDatabase = mt.DB
+}
+
+// reply to a find or aggregate
+func cursorReply(t testing.TB, coll string, docs ...interface{}) bson.D {
+	batch := make([]bson.D, 0, len(docs))
+	for _, d := range docs {
+		batch = append(batch, toDoc(t, d))
+	}
+	return mtest.CreateCursorResponse(0, "test."+coll, mtest.FirstBatch, batch...)
+}
+
+// reply to an AggregatePaged query
+func pageReply(t testing.TB, coll string, total int, docs ...interface{}) bson.D {
+	data := bson.A{}
+	for _, d := range docs {
+		data = append(data, toDoc(t, d))
+	}
+	counts := bson.A{}
+	if total > 0 {
+		counts = append(counts, bson.D{{Key: "count", Value: int64(total)}})
+	}
+	return cursorReply(t, coll, bson.D{{Key: "data", Value: data}, {Key: "total", Value: counts}})
+}
+
+// reply to a FindOneAndUpdate/Delete, doc nil when nothing matched
+func findAndModifyReply(t testing.TB, doc interface{}) bson.D {
+	if doc == nil {
+		return mtest.CreateSuccessResponse(bson.E{Key: "value", Value: nil})
+	}
+	return mtest.CreateSuccessResponse(bson.E{Key: "value", Value: toDoc(t, doc)})
+}
+
+func toDoc(t testing.TB, v interface{}) bson.D {
+	t.Helper()
+	raw, err := bson.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var d bson.D
+	if err := bson.Unmarshal(raw, &d); err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+// The command of the started event name, fails when there's none
+func sentCommand(t testing.TB, mt *mtest.T, name string) bson.Raw {
+	t.Helper()
+	for _, e := range mt.GetAllStartedEvents() {
+		if e.CommandName == name {
+			return e.Command
+		}
+	}
+	t.Fatalf("no %s command sent", name)
+	return nil
+}
+
+// Who the request comes from, as Authenticate or APIKeyAuth would have put it in the context
+type caller func(ctx context.Context) context.Context
+
+func anonymous(ctx context.Context) context.Context { return ctx }
+
+func asUser(accountId primitive.ObjectID, roles ...string) caller {
+	return func(ctx context.Context) context.Context {
+		return context.WithValue(ctx, claimsContextKey{}, &auth.JWTClaims{AccountId: accountId.Hex(), Roles: roles})
+	}
+}
+
+// a user whose roles grant permissions, as VerifyToken fills them in
+func asUserWith(accountId primitive.ObjectID, permissions ...string) caller {
+	return func(ctx context.Context) context.Context {
+		return context.WithValue(ctx, claimsContextKey{}, &auth.JWTClaims{AccountId: accountId.Hex(), Permissions: permissions})
+	}
+}
+
+func asAPIKey(scopes ...string) caller {
+	return func(ctx context.Context) context.Context {
+		return context.WithValue(ctx, apiKeyContextKey{}, &model.APIKey{ID: primitive.NewObjectID(), Scopes: scopes})
+	}
+}
+
+func serve(h http.Handler, as caller, method string, target string, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	req = req.WithContext(as(req.Context()))
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
@@ -0,0 +1,204 @@
+package router
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const idempotencyHeader = "Idempotency-Key"
+
+// how long a response is kept for replay
+const idempotencyTTL = 24 * time.Hour
+
+var (
+	errIdempotencyInFlight = errors.New("a request with this Idempotency-Key is still in progress")
+	errIdempotencyMismatch = errors.New("Idempotency-Key was already used for a different request")
+)
+
+type IdempotentResponse struct {
+	Status int
+	Header http.Header
+	Body   []byte
+}
+
+// Responses remembered by key, in memory for now (so per instance)
+type IdempotencyStore interface {
+	// Begin claims key for a request with the given fingerprint. It returns the stored response
+	// when the key is already done, errIdempotencyInFlight or errIdempotencyMismatch otherwise.
+	Begin(key string, fingerprint string) (*IdempotentResponse, error)
+	Finish(key string, resp *IdempotentResponse)
+	// Abort frees the key so the request can be retried
+	Abort(key string)
+}
+
+/*
+* Idempotency
+* When a request carries an Idempotency-Key, the first response is stored and replayed for
+* retries of the same request instead of running the handler again. A retry arriving while
+* the first one is still running gets 409, so does reusing the key for another request.
+* Server errors aren't stored, the client can retry those for real.
+ */
+func Idempotency(store IdempotencyStore) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			key := r.Header.Get(idempotencyHeader)
+			if key == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			body, err := io.ReadAll(r.Body)
+			if err != nil {
+				writeErrorMessage(w, r, http.StatusBadRequest, "cannot read request body")
+				return
+			}
+			r.Body = io.NopCloser(bytes.NewReader(body))
+			sum := sha256.Sum256(append([]byte(r.Method+" "+r.URL.Path+"\n"), body...))
+			// keys are scoped to the caller and the endpoint, another caller can't replay our response
+			key = idempotencyCaller(r) + " " + r.Method + " " + r.URL.Path + " " + key
+
+			stored, err := store.Begin(key, hex.EncodeToString(sum[:]))
+			if err != nil {
+				code := "IDEMPOTENCY_IN_FLIGHT"
+				if errors.Is(err, errIdempotencyMismatch) {
+					code = "IDEMPOTENCY_KEY_REUSED"
+				}
+				writeErrorWithCode(w, r, http.StatusConflict, code, err.Error())
+				return
+			}
+			if stored != nil {
+				for name, values := range stored.Header {
+					w.Header()[name] = values
+				}
+				w.Header().Set("Idempotent-Replayed", "true")
+				w.WriteHeader(stored.Status)
+				w.Write(stored.Body)
+				return
+			}
+
+			rec := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+			defer func() {
+				// a panicking handler must not leave the key in flight forever
+				if p := recover(); p != nil {
+					store.Abort(key)
+					panic(p)
+				}
+				if rec.status >= 500 {
+					store.Abort(key)
+					return
+				}
+				header := w.Header().Clone()
+				// set again by the outer middleware on replay
+				for _, name := range []string{"Content-Encoding", "Content-Length", "Vary", requestIDHeader} {
+					header.Del(name)
+				}
+				store.Finish(key, &IdempotentResponse{Status: rec.status, Header: header, Body: rec.body.Bytes()})
+			}()
+			next.ServeHTTP(rec, r)
+		})
+	}
+}
+
+// Who sent the request, empty when nobody is authenticated
+func idempotencyCaller(r *http.Request) string {
+	if claims := ClaimsFromContext(r.Context()); claims != nil {
+		return "account:" + claims.AccountId
+	}
+	if apiKey := APIKeyFromContext(r.Context()); apiKey != nil {
+		return "apikey:" + apiKey.ID.Hex()
+	}
+	return ""
+}
+
+// passes the response through while keeping a copy
+type responseRecorder struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+	body        bytes.Buffer
+}
+
+func (rr *responseRecorder) WriteHeader(status int) {
+	if !rr.wroteHeader {
+		rr.status, rr.wroteHeader = status, true
+	}
+	rr.ResponseWriter.WriteHeader(status)
+}
+
+func (rr *responseRecorder) Write(b []byte) (int, error) {
+	rr.wroteHeader = true
+	rr.body.Write(b)
+	return rr.ResponseWriter.Write(b)
+}
+
+type idempotencyEntry struct {
+	fingerprint string
+	response    *IdempotentResponse // nil while in flight
+	expires     time.Time
+}
+
+type memoryIdempotencyStore struct {
+	mu        sync.Mutex
+	entries   map[string]*idempotencyEntry
+	ttl       time.Duration
+	lastSweep time.Time
+}
+
+func NewMemoryIdempotencyStore(ttl time.Duration) IdempotencyStore {
+	return &memoryIdempotencyStore{entries: map[string]*idempotencyEntry{}, ttl: ttl, lastSweep: time.Now()}
+}
+
+func (s *memoryIdempotencyStore) Begin(key string, fingerprint string) (*IdempotentResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.sweep(time.Now())
+
+	e, ok := s.entries[key]
+	if ok && e.response != nil && time.Now().After(e.expires) {
+		ok = false
+	}
+	if !ok {
+		s.entries[key] = &idempotencyEntry{fingerprint: fingerprint}
+		return nil, nil
+	}
+	if e.fingerprint != fingerprint {
+		return nil, errIdempotencyMismatch
+	}
+	if e.response == nil {
+		return nil, errIdempotencyInFlight
+	}
+	return e.response, nil
+}
+
+func (s *memoryIdempotencyStore) Finish(key string, resp *IdempotentResponse) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if e, ok := s.entries[key]; ok {
+		e.response, e.expires = resp, time.Now().Add(s.ttl)
+	}
+}
+
+func (s *memoryIdempotencyStore) Abort(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.entries, key)
+}
+
+func (s *memoryIdempotencyStore) sweep(now time.Time) {
+	if now.Sub(s.lastSweep) < time.Minute {
+		return
+	}
+	s.lastSweep = now
+	for key, e := range s.entries {
+		if e.response != nil && now.After(e.expires) {
+			delete(s.entries, key)
+		}
+	}
+}
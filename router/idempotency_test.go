@@ -0,0 +1,182 @@
+package router
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Counts its runs and answers with the count, so a replay is told apart from a second run
+func countingHandler(runs *int32, status func(run int32) int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		run := atomic.AddInt32(runs, 1)
+		w.Header().Set("Location", fmt.Sprintf("/things/%d", run))
+		w.WriteHeader(status(run))
+		fmt.Fprintf(w, `{"run":%d}`, run)
+	})
+}
+
+func created(int32) int { return http.StatusCreated }
+
+func idempotentRequest(h http.Handler, as caller, key string, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/things", strings.NewReader(body))
+	if key != "" {
+		req.Header.Set(idempotencyHeader, key)
+	}
+	req = req.WithContext(as(req.Context()))
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestIdempotency(t *testing.T) {
+	alice, bob := asUser(primitive.NewObjectID()), asUser(primitive.NewObjectID())
+
+	type request struct {
+		as         caller
+		key        string
+		body       string
+		wantStatus int
+		wantBody   string // empty to skip
+		wantReplay bool
+	}
+	tests := []struct {
+		name     string
+		status   func(run int32) int
+		requests []request
+		wantRuns int32
+	}{
+		{"replays the first response", created, []request{
+			{alice, "k1", `{"a":1}`, http.StatusCreated, `{"run":1}`, false},
+			{alice, "k1", `{"a":1}`, http.StatusCreated, `{"run":1}`, true},
+			{alice, "k1", `{"a":1}`, http.StatusCreated, `{"run":1}`, true},
+		}, 1},
+		{"key reused with another body", created, []request{
+			{alice, "k1", `{"a":1}`, http.StatusCreated, `{"run":1}`, false},
+			{alice, "k1", `{"a":2}`, http.StatusConflict, "", false},
+		}, 1},
+		{"keys belong to their caller", created, []request{
+			{alice, "k1", `{"a":1}`, http.StatusCreated, `{"run":1}`, false},
+			{bob, "k1", `{"a":1}`, http.StatusCreated, `{"run":2}`, false},
+		}, 2},
+		{"no key runs every time", created, []request{
+			{alice, "", `{"a":1}`, http.StatusCreated, `{"run":1}`, false},
+			{alice, "", `{"a":1}`, http.StatusCreated, `{"run":2}`, false},
+		}, 2},
+		{"server errors are retried for real", func(run int32) int {
+			if run == 1 {
+				return http.StatusServiceUnavailable
+			}
+			return http.StatusCreated
+		}, []request{
+			{alice, "k1", `{"a":1}`, http.StatusServiceUnavailable, `{"run":1}`, false},
+			{alice, "k1", `{"a":1}`, http.StatusCreated, `{"run":2}`, false},
+			{alice, "k1", `{"a":1}`, http.StatusCreated, `{"run":2}`, true},
+		}, 2},
+		{"client errors are replayed", func(int32) int { return http.StatusBadRequest }, []request{
+			{alice, "k1", `{}`, http.StatusBadRequest, `{"run":1}`, false},
+			{alice, "k1", `{}`, http.StatusBadRequest, `{"run":1}`, true},
+		}, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var runs int32
+			h := Idempotency(NewMemoryIdempotencyStore(time.Hour))(countingHandler(&runs, tt.status))
+
+			var first *httptest.ResponseRecorder
+			for i, req := range tt.requests {
+				rec := idempotentRequest(h, req.as, req.key, req.body)
+				if rec.Code != req.wantStatus {
+					t.Fatalf("request %d: status %d, want %d: %s", i, rec.Code, req.wantStatus, rec.Body)
+				}
+				if req.wantBody != "" && rec.Body.String() != req.wantBody {
+					t.Errorf("request %d: body %s, want %s", i, rec.Body, req.wantBody)
+				}
+				if replayed := rec.Header().Get("Idempotent-Replayed") == "true"; replayed != req.wantReplay {
+					t.Errorf("request %d: replayed %t, want %t", i, replayed, req.wantReplay)
+				}
+				if req.wantReplay && rec.Header().Get("Location") != first.Header().Get("Location") {
+					t.Errorf("request %d: Location %q, want the stored %q", i, rec.Header().Get("Location"), first.Header().Get("Location"))
+				}
+				if rec.Code == http.StatusConflict {
+					var body errorResponse
+					json.Unmarshal(rec.Body.Bytes(), &body)
+					if body.Code != "IDEMPOTENCY_KEY_REUSED" {
+						t.Errorf("request %d: code %q, want IDEMPOTENCY_KEY_REUSED", i, body.Code)
+					}
+				}
+				if !req.wantReplay {
+					first = rec
+				}
+			}
+			if runs != tt.wantRuns {
+				t.Errorf("handler ran %d times, want %d", runs, tt.wantRuns)
+			}
+		})
+	}
+}
+
+func TestIdempotencyInFlight(t *testing.T) {
+	alice := asUser(primitive.NewObjectID())
+	started, release := make(chan struct{}), make(chan struct{})
+	var runs int32
+	slow := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&runs, 1)
+		close(started)
+		<-release
+		w.WriteHeader(http.StatusCreated)
+	})
+	h := Idempotency(NewMemoryIdempotencyStore(time.Hour))(slow)
+
+	done := make(chan *httptest.ResponseRecorder)
+	go func() { done <- idempotentRequest(h, alice, "k1", `{"a":1}`) }()
+	<-started
+
+	retry := idempotentRequest(h, alice, "k1", `{"a":1}`)
+	var body errorResponse
+	json.Unmarshal(retry.Body.Bytes(), &body)
+	if retry.Code != http.StatusConflict || body.Code != "IDEMPOTENCY_IN_FLIGHT" {
+		t.Errorf("retry got %d %q, want 409 IDEMPOTENCY_IN_FLIGHT", retry.Code, body.Code)
+	}
+
+	close(release)
+	if first := <-done; first.Code != http.StatusCreated {
+		t.Errorf("first request got %d, want 201", first.Code)
+	}
+	if replay := idempotentRequest(h, alice, "k1", `{"a":1}`); replay.Code != http.StatusCreated || replay.Header().Get("Idempotent-Replayed") != "true" {
+		t.Errorf("after it finished got %d replayed %q, want the stored 201", replay.Code, replay.Header().Get("Idempotent-Replayed"))
+	}
+	if runs != 1 {
+		t.Errorf("handler ran %d times, want 1", runs)
+	}
+}
+
+func TestIdempotencyPanicFreesKey(t *testing.T) {
+	alice := asUser(primitive.NewObjectID())
+	var runs int32
+	h := Idempotency(NewMemoryIdempotencyStore(time.Hour))(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&runs, 1) == 1 {
+			panic("boom")
+		}
+		w.WriteHeader(http.StatusCreated)
+	}))
+
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Error("the panic was swallowed")
+			}
+		}()
+		idempotentRequest(h, alice, "k1", `{}`)
+	}()
+	if rec := idempotentRequest(h, alice, "k1", `{}`); rec.Code != http.StatusCreated || runs != 2 {
+		t.Errorf("retry got %d after %d runs, want 201 from a second run", rec.Code, runs)
+	}
+}
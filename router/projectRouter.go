@@ -1,73 +1,195 @@
 package router
 
 import (
-	"encoding/json"
 	"main/model"
 	"main/service"
 	"net/http"
+	"strings"
 
 	"github.com/go-chi/chi/v5"
 )
 
 type ProjectRouter struct {
 	projectService *service.ProjectService
+	idempotency    IdempotencyStore
 }
 
 func NewProjectRouter() *ProjectRouter {
 	return &ProjectRouter{
 		projectService: service.NewProjectService(),
+		idempotency:    NewMemoryIdempotencyStore(idempotencyTTL),
 	}
 }
 
+// scope a service client needs to change any project, users need to own it or be a project manager/admin
+const projectAdminScope = "manage:projects"
+
 func (pr ProjectRouter) Routes() chi.Router {
 	r := chi.NewRouter()
-	r.Post("/", pr.createProject)
+	r.With(Idempotency(pr.idempotency)).Post("/", pr.createProject)
 	r.Get("/", pr.getAllProjects)
 	r.Get("/{id}", pr.getProjectById)
+	r.Group(func(r chi.Router) {
+		r.Use(pr.requireManage)
+		r.Put("/{id}", pr.updateProject)
+		r.Delete("/{id}", pr.deleteProject)
+		r.Post("/{id}/participants", pr.addParticipant)
+		r.Delete("/{id}/participants/{userId}", pr.removeParticipant)
+	})
 	return r
 }
 
+// Only the project's creator, project managers and admins (or service clients with manage:projects) change it
+func (pr *ProjectRouter) requireManage(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if apiKey := APIKeyFromContext(r.Context()); apiKey != nil {
+			if !apiKey.HasScope(projectAdminScope) {
+				writeErrorWithCode(w, r, http.StatusForbidden, "INSUFFICIENT_SCOPE", "missing scope "+projectAdminScope)
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+		claims := ClaimsFromContext(r.Context())
+		if claims == nil {
+			writeErrorWithCode(w, r, http.StatusUnauthorized, CodeUnauthorized, "authentication required")
+			return
+		}
+		if hasRole(claims, "admin") || hasRole(claims, "project_manager") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		owner, err := pr.projectService.IsOwner(r.Context(), chi.URLParam(r, "id"), claims.AccountId)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		if !owner {
+			writeErrorWithCode(w, r, http.StatusForbidden, CodeForbidden, "only the project owner can change it")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// fields GET /projects can be sorted by
+var projectSortFields = map[string]bool{"name": true, "createAt": true, "updateAt": true}
+
+// ?name= filters by name, ?sort=field or ?sort=-field (descending), newest first by default
 func (pr *ProjectRouter) getAllProjects(w http.ResponseWriter, r *http.Request) {
-	projects, err := pr.projectService.GetProjects()
+	page, limit := getPagination(r)
+	query := model.ProjectQuery{
+		Name:      r.URL.Query().Get("name"),
+		SortField: "createAt",
+		SortOrder: -1,
+	}
+	if sort := r.URL.Query().Get("sort"); sort != "" {
+		query.SortField, query.SortOrder = strings.TrimPrefix(sort, "-"), 1
+		if strings.HasPrefix(sort, "-") {
+			query.SortOrder = -1
+		}
+		if !projectSortFields[query.SortField] {
+			writeErrorMessage(w, r, http.StatusBadRequest, "cannot sort by "+query.SortField)
+			return
+		}
+	}
+
+	projects, err := pr.projectService.GetProjects(r.Context(), query, page, limit)
 
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(err.Error()))
+		writeError(w, r, err)
+		return
 	}
 
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(projects)
+	writeJSON(w, r, http.StatusOK, projects)
 }
 
 func (pr *ProjectRouter) getProjectById(w http.ResponseWriter, r *http.Request) {
-	projects, err := pr.projectService.GetProjectById(chi.URLParam(r, "id"))
+	project, err := pr.projectService.GetProjectById(r.Context(), chi.URLParam(r, "id"))
 
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(err.Error()))
+		writeError(w, r, err)
+		return
 	}
 
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(projects)
+	writeJSONWithETag(w, r, project)
 }
 
 func (pr *ProjectRouter) createProject(w http.ResponseWriter, r *http.Request) {
 	var inputProject model.Project
 
-	err := json.NewDecoder(r.Body).Decode(&inputProject)
+	if !decodeJSON(w, r, &inputProject) {
+		return
+	}
+	// users create projects as themselves, only service clients may name the creator
+	if claims := ClaimsFromContext(r.Context()); claims != nil {
+		userId, err := pr.projectService.UserIdOfAccount(r.Context(), claims.AccountId)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		inputProject.CreateBy = userId
+	} else if apiKey := APIKeyFromContext(r.Context()); apiKey == nil || !apiKey.HasScope(projectAdminScope) {
+		writeErrorWithCode(w, r, http.StatusForbidden, "INSUFFICIENT_SCOPE", "missing scope "+projectAdminScope)
+		return
+	}
+
+	rs, err := pr.projectService.CreateProject(r.Context(), &inputProject)
+
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	writeJSON(w, r, http.StatusOK, rs)
+}
+
+func (pr *ProjectRouter) updateProject(w http.ResponseWriter, r *http.Request) {
+	var req model.ProjectUpdateRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+
+	project, err := pr.projectService.UpdateProject(r.Context(), chi.URLParam(r, "id"), &req)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	writeJSON(w, r, http.StatusOK, project)
+}
 
+func (pr *ProjectRouter) deleteProject(w http.ResponseWriter, r *http.Request) {
+	err := pr.projectService.DeleteProject(r.Context(), chi.URLParam(r, "id"))
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(err.Error()))
+		writeError(w, r, err)
+		return
 	}
 
-	rs, err := pr.projectService.CreateProject(&inputProject)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (pr *ProjectRouter) addParticipant(w http.ResponseWriter, r *http.Request) {
+	var req model.ProjectParticipantRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+
+	project, err := pr.projectService.AddParticipant(r.Context(), chi.URLParam(r, "id"), req.UserId)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	writeJSON(w, r, http.StatusOK, project)
+}
 
+func (pr *ProjectRouter) removeParticipant(w http.ResponseWriter, r *http.Request) {
+	project, err := pr.projectService.RemoveParticipant(r.Context(), chi.URLParam(r, "id"), chi.URLParam(r, "userId"))
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(err.Error()))
+		writeError(w, r, err)
+		return
 	}
 
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(rs)
+	writeJSON(w, r, http.StatusOK, project)
 }
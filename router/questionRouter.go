@@ -1,7 +1,6 @@
 package router
 
 import (
-	"encoding/json"
 	"main/model"
 	"main/service"
 	"net/http"
@@ -24,6 +23,7 @@ func NewQRouter() *QuestionRouter {
 func (qr QuestionRouter) Routes() chi.Router {
 	r := chi.NewRouter()
 	r.Post("/", qr.setQuestionMongo)
+	r.Post("/batch", qr.createQuestions)
 	r.Get("/", qr.getAllQuestions)
 	return r
 }
@@ -31,32 +31,45 @@ func (qr QuestionRouter) Routes() chi.Router {
 func (qr *QuestionRouter) setQuestionMongo(w http.ResponseWriter, r *http.Request) {
 	var inputQuestion model.Question
 
-	err := json.NewDecoder(r.Body).Decode(&inputQuestion)
+	if !decodeJSON(w, r, &inputQuestion) {
+		return
+	}
+
+	rs, err := qr.questionService.CreateQuestion(r.Context(), &inputQuestion)
 
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(err.Error()))
+		writeError(w, r, err)
+		return
 	}
 
-	rs, err := qr.questionService.CreateQuestion(&inputQuestion)
+	writeJSON(w, r, http.StatusOK, rs)
+}
 
+func (qr *QuestionRouter) createQuestions(w http.ResponseWriter, r *http.Request) {
+	var req model.QuestionBatchRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	if len(req.Questions) > maxPageLimit {
+		writeErrorMessage(w, r, http.StatusBadRequest, "too many questions")
+		return
+	}
+	rs, err := qr.questionService.CreateQuestions(r.Context(), req.Questions)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(err.Error()))
+		writeError(w, r, err)
+		return
 	}
-
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(rs)
+	writeJSON(w, r, http.StatusOK, rs)
 }
 
 func (qr *QuestionRouter) getAllQuestions(w http.ResponseWriter, r *http.Request) {
-	questions, err := qr.questionService.GetAllQuestions()
+	page, limit := getPagination(r)
+	questions, err := qr.questionService.GetAllQuestions(r.Context(), page, limit)
 
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(err.Error()))
+		writeError(w, r, err)
+		return
 	}
 
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(questions)
+	writeJSON(w, r, http.StatusOK, questions)
 }
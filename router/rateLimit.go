@@ -0,0 +1,107 @@
+package router
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Where the buckets live, in memory for now. A shared store (e.g. Redis) is needed
+// once more than one instance serves the same clients.
+type RateLimitStore interface {
+	// Take uses up one request of key, when none is left it returns how long to wait for the next
+	Take(key string) (bool, time.Duration)
+}
+
+/*
+* RateLimit
+* Token bucket per client: rpm requests a minute on average, bursts of up to burst requests.
+* Clients are told when to come back with 429 and Retry-After.
+ */
+func RateLimit(store RateLimitStore) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ok, wait := store.Take(rateLimitKey(r))
+			if !ok {
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+				writeErrorMessage(w, r, http.StatusTooManyRequests, "too many requests")
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// the caller when the limiter runs after authentication, the client IP otherwise
+// (X-Forwarded-For is ignored as anyone can set it)
+func rateLimitKey(r *http.Request) string {
+	if claims := ClaimsFromContext(r.Context()); claims != nil {
+		return "account:" + claims.AccountId
+	}
+	if apiKey := APIKeyFromContext(r.Context()); apiKey != nil {
+		return "api-key:" + apiKey.ID.Hex()
+	}
+	return "ip:" + clientIP(r)
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+type memoryRateLimitStore struct {
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	rate      float64 // tokens per second
+	burst     float64
+	lastSweep time.Time
+	now       func() time.Time // the clock, replaced in tests
+}
+
+func NewMemoryRateLimitStore(rpm int, burst int) RateLimitStore {
+	return &memoryRateLimitStore{
+		buckets:   map[string]*bucket{},
+		rate:      float64(rpm) / 60,
+		burst:     float64(burst),
+		lastSweep: time.Now(),
+		now:       time.Now,
+	}
+}
+
+func (s *memoryRateLimitStore) Take(key string) (bool, time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	s.sweep(now)
+
+	b, ok := s.buckets[key]
+	if !ok {
+		b = &bucket{tokens: s.burst, last: now}
+		s.buckets[key] = b
+	}
+	b.tokens = math.Min(s.burst, b.tokens+now.Sub(b.last).Seconds()*s.rate)
+	b.last = now
+
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / s.rate * float64(time.Second))
+	}
+	b.tokens--
+	return true, 0
+}
+
+// drops buckets that refilled completely, they'd start full anyway
+func (s *memoryRateLimitStore) sweep(now time.Time) {
+	if now.Sub(s.lastSweep) < time.Minute {
+		return
+	}
+	s.lastSweep = now
+	full := time.Duration(s.burst / s.rate * float64(time.Second))
+	for key, b := range s.buckets {
+		if now.Sub(b.last) > full {
+			delete(s.buckets, key)
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package router
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestMemoryRateLimitStoreTake(t *testing.T) {
+	type take struct {
+		after    time.Duration // since the previous take
+		wantOK   bool
+		wantWait time.Duration
+	}
+	tests := []struct {
+		name  string
+		rpm   int
+		burst int
+		takes []take
+	}{
+		{"burst then empty", 60, 3, []take{
+			{0, true, 0}, {0, true, 0}, {0, true, 0},
+			{0, false, time.Second},
+		}},
+		{"refills at the rate", 60, 1, []take{
+			{0, true, 0},
+			{500 * time.Millisecond, false, 500 * time.Millisecond},
+			{500 * time.Millisecond, true, 0},
+		}},
+		{"refill stops at burst", 60, 2, []take{
+			{0, true, 0},
+			{time.Hour, true, 0}, {0, true, 0},
+			{0, false, time.Second},
+		}},
+		{"slow rate", 6, 1, []take{
+			{0, true, 0},
+			{0, false, 10 * time.Second},
+			{10 * time.Second, true, 0},
+		}},
+		{"a refused request uses nothing up", 60, 1, []take{
+			{0, true, 0},
+			{0, false, time.Second}, {0, false, time.Second},
+			{time.Second, true, 0},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := NewMemoryRateLimitStore(tt.rpm, tt.burst).(*memoryRateLimitStore)
+			clock := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+			store.now = func() time.Time { return clock }
+			for i, tk := range tt.takes {
+				clock = clock.Add(tk.after)
+				ok, wait := store.Take("client")
+				if ok != tk.wantOK || wait.Round(time.Millisecond) != tk.wantWait {
+					t.Fatalf("take %d: got (%t, %s), want (%t, %s)", i, ok, wait, tk.wantOK, tk.wantWait)
+				}
+			}
+		})
+	}
+}
+
+func TestMemoryRateLimitStoreKeysAreSeparate(t *testing.T) {
+	store := NewMemoryRateLimitStore(60, 1)
+	if ok, _ := store.Take("a"); !ok {
+		t.Fatal("first request of a refused")
+	}
+	if ok, _ := store.Take("b"); !ok {
+		t.Fatal("b refused after a used its bucket")
+	}
+	if ok, _ := store.Take("a"); ok {
+		t.Fatal("second request of a allowed")
+	}
+}
+
+func TestRateLimitMiddleware(t *testing.T) {
+	handler := RateLimit(NewMemoryRateLimitStore(6, 1))(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	tests := []struct {
+		wantStatus     int
+		wantRetryAfter string
+	}{
+		{http.StatusNoContent, ""},
+		{http.StatusTooManyRequests, "10"},
+	}
+	for i, tt := range tests {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+		if rec.Code != tt.wantStatus {
+			t.Errorf("request %d: status %d, want %d", i, rec.Code, tt.wantStatus)
+		}
+		if got := rec.Header().Get("Retry-After"); got != tt.wantRetryAfter {
+			t.Errorf("request %d: Retry-After %q, want %q", i, got, tt.wantRetryAfter)
+		}
+	}
+}
@@ -0,0 +1,44 @@
+package router
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/google/uuid"
+)
+
+const requestIDHeader = "X-Request-ID"
+
+// longer ids from clients are replaced, they end up in every log line
+const maxRequestIDLength = 128
+
+/*
+* RequestID
+* Takes the caller's X-Request-ID or makes up a UUID, and echoes it in the response.
+* It's stored under chi's key so middleware.GetReqID(ctx) finds it anywhere down the line,
+* services included, to tag their logs with the same id.
+ */
+func RequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if !validRequestID(id) {
+			id = uuid.NewString()
+		}
+		w.Header().Set(requestIDHeader, id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), middleware.RequestIDKey, id)))
+	})
+}
+
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, c := range id {
+		// printable ASCII, nothing that could forge log lines
+		if c < 0x21 || c > 0x7e {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,64 @@
+package router
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/google/uuid"
+)
+
+func TestRequestID(t *testing.T) {
+	tests := []struct {
+		name     string
+		incoming string // none when empty
+		wantEcho bool   // false when a new id must be generated
+	}{
+		{"echoed", "req-7f3a", true},
+		{"longest kept", strings.Repeat("a", maxRequestIDLength), true},
+		{"missing", "", false},
+		{"too long", strings.Repeat("a", maxRequestIDLength+1), false},
+		{"with a space", "req 1", false},
+		{"forging a log line", "req-1\n[admin] login ok", false},
+		{"non-ASCII", "réq-1", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var seen string
+			h := RequestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				seen = middleware.GetReqID(r.Context())
+			}))
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.incoming != "" {
+				req.Header.Set(requestIDHeader, tt.incoming)
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+
+			got := rec.Header().Get(requestIDHeader)
+			if got != seen {
+				t.Errorf("responded %q, handlers saw %q", got, seen)
+			}
+			if tt.wantEcho {
+				if got != tt.incoming {
+					t.Errorf("got %q, want the incoming %q", got, tt.incoming)
+				}
+				return
+			}
+			if _, err := uuid.Parse(got); err != nil || got == tt.incoming {
+				t.Errorf("got %q, want a generated UUID", got)
+			}
+		})
+	}
+
+	// generated ids differ between requests
+	h := RequestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	first, second := httptest.NewRecorder(), httptest.NewRecorder()
+	h.ServeHTTP(first, httptest.NewRequest(http.MethodGet, "/", nil))
+	h.ServeHTTP(second, httptest.NewRequest(http.MethodGet, "/", nil))
+	if first.Header().Get(requestIDHeader) == second.Header().Get(requestIDHeader) {
+		t.Errorf("two requests got the same id %q", first.Header().Get(requestIDHeader))
+	}
+}
@@ -0,0 +1,254 @@
+package router
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"main/auth"
+	"main/db/builder"
+	"main/model"
+	"main/service"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/go-chi/chi/v5/middleware"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// ?pretty=true is a debugging aid, never honored in production
+func prettyAllowed() bool {
+	return os.Getenv("APP_ENV") != "production"
+}
+
+func writeJSON(w http.ResponseWriter, r *http.Request, status int, v interface{}) {
+	enc := json.NewEncoder(w)
+	if r.URL.Query().Get("pretty") == "true" && prettyAllowed() {
+		enc.SetIndent("", "  ")
+	}
+	w.WriteHeader(status)
+	enc.Encode(v)
+}
+
+// Machine-readable error codes, clients branch on these rather than on messages
+const (
+	CodeValidation         = "VALIDATION_ERROR"
+	CodeBadRequest         = "BAD_REQUEST"
+	CodeInvalidId          = "INVALID_ID"
+	CodeUnauthorized       = "UNAUTHORIZED"
+	CodeForbidden          = "FORBIDDEN"
+	CodeNotFound           = "NOT_FOUND"
+	CodeConflict           = "CONFLICT"
+	CodeVersionConflict    = "VERSION_CONFLICT"
+	CodeRateLimited        = "RATE_LIMITED"
+	CodeBodyTooLarge       = "BODY_TOO_LARGE"
+	CodeInternal           = "INTERNAL_ERROR"
+	CodeServiceUnavailable = "SERVICE_UNAVAILABLE"
+)
+
+// status and code of the errors services return, checked in order with errors.Is
+var errorCodes = []struct {
+	err    error
+	status int
+	code   string
+}{
+	{primitive.ErrInvalidHex, http.StatusBadRequest, CodeInvalidId},
+	{service.ErrMergeSameUser, http.StatusBadRequest, "MERGE_SAME_USER"},
+	{service.ErrUnknownQuestion, http.StatusBadRequest, "UNKNOWN_QUESTION"},
+	{service.ErrDuplicateAnswer, http.StatusBadRequest, "DUPLICATE_ANSWER"},
+	// always a role named in the request, not the resource of the route
+	{service.ErrRoleNotFound, http.StatusBadRequest, "ROLE_NOT_FOUND"},
+	{service.ErrUserNotFound, http.StatusNotFound, "USER_NOT_FOUND"},
+	{service.ErrQuestionNotFound, http.StatusNotFound, "QUESTION_NOT_FOUND"},
+	{service.ErrNoAccount, http.StatusConflict, "NO_ACCOUNT"},
+	{service.ErrNoUserProfile, http.StatusConflict, "NO_USER_PROFILE"},
+	{service.ErrProfileExists, http.StatusConflict, "PROFILE_EXISTS"},
+	{mongo.ErrNoDocuments, http.StatusNotFound, CodeNotFound},
+	{builder.ErrInvalidCursor, http.StatusBadRequest, "INVALID_CURSOR"},
+	{builder.ErrVersionConflict, http.StatusConflict, CodeVersionConflict},
+	// the text index is created at startup, missing means it's still building or was dropped
+	{builder.ErrNoTextIndex, http.StatusServiceUnavailable, "SEARCH_UNAVAILABLE"},
+	{service.ErrDuplicateUsername, http.StatusConflict, "DUPLICATE_USERNAME"},
+	{service.ErrDuplicateEmail, http.StatusConflict, "DUPLICATE_EMAIL"},
+	{service.ErrDuplicateRole, http.StatusConflict, "DUPLICATE_ROLE"},
+	{service.ErrRoleInUse, http.StatusConflict, "ROLE_IN_USE"},
+	{service.ErrDefaultRole, http.StatusConflict, "DEFAULT_ROLE"},
+	{service.ErrInvalidCredentials, http.StatusUnauthorized, "INVALID_CREDENTIALS"},
+	{service.ErrWrongPassword, http.StatusBadRequest, "WRONG_PASSWORD"},
+	{auth.ErrInvalidToken, http.StatusUnauthorized, "TOKEN_INVALID"},
+	{service.ErrInvalidAPIKey, http.StatusUnauthorized, "INVALID_API_KEY"},
+}
+
+// Maps the errors services return to a status code and error code, anything unknown is a 500
+func writeError(w http.ResponseWriter, r *http.Request, err error) {
+	requestId := middleware.GetReqID(r.Context())
+
+	// field-level problems go out as a JSON list
+	var invalid model.ValidationErrors
+	var single model.ValidationError
+	if errors.As(err, &single) {
+		invalid = model.ValidationErrors{single}
+	}
+	if invalid != nil || errors.As(err, &invalid) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(errorResponse{Code: CodeValidation, Error: "validation failed", Errors: invalid, RequestId: requestId})
+		return
+	}
+
+	for _, known := range errorCodes {
+		if errors.Is(err, known.err) {
+			writeErrorWithCode(w, r, known.status, known.code, err.Error())
+			return
+		}
+	}
+	// unknown errors may carry driver or query details, those only go to the log
+	log.Printf("[%s] %s %s: %v", requestId, r.Method, r.URL.Path, err)
+	writeErrorWithCode(w, r, http.StatusInternalServerError, CodeInternal, "internal error")
+}
+
+// Every error body has this shape, whatever the endpoint
+type errorResponse struct {
+	Code      string                 `json:"code"`
+	Error     string                 `json:"error"`
+	Errors    model.ValidationErrors `json:"errors,omitempty"`
+	RequestId string                 `json:"requestId,omitempty"`
+}
+
+// For errors the handler already knows the status of, the code is the generic one for that status
+func writeErrorMessage(w http.ResponseWriter, r *http.Request, status int, msg string) {
+	writeErrorWithCode(w, r, status, statusCode(status), msg)
+}
+
+func writeErrorWithCode(w http.ResponseWriter, r *http.Request, status int, code string, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(errorResponse{Code: code, Error: msg, RequestId: middleware.GetReqID(r.Context())})
+}
+
+func statusCode(status int) string {
+	switch status {
+	case http.StatusBadRequest:
+		return CodeBadRequest
+	case http.StatusUnauthorized:
+		return CodeUnauthorized
+	case http.StatusForbidden:
+		return CodeForbidden
+	case http.StatusNotFound:
+		return CodeNotFound
+	case http.StatusConflict:
+		return CodeConflict
+	case http.StatusRequestEntityTooLarge:
+		return CodeBodyTooLarge
+	case http.StatusTooManyRequests:
+		return CodeRateLimited
+	case http.StatusServiceUnavailable:
+		return CodeServiceUnavailable
+	}
+	return CodeInternal
+}
+
+// Request bodies are read up to this, nothing the API takes comes close
+const maxBodyBytes = 1 << 20
+
+var errBodyTooLarge = errors.New("request body too large")
+
+// Like http.MaxBytesReader, with an error decodeJSON can tell apart
+type limitedBody struct {
+	r    io.Reader
+	left int64
+}
+
+func (l *limitedBody) Read(p []byte) (int, error) {
+	if l.left < 0 {
+		return 0, errBodyTooLarge
+	}
+	// one byte more than allowed tells a body of exactly the limit from a longer one
+	if int64(len(p)) > l.left+1 {
+		p = p[:l.left+1]
+	}
+	n, err := l.r.Read(p)
+	if int64(n) <= l.left {
+		l.left -= int64(n)
+		return n, err
+	}
+	n, l.left = int(l.left), -1
+	return n, errBodyTooLarge
+}
+
+// Decodes the request body into v. On failure it answers 400 (413 past maxBodyBytes) with a message
+// that doesn't expose Go types or internals (the raw error is only logged) and returns false.
+func decodeJSON(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	err := json.NewDecoder(&limitedBody{r: r.Body, left: maxBodyBytes}).Decode(v)
+	if err == nil {
+		return true
+	}
+	log.Printf("[%s] decode %s %s: %v", middleware.GetReqID(r.Context()), r.Method, r.URL.Path, err)
+
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	msg := "invalid request body"
+	switch {
+	case errors.Is(err, errBodyTooLarge):
+		writeErrorMessage(w, r, http.StatusRequestEntityTooLarge, fmt.Sprintf("request body must be at most %d bytes", maxBodyBytes))
+		return false
+	case errors.Is(err, io.EOF):
+		msg = "request body is empty"
+	case errors.Is(err, io.ErrUnexpectedEOF), errors.As(err, &syntaxErr):
+		msg = "request body is not valid JSON"
+	case errors.As(err, &typeErr) && typeErr.Field != "":
+		msg = fmt.Sprintf("field %q must be %s", typeErr.Field, jsonTypeName(typeErr.Type.Kind().String()))
+	}
+	writeErrorMessage(w, r, http.StatusBadRequest, msg)
+	return false
+}
+
+// Go kinds to the names clients know from JSON, with their article
+func jsonTypeName(kind string) string {
+	switch {
+	case kind == "string":
+		return "a string"
+	case kind == "bool":
+		return "a boolean"
+	case kind == "slice" || kind == "array":
+		return "an array"
+	case kind == "map" || kind == "struct":
+		return "an object"
+	case strings.HasPrefix(kind, "int") || strings.HasPrefix(kind, "uint") || strings.HasPrefix(kind, "float"):
+		return "a number"
+	}
+	return "a valid value"
+}
+
+// Like writeJSON with an ETag computed from the content, answers 304 when If-None-Match matches it
+func writeJSONWithETag(w http.ResponseWriter, r *http.Request, v interface{}) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	sum := sha256.Sum256(body)
+	etag := `"` + hex.EncodeToString(sum[:16]) + `"`
+
+	w.Header().Set("ETag", etag)
+	if etagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	writeJSON(w, r, http.StatusOK, v)
+}
+
+func etagMatches(ifNoneMatch string, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == etag || candidate == "*" {
+			return true
+		}
+	}
+	return false
+}
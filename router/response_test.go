@@ -0,0 +1,342 @@
+package router
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io/fs"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"main/auth"
+	"main/db/builder"
+	"main/model"
+	"main/service"
+
+	"github.com/go-chi/chi/v5/middleware"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// The error body of rec, failing unless it is JSON with a code, a message and the request id
+func decodeError(t testing.TB, rec *httptest.ResponseRecorder) errorResponse {
+	t.Helper()
+	if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Content-Type %q, want application/json", ct)
+	}
+	var body errorResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatalf("body is not JSON: %s", rec.Body)
+	}
+	if body.Code == "" || body.Error == "" || body.RequestId == "" {
+		t.Errorf("incomplete error body %s", rec.Body)
+	}
+	return body
+}
+
+func TestWriteError(t *testing.T) {
+	tests := []struct {
+		name       string
+		err        error
+		wantStatus int
+		wantCode   string
+		wantError  string
+		wantFields []string
+	}{
+		{"validation error", model.ValidationError{Field: "name", Message: "is required"},
+			http.StatusBadRequest, CodeValidation, "validation failed", []string{"name"}},
+		{"validation errors", model.ValidationErrors{{Field: "a", Message: "x"}, {Field: "b", Message: "y"}},
+			http.StatusBadRequest, CodeValidation, "validation failed", []string{"a", "b"}},
+		{"known error, wrapped", fmt.Errorf("get: %w", mongo.ErrNoDocuments),
+			http.StatusNotFound, CodeNotFound, "get: " + mongo.ErrNoDocuments.Error(), nil},
+		{"unknown error", errors.New("connection refused to mongodb://admin:hunter2@db"),
+			http.StatusInternalServerError, CodeInternal, "internal error", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var logged bytes.Buffer
+			defer log.SetOutput(log.Writer())
+			log.SetOutput(&logged)
+
+			h := middleware.RequestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				writeError(w, r, tt.err)
+			}))
+			rec := serve(h, anonymous, http.MethodGet, "/", "")
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status %d, want %d", rec.Code, tt.wantStatus)
+			}
+			body := decodeError(t, rec)
+			if body.Code != tt.wantCode || body.Error != tt.wantError {
+				t.Errorf("got %s %q, want %s %q", body.Code, body.Error, tt.wantCode, tt.wantError)
+			}
+			var fields []string
+			for _, e := range body.Errors {
+				fields = append(fields, e.Field)
+			}
+			if strings.Join(fields, ",") != strings.Join(tt.wantFields, ",") {
+				t.Errorf("fields %v, want %v", fields, tt.wantFields)
+			}
+			// details of unknown errors only go to the log
+			if tt.wantStatus == http.StatusInternalServerError {
+				if strings.Contains(rec.Body.String(), "hunter2") || !strings.Contains(logged.String(), tt.err.Error()) {
+					t.Errorf("body %s, log %q", rec.Body, logged.String())
+				}
+			}
+		})
+	}
+}
+
+func TestDecodeJSON(t *testing.T) {
+	type request struct {
+		Name string `json:"name"`
+	}
+	atLimit := `{"name":"` + strings.Repeat("a", maxBodyBytes-len(`{"name":""}`)) + `"}`
+
+	tests := []struct {
+		name       string
+		body       string
+		wantStatus int // 0 when decoded
+		wantCode   string
+		wantError  string
+	}{
+		{"valid", `{"name":"alice"}`, 0, "", ""},
+		{"at the limit", atLimit, 0, "", ""},
+		{"empty", ``, http.StatusBadRequest, CodeBadRequest, "request body is empty"},
+		{"malformed", `{"name":}`, http.StatusBadRequest, CodeBadRequest, "request body is not valid JSON"},
+		{"truncated", `{"name":"al`, http.StatusBadRequest, CodeBadRequest, "request body is not valid JSON"},
+		{"over the limit", atLimit[:len(atLimit)-2] + `a"}`, http.StatusRequestEntityTooLarge, CodeBodyTooLarge,
+			fmt.Sprintf("request body must be at most %d bytes", maxBodyBytes)},
+		{"far over the limit", `{"name":"` + strings.Repeat("a", 4*maxBodyBytes) + `"}`, http.StatusRequestEntityTooLarge, CodeBodyTooLarge,
+			fmt.Sprintf("request body must be at most %d bytes", maxBodyBytes)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer log.SetOutput(log.Writer())
+			log.SetOutput(&bytes.Buffer{})
+
+			var decoded request
+			var ok bool
+			h := middleware.RequestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				ok = decodeJSON(w, r, &decoded)
+			}))
+			rec := serve(h, anonymous, http.MethodPost, "/", tt.body)
+			if tt.wantStatus == 0 {
+				if !ok || rec.Body.Len() > 0 || decoded.Name == "" {
+					t.Errorf("not decoded: %t %s", ok, rec.Body)
+				}
+				return
+			}
+			if ok || rec.Code != tt.wantStatus {
+				t.Fatalf("decoded %t, status %d, want %d", ok, rec.Code, tt.wantStatus)
+			}
+			if body := decodeError(t, rec); body.Code != tt.wantCode || body.Error != tt.wantError {
+				t.Errorf("got %s %q, want %s %q", body.Code, body.Error, tt.wantCode, tt.wantError)
+			}
+		})
+	}
+}
+
+// Every sentinel error of the packages below, by qualified name, with what clients get for it
+var wantErrorCodes = []struct {
+	name   string
+	err    error
+	status int
+	code   string
+}{
+	{"auth.ErrInvalidToken", auth.ErrInvalidToken, http.StatusUnauthorized, "TOKEN_INVALID"},
+	{"builder.ErrInvalidCursor", builder.ErrInvalidCursor, http.StatusBadRequest, "INVALID_CURSOR"},
+	{"builder.ErrVersionConflict", builder.ErrVersionConflict, http.StatusConflict, CodeVersionConflict},
+	{"builder.ErrNoTextIndex", builder.ErrNoTextIndex, http.StatusServiceUnavailable, "SEARCH_UNAVAILABLE"},
+	{"service.ErrUnknownQuestion", service.ErrUnknownQuestion, http.StatusBadRequest, "UNKNOWN_QUESTION"},
+	{"service.ErrDuplicateAnswer", service.ErrDuplicateAnswer, http.StatusBadRequest, "DUPLICATE_ANSWER"},
+	{"service.ErrNoUserProfile", service.ErrNoUserProfile, http.StatusConflict, "NO_USER_PROFILE"},
+	{"service.ErrInvalidCredentials", service.ErrInvalidCredentials, http.StatusUnauthorized, "INVALID_CREDENTIALS"},
+	{"service.ErrWrongPassword", service.ErrWrongPassword, http.StatusBadRequest, "WRONG_PASSWORD"},
+	{"service.ErrDuplicateUsername", service.ErrDuplicateUsername, http.StatusConflict, "DUPLICATE_USERNAME"},
+	{"service.ErrMergeSameUser", service.ErrMergeSameUser, http.StatusBadRequest, "MERGE_SAME_USER"},
+	{"service.ErrUserNotFound", service.ErrUserNotFound, http.StatusNotFound, "USER_NOT_FOUND"},
+	{"service.ErrDuplicateEmail", service.ErrDuplicateEmail, http.StatusConflict, "DUPLICATE_EMAIL"},
+	{"service.ErrRoleNotFound", service.ErrRoleNotFound, http.StatusBadRequest, "ROLE_NOT_FOUND"},
+	{"service.ErrNoAccount", service.ErrNoAccount, http.StatusConflict, "NO_ACCOUNT"},
+	{"service.ErrProfileExists", service.ErrProfileExists, http.StatusConflict, "PROFILE_EXISTS"},
+	{"service.ErrQuestionNotFound", service.ErrQuestionNotFound, http.StatusNotFound, "QUESTION_NOT_FOUND"},
+	{"service.ErrInvalidAPIKey", service.ErrInvalidAPIKey, http.StatusUnauthorized, "INVALID_API_KEY"},
+	{"service.ErrDuplicateRole", service.ErrDuplicateRole, http.StatusConflict, "DUPLICATE_ROLE"},
+	{"service.ErrRoleInUse", service.ErrRoleInUse, http.StatusConflict, "ROLE_IN_USE"},
+	{"service.ErrDefaultRole", service.ErrDefaultRole, http.StatusConflict, "DEFAULT_ROLE"},
+	{"mongo.ErrNoDocuments", mongo.ErrNoDocuments, http.StatusNotFound, CodeNotFound},
+	{"primitive.ErrInvalidHex", primitive.ErrInvalidHex, http.StatusBadRequest, CodeInvalidId},
+}
+
+func TestErrorCodes(t *testing.T) {
+	for _, tt := range wantErrorCodes {
+		t.Run(tt.name, func(t *testing.T) {
+			// services wrap them, the mapping must see through
+			for _, err := range []error{tt.err, fmt.Errorf("context: %w", tt.err)} {
+				h := middleware.RequestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					writeError(w, r, err)
+				}))
+				rec := serve(h, anonymous, http.MethodGet, "/", "")
+				if rec.Code != tt.status {
+					t.Fatalf("%v: status %d, want %d", err, rec.Code, tt.status)
+				}
+				if body := decodeError(t, rec); body.Code != tt.code || body.Error != err.Error() {
+					t.Errorf("%v: got %s %q, want %s with the error message", err, body.Code, body.Error, tt.code)
+				}
+			}
+		})
+	}
+}
+
+// A sentinel added without a mapping would reach clients as a 500
+func TestErrorCodesCoverSentinels(t *testing.T) {
+	listed := map[string]bool{}
+	for _, tt := range wantErrorCodes {
+		listed[tt.name] = true
+	}
+	for _, dir := range []string{"../auth", "../db/builder", "../service"} {
+		pkgs, err := parser.ParseDir(token.NewFileSet(), dir, func(fi fs.FileInfo) bool {
+			return !strings.HasSuffix(fi.Name(), "_test.go")
+		}, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for pkgName, pkg := range pkgs {
+			for _, file := range pkg.Files {
+				for _, decl := range file.Decls {
+					gen, ok := decl.(*ast.GenDecl)
+					if !ok || gen.Tok != token.VAR {
+						continue
+					}
+					for _, spec := range gen.Specs {
+						for _, name := range spec.(*ast.ValueSpec).Names {
+							if qualified := pkgName + "." + name.Name; strings.HasPrefix(name.Name, "Err") && !listed[qualified] {
+								t.Errorf("%s is not in errorCodes (or not in this test)", qualified)
+							}
+						}
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestDecodeJSONTypeMismatch(t *testing.T) {
+	type request struct {
+		Name     string            `json:"name"`
+		Age      int               `json:"age"`
+		Score    float64           `json:"score"`
+		Active   bool              `json:"active"`
+		Tags     []string          `json:"tags"`
+		Settings map[string]string `json:"settings"`
+		Address  struct {
+			City string `json:"city"`
+		} `json:"address"`
+	}
+	tests := []struct {
+		body string
+		want string
+	}{
+		{`{"name":1}`, `field "name" must be a string`},
+		{`{"age":"1"}`, `field "age" must be a number`},
+		{`{"age":1.5}`, `field "age" must be a number`},
+		{`{"score":true}`, `field "score" must be a number`},
+		{`{"active":"yes"}`, `field "active" must be a boolean`},
+		{`{"tags":"a"}`, `field "tags" must be an array`},
+		{`{"settings":[]}`, `field "settings" must be an object`},
+		{`{"address":{"city":2}}`, `field "address.city" must be a string`},
+		{`"alice"`, `invalid request body`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.body, func(t *testing.T) {
+			var logged bytes.Buffer
+			defer log.SetOutput(log.Writer())
+			log.SetOutput(&logged)
+
+			h := middleware.RequestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				var req request
+				decodeJSON(w, r, &req)
+			}))
+			rec := serve(h, anonymous, http.MethodPost, "/", tt.body)
+			if rec.Code != http.StatusBadRequest {
+				t.Fatalf("status %d, want 400", rec.Code)
+			}
+			body := decodeError(t, rec)
+			if body.Code != CodeBadRequest || body.Error != tt.want {
+				t.Errorf("got %s %q, want %s %q", body.Code, body.Error, CodeBadRequest, tt.want)
+			}
+			// Go type names stay in the log
+			if strings.Contains(rec.Body.String(), "float64") || strings.Contains(rec.Body.String(), "router.request") {
+				t.Errorf("body leaks Go types: %s", rec.Body)
+			}
+			if !strings.Contains(logged.String(), "cannot unmarshal") {
+				t.Errorf("raw error not logged: %q", logged.String())
+			}
+		})
+	}
+}
+
+func TestWriteJSONWithETag(t *testing.T) {
+	respond := func(v interface{}) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			writeJSONWithETag(w, r, v)
+		})
+	}
+	get := func(h http.Handler, ifNoneMatch string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		if ifNoneMatch != "" {
+			req.Header.Set("If-None-Match", ifNoneMatch)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	form := map[string]string{"title": "Survey"}
+	first := get(respond(form), "")
+	etag := first.Header().Get("ETag")
+	if first.Code != http.StatusOK || !strings.HasPrefix(etag, `"`) || !strings.HasSuffix(etag, `"`) {
+		t.Fatalf("first response %d with ETag %q", first.Code, etag)
+	}
+	if other := get(respond(map[string]string{"title": "Poll"}), "").Header().Get("ETag"); other == etag {
+		t.Errorf("different content has the same ETag %s", etag)
+	}
+
+	tests := []struct {
+		name        string
+		ifNoneMatch string
+		wantStatus  int
+	}{
+		{"match", etag, http.StatusNotModified},
+		{"weak match", "W/" + etag, http.StatusNotModified},
+		{"match in a list", `"stale", ` + etag, http.StatusNotModified},
+		{"any", "*", http.StatusNotModified},
+		{"mismatch", `"stale"`, http.StatusOK},
+		{"unquoted", strings.Trim(etag, `"`), http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := get(respond(form), tt.ifNoneMatch)
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if rec.Header().Get("ETag") != etag {
+				t.Errorf("ETag %q, want %q", rec.Header().Get("ETag"), etag)
+			}
+			wantBody := first.Body.String()
+			if tt.wantStatus == http.StatusNotModified {
+				wantBody = ""
+			}
+			if rec.Body.String() != wantBody {
+				t.Errorf("body %q, want %q", rec.Body, wantBody)
+			}
+		})
+	}
+}
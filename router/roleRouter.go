@@ -1,10 +1,11 @@
 package router
 
 import (
-	"encoding/json"
 	"main/model"
 	"main/service"
 	"net/http"
+	"os"
+	"strconv"
 
 	"github.com/go-chi/chi/v5"
 )
@@ -19,37 +20,94 @@ func NewRoleRouter() *RoleRouter {
 	}
 }
 
+// scope a service client needs to change roles, users need the admin role
+const roleAdminScope = "admin:roles"
+
 func (ar *RoleRouter) Routes() chi.Router {
 	r := chi.NewRouter()
-	r.Post("/", ar.newRole)
+	r.Get("/", ar.getRoles)
 	r.Get("/{roleId}", ar.getRole)
+	r.Group(func(r chi.Router) {
+		r.Use(RequireRoleOrScope("admin", roleAdminScope))
+		r.Post("/", ar.newRole)
+		r.Post("/sync", ar.syncRoles)
+		r.Put("/{roleId}", ar.updateRole)
+		r.Delete("/{roleId}", ar.deleteRole)
+	})
 	return r
 }
 
+func (ar *RoleRouter) getRoles(w http.ResponseWriter, r *http.Request) {
+	page, limit := getPagination(r)
+	roles, err := ar.roleService.GetRoles(r.Context(), page, limit)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	writeJSON(w, r, http.StatusOK, roles)
+}
+
 func (ar *RoleRouter) getRole(w http.ResponseWriter, r *http.Request) {
 	roleReq := chi.URLParam(r, "roleId")
-	role, err := ar.roleService.GetRole(roleReq)
+	role, err := ar.roleService.GetRole(r.Context(), roleReq)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(err.Error()))
+		writeError(w, r, err)
 		return
 	}
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(role)
+	writeJSON(w, r, http.StatusOK, role)
 }
 
 func (ar *RoleRouter) newRole(w http.ResponseWriter, r *http.Request) {
 	var role model.Role
-	err := json.NewDecoder(r.Body).Decode(&role)
+	if !decodeJSON(w, r, &role) {
+		return
+	}
+	rs, err := ar.roleService.NewRole(r.Context(), role)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	writeJSON(w, r, http.StatusOK, rs)
+}
+
+func (ar *RoleRouter) updateRole(w http.ResponseWriter, r *http.Request) {
+	var req model.RoleUpdateRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	role, err := ar.roleService.UpdateRole(r.Context(), chi.URLParam(r, "roleId"), &req)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	writeJSON(w, r, http.StatusOK, role)
+}
+
+func (ar *RoleRouter) deleteRole(w http.ResponseWriter, r *http.Request) {
+	if err := ar.roleService.DeleteRole(r.Context(), chi.URLParam(r, "roleId")); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Re-reads ROLE_CATALOG_PATH so catalog edits apply without a restart, ?prune=true drops roles not in it
+func (ar *RoleRouter) syncRoles(w http.ResponseWriter, r *http.Request) {
+	path := os.Getenv("ROLE_CATALOG_PATH")
+	if path == "" {
+		writeErrorMessage(w, r, http.StatusBadRequest, "ROLE_CATALOG_PATH is not set")
+		return
+	}
+	catalog, err := service.LoadRoleCatalog(path)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(err.Error()))
+		writeError(w, r, err)
+		return
 	}
-	rs, err := ar.roleService.NewRole(role.Name)
+	prune, _ := strconv.ParseBool(r.URL.Query().Get("prune"))
+	rs, err := ar.roleService.SyncRoles(r.Context(), catalog, prune)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(err.Error()))
+		writeError(w, r, err)
+		return
 	}
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(rs)
+	writeJSON(w, r, http.StatusOK, rs)
 }
@@ -0,0 +1,60 @@
+package router
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"main/model"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+func TestGetRoles(t *testing.T) {
+	mt := mtest.New(t, mockDB)
+	defer mt.Close()
+
+	roles := []interface{}{
+		model.Role{Id: primitive.NewObjectID(), Name: "admin"},
+		model.Role{Id: primitive.NewObjectID(), Name: "user", Permissions: []string{model.PermissionReadForms}},
+	}
+	tests := []struct {
+		name           string
+		target         string
+		reply          bson.D
+		wantData       string
+		wantPagination string
+	}{
+		{"roles", "/?page=2&limit=2", pageReply(t, "role", 4, roles...),
+			`[{"id":"` + roles[0].(model.Role).Id.Hex() + `","name":"admin"},{"id":"` + roles[1].(model.Role).Id.Hex() + `","name":"user","permissions":["read:forms"]}]`,
+			`{"page":2,"limit":2,"total":4,"totalPages":2}`},
+		{"no roles", "/", pageReply(t, "role", 0), `[]`, `{"page":1,"limit":20,"total":0,"totalPages":0}`},
+	}
+	for _, tt := range tests {
+		mt.Run(tt.name, func(mt *mtest.T) {
+			t := mt.T
+			useMock(mt)
+			mt.AddMockResponses(tt.reply)
+
+			rec := serve(NewRoleRouter().Routes(), asUser(primitive.NewObjectID(), "user"), http.MethodGet, tt.target, "")
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status %d: %s", rec.Code, rec.Body)
+			}
+			var body map[string]json.RawMessage
+			if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+				t.Fatal(err)
+			}
+			if len(body) != 2 {
+				t.Errorf("fields %v, want only data and pagination", body)
+			}
+			if got := string(body["data"]); got != tt.wantData {
+				t.Errorf("data %s, want %s", got, tt.wantData)
+			}
+			if got := string(body["pagination"]); got != tt.wantPagination {
+				t.Errorf("pagination %s, want %s", got, tt.wantPagination)
+			}
+		})
+	}
+}
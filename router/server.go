@@ -0,0 +1,59 @@
+package router
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+type ServerConfig struct {
+	Addr              string
+	ReadTimeout       time.Duration
+	ReadHeaderTimeout time.Duration
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration
+	ShutdownTimeout   time.Duration // how long in-flight requests get to finish on SIGINT/SIGTERM
+}
+
+/*
+* LoadServerConfig
+* SERVER_ADDR: listen address, e.g. 127.0.0.1:8080, wins over PORT
+* PORT: port to listen on, on every interface (default 3001)
+* SERVER_READ_TIMEOUT, SERVER_READ_HEADER_TIMEOUT, SERVER_WRITE_TIMEOUT, SERVER_IDLE_TIMEOUT,
+* SERVER_SHUTDOWN_TIMEOUT: Go durations, e.g. 15s
+ */
+func LoadServerConfig() (ServerConfig, error) {
+	cfg := ServerConfig{
+		Addr:              ":3001",
+		ReadTimeout:       15 * time.Second,
+		ReadHeaderTimeout: 5 * time.Second,
+		WriteTimeout:      30 * time.Second,
+		IdleTimeout:       60 * time.Second,
+		ShutdownTimeout:   30 * time.Second,
+	}
+	if port := os.Getenv("PORT"); port != "" {
+		cfg.Addr = ":" + port
+	}
+	if addr := os.Getenv("SERVER_ADDR"); addr != "" {
+		cfg.Addr = addr
+	}
+
+	for key, d := range map[string]*time.Duration{
+		"SERVER_READ_TIMEOUT":        &cfg.ReadTimeout,
+		"SERVER_READ_HEADER_TIMEOUT": &cfg.ReadHeaderTimeout,
+		"SERVER_WRITE_TIMEOUT":       &cfg.WriteTimeout,
+		"SERVER_IDLE_TIMEOUT":        &cfg.IdleTimeout,
+		"SERVER_SHUTDOWN_TIMEOUT":    &cfg.ShutdownTimeout,
+	} {
+		v := os.Getenv(key)
+		if v == "" {
+			continue
+		}
+		parsed, err := time.ParseDuration(v)
+		if err != nil || parsed <= 0 {
+			return cfg, fmt.Errorf("%s: %q is not a positive duration", key, v)
+		}
+		*d = parsed
+	}
+	return cfg, nil
+}
@@ -0,0 +1,69 @@
+package router
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadServerConfig(t *testing.T) {
+	defaults := ServerConfig{
+		Addr:              ":3001",
+		ReadTimeout:       15 * time.Second,
+		ReadHeaderTimeout: 5 * time.Second,
+		WriteTimeout:      30 * time.Second,
+		IdleTimeout:       60 * time.Second,
+		ShutdownTimeout:   30 * time.Second,
+	}
+	with := func(change func(cfg *ServerConfig)) ServerConfig {
+		cfg := defaults
+		change(&cfg)
+		return cfg
+	}
+
+	tests := []struct {
+		name    string
+		env     map[string]string
+		want    ServerConfig
+		wantErr string
+	}{
+		{"defaults", nil, defaults, ""},
+		{"port", map[string]string{"PORT": "8080"}, with(func(cfg *ServerConfig) { cfg.Addr = ":8080" }), ""},
+		{"address wins over port", map[string]string{"PORT": "8080", "SERVER_ADDR": "127.0.0.1:9090"},
+			with(func(cfg *ServerConfig) { cfg.Addr = "127.0.0.1:9090" }), ""},
+		{"timeouts", map[string]string{
+			"SERVER_READ_TIMEOUT":        "10s",
+			"SERVER_READ_HEADER_TIMEOUT": "2s",
+			"SERVER_WRITE_TIMEOUT":       "1m",
+			"SERVER_IDLE_TIMEOUT":        "2m30s",
+			"SERVER_SHUTDOWN_TIMEOUT":    "500ms",
+		}, with(func(cfg *ServerConfig) {
+			cfg.ReadTimeout, cfg.ReadHeaderTimeout, cfg.WriteTimeout = 10*time.Second, 2*time.Second, time.Minute
+			cfg.IdleTimeout, cfg.ShutdownTimeout = 150*time.Second, 500*time.Millisecond
+		}), ""},
+		{"not a duration", map[string]string{"SERVER_WRITE_TIMEOUT": "30"}, ServerConfig{}, `SERVER_WRITE_TIMEOUT: "30" is not a positive duration`},
+		{"zero", map[string]string{"SERVER_IDLE_TIMEOUT": "0s"}, ServerConfig{}, `SERVER_IDLE_TIMEOUT: "0s" is not a positive duration`},
+		{"negative", map[string]string{"SERVER_SHUTDOWN_TIMEOUT": "-5s"}, ServerConfig{}, `SERVER_SHUTDOWN_TIMEOUT: "-5s" is not a positive duration`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, key := range []string{"PORT", "SERVER_ADDR", "SERVER_READ_TIMEOUT", "SERVER_READ_HEADER_TIMEOUT",
+				"SERVER_WRITE_TIMEOUT", "SERVER_IDLE_TIMEOUT", "SERVER_SHUTDOWN_TIMEOUT"} {
+				t.Setenv(key, tt.env[key])
+			}
+			cfg, err := LoadServerConfig()
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cfg != tt.want {
+				t.Errorf("got %+v, want %+v", cfg, tt.want)
+			}
+		})
+	}
+}
@@ -1,12 +1,12 @@
 package router
 
 import (
-	"encoding/json"
 	"main/model"
 	"main/service"
 	"net/http"
 
 	"github.com/go-chi/chi/v5"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
 type UserRouter struct {
@@ -19,37 +19,196 @@ func NewUserRouter() *UserRouter {
 	}
 }
 
+// scope a service client needs to manage users, users need the admin role
+const userAdminScope = "manage:users"
+
 func (ur *UserRouter) Routes() chi.Router {
 	r := chi.NewRouter()
+	r.Get("/", ur.getUsers)
 	r.Get("/{uid}", ur.getUserByID)
-	r.Post("/", ur.newUser)
+	// the writes open to everyone, on the caller's own account
+	r.Post("/me", ur.newMe)
+	r.Delete("/me", ur.deleteMe)
+	r.Group(func(r chi.Router) {
+		r.Use(RequireRoleOrScope("admin", userAdminScope))
+		r.Post("/", ur.newUser)
+		r.Delete("/{uid}", ur.deleteUser)
+		r.Post("/merge", ur.mergeUsers)
+		r.Post("/{uid}/roles", ur.addRole)
+		r.Delete("/{uid}/roles/{roleName}", ur.removeRole)
+	})
+	return r
+}
+
+// Mounted at /profiles, admin screens fetch the profiles of many users there
+func (ur *UserRouter) ProfileRoutes() chi.Router {
+	r := chi.NewRouter()
+	r.Use(RequireRoleOrScope("admin", userAdminScope))
+	r.Post("/batch", ur.getUsersBatch)
 	return r
 }
 
+func (ur *UserRouter) getUsers(w http.ResponseWriter, r *http.Request) {
+	page, limit := getPagination(r)
+	if q := r.URL.Query().Get("q"); q != "" {
+		ur.searchUsers(w, r, q, page, limit)
+		return
+	}
+	if query := r.URL.Query(); query.Has("after") || query.Has("before") {
+		ur.getUsersCursor(w, r, limit)
+		return
+	}
+	users, err := ur.UserService.GetUsers(r.Context(), page, limit)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	writeJSON(w, r, http.StatusOK, users)
+}
+
+// ?after=<nextCursor> and ?before=<prevCursor> page with cursors instead of page numbers,
+// an empty ?after= is the first page and an empty ?before= the last
+func (ur *UserRouter) getUsersCursor(w http.ResponseWriter, r *http.Request, limit int) {
+	cursor, backward := r.URL.Query().Get("after"), false
+	if r.URL.Query().Has("before") {
+		cursor, backward = r.URL.Query().Get("before"), true
+	}
+	users, err := ur.UserService.GetUsersCursor(r.Context(), cursor, backward, limit)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	writeJSON(w, r, http.StatusOK, users)
+}
+
+func (ur *UserRouter) searchUsers(w http.ResponseWriter, r *http.Request, q string, page int, limit int) {
+	users, err := ur.UserService.SearchUsers(r.Context(), q, page, limit)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	writeJSON(w, r, http.StatusOK, users)
+}
+
+func (ur *UserRouter) getUsersBatch(w http.ResponseWriter, r *http.Request) {
+	var req model.UserBatchRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	if len(req.Ids) > maxPageLimit {
+		writeErrorMessage(w, r, http.StatusBadRequest, "too many ids")
+		return
+	}
+	users, err := ur.UserService.GetUsersByIDs(r.Context(), req.Ids)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	writeJSON(w, r, http.StatusOK, users)
+}
+
 func (ur *UserRouter) getUserByID(w http.ResponseWriter, r *http.Request) {
 	uid := chi.URLParam(r, "uid")
-	user, err := ur.UserService.GetUserByID(uid, false)
+	user, err := ur.UserService.GetUserByID(r.Context(), uid, false)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	writeJSONWithETag(w, r, user)
+}
+
+func (ur *UserRouter) deleteUser(w http.ResponseWriter, r *http.Request) {
+	err := ur.UserService.DeleteUser(r.Context(), chi.URLParam(r, "uid"))
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(err.Error()))
+		writeError(w, r, err)
 		return
 	}
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(user)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Deletes the caller's own account and user, their access token stops working right away
+func (ur *UserRouter) deleteMe(w http.ResponseWriter, r *http.Request) {
+	claims := ClaimsFromContext(r.Context())
+	if claims == nil {
+		writeErrorWithCode(w, r, http.StatusForbidden, CodeForbidden, "only available to logged in users")
+		return
+	}
+	if err := ur.UserService.DeleteAccount(r.Context(), claims.AccountId); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
 }
 
 func (ur *UserRouter) newUser(w http.ResponseWriter, r *http.Request) {
 	var user model.UserRequest
-	err := json.NewDecoder(r.Body).Decode(&user)
+	if !decodeJSON(w, r, &user) {
+		return
+	}
+	urs, err := ur.UserService.NewUser(r.Context(), &user, user.AccountId)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	writeJSON(w, r, http.StatusOK, urs)
+}
+
+// Creates the caller's own profile, always bound to the caller's account
+func (ur *UserRouter) newMe(w http.ResponseWriter, r *http.Request) {
+	claims := ClaimsFromContext(r.Context())
+	if claims == nil {
+		writeErrorWithCode(w, r, http.StatusForbidden, CodeForbidden, "only available to logged in users")
+		return
+	}
+	accountId, err := primitive.ObjectIDFromHex(claims.AccountId)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(err.Error()))
+		writeError(w, r, err)
+		return
 	}
-	urs, err := ur.UserService.NewUser(&user, user.AccountId)
+	var user model.UserRequest
+	if !decodeJSON(w, r, &user) {
+		return
+	}
+	urs, err := ur.UserService.NewUser(r.Context(), &user, accountId)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(err.Error()))
+		writeError(w, r, err)
+		return
+	}
+	writeJSON(w, r, http.StatusOK, urs)
+}
+
+func (ur *UserRouter) mergeUsers(w http.ResponseWriter, r *http.Request) {
+	var req model.UserMergeRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	err := ur.UserService.MergeUsers(r.Context(), req.PrimaryId, req.SecondaryId)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Applies to tokens already issued as well, their roles are read from the account on every request
+func (ur *UserRouter) addRole(w http.ResponseWriter, r *http.Request) {
+	var req model.Role
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	account, err := ur.UserService.AddRole(r.Context(), chi.URLParam(r, "uid"), req.Name)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	writeJSON(w, r, http.StatusOK, account)
+}
+
+func (ur *UserRouter) removeRole(w http.ResponseWriter, r *http.Request) {
+	account, err := ur.UserService.RemoveRole(r.Context(), chi.URLParam(r, "uid"), chi.URLParam(r, "roleName"))
+	if err != nil {
+		writeError(w, r, err)
+		return
 	}
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(urs)
+	writeJSON(w, r, http.StatusOK, account)
 }
@@ -0,0 +1,276 @@
+package router
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"main/model"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+func TestNewMe(t *testing.T) {
+	mt := mtest.New(t, mockDB)
+	defer mt.Close()
+
+	accountId := primitive.NewObjectID()
+	// the account id in the body is ignored
+	body := `{"accountId": "` + primitive.NewObjectID().Hex() + `", "fullName": "Alice"}`
+	countReply := func(n int) bson.D {
+		if n == 0 {
+			return cursorReply(t, "user")
+		}
+		return cursorReply(t, "user", bson.M{"_id": 1, "n": n})
+	}
+
+	tests := []struct {
+		name       string
+		as         caller
+		replies    []bson.D
+		wantStatus int
+		wantCode   string
+	}{
+		{"creates the caller's profile", asUser(accountId), []bson.D{
+			countReply(0),
+			mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}),
+			mtest.CreateSuccessResponse(bson.E{Key: "value", Value: bson.D{{Key: "_id", Value: accountId}}}),
+		}, http.StatusOK, ""},
+		{"profile already exists", asUser(accountId), []bson.D{countReply(1)}, http.StatusConflict, "PROFILE_EXISTS"},
+		{"service clients have no profile", asAPIKey(userAdminScope), nil, http.StatusForbidden, CodeForbidden},
+	}
+	for _, tt := range tests {
+		mt.Run(tt.name, func(mt *mtest.T) {
+			t := mt.T
+			useMock(mt)
+			mt.AddMockResponses(tt.replies...)
+
+			rec := serve(NewUserRouter().Routes(), tt.as, http.MethodPost, "/me", body)
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+			if tt.wantCode != "" {
+				var body errorResponse
+				json.Unmarshal(rec.Body.Bytes(), &body)
+				if body.Code != tt.wantCode {
+					t.Errorf("code %q, want %q", body.Code, tt.wantCode)
+				}
+				return
+			}
+			inserted := sentCommand(t, mt, "insert").Lookup("documents").Array().Index(0).Value().Document()
+			var user model.User
+			if err := bson.Unmarshal(inserted, &user); err != nil {
+				t.Fatal(err)
+			}
+			if user.AccountId != accountId || user.Fullname != "Alice" {
+				t.Errorf("stored %+v, want account %s", user, accountId.Hex())
+			}
+		})
+	}
+}
+
+func TestUserAdminRoutesForbidden(t *testing.T) {
+	mt := mtest.New(t, mockDB)
+	defer mt.Close()
+
+	uid := primitive.NewObjectID().Hex()
+	tests := []struct {
+		method string
+		target string
+	}{
+		{http.MethodPost, "/"},
+		{http.MethodDelete, "/" + uid},
+		{http.MethodPost, "/merge"},
+		{http.MethodPost, "/" + uid + "/roles"},
+		{http.MethodDelete, "/" + uid + "/roles/admin"},
+	}
+	for _, tt := range tests {
+		mt.Run(tt.method+" "+tt.target, func(mt *mtest.T) {
+			t := mt.T
+			useMock(mt)
+			rec := serve(NewUserRouter().Routes(), asUser(primitive.NewObjectID(), "user", "project_manager"), tt.method, tt.target, `{}`)
+			if rec.Code != http.StatusForbidden {
+				t.Errorf("status %d, want 403", rec.Code)
+			}
+		})
+	}
+}
+
+func TestSearchUsers(t *testing.T) {
+	mt := mtest.New(t, mockDB)
+	defer mt.Close()
+
+	alice := model.User{ID: primitive.NewObjectID(), Fullname: "Alice Smith", Email: "alice@example.com"}
+	tests := []struct {
+		name       string
+		reply      bson.D
+		wantStatus int
+		wantCode   string
+		wantIds    []primitive.ObjectID
+	}{
+		{"matches", pageReply(t, "user", 1, alice), http.StatusOK, "", []primitive.ObjectID{alice.ID}},
+		{"no match", pageReply(t, "user", 0), http.StatusOK, "", []primitive.ObjectID{}},
+		{"no text index", mtest.CreateCommandErrorResponse(mtest.CommandError{Code: 27, Name: "IndexNotFound", Message: "text index required for $text query"}),
+			http.StatusServiceUnavailable, "SEARCH_UNAVAILABLE", nil},
+	}
+	for _, tt := range tests {
+		mt.Run(tt.name, func(mt *mtest.T) {
+			t := mt.T
+			useMock(mt)
+			mt.AddMockResponses(tt.reply)
+
+			rec := serve(NewUserRouter().Routes(), anonymous, http.MethodGet, "/?q=alice", "")
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+			search := sentCommand(t, mt, "aggregate").Lookup("pipeline").Array().Index(0).Value().Document()
+			if got := search.Lookup("$match", "$text", "$search").StringValue(); got != "alice" {
+				t.Errorf("searched for %q, want alice", got)
+			}
+			if tt.wantCode != "" {
+				var body errorResponse
+				json.Unmarshal(rec.Body.Bytes(), &body)
+				if body.Code != tt.wantCode {
+					t.Errorf("code %q, want %q", body.Code, tt.wantCode)
+				}
+				return
+			}
+			var page model.PagedResponse[model.User]
+			if err := json.Unmarshal(rec.Body.Bytes(), &page); err != nil {
+				t.Fatal(err)
+			}
+			if len(page.Data) != len(tt.wantIds) || page.Pagination.Total != int64(len(tt.wantIds)) {
+				t.Fatalf("got %d users (total %d), want %d", len(page.Data), page.Pagination.Total, len(tt.wantIds))
+			}
+			for i, id := range tt.wantIds {
+				if page.Data[i].ID != id {
+					t.Errorf("user %d is %s, want %s", i, page.Data[i].ID.Hex(), id.Hex())
+				}
+			}
+		})
+	}
+}
+
+func TestGetUsersCursor(t *testing.T) {
+	mt := mtest.New(t, mockDB)
+	defer mt.Close()
+
+	users := make([]model.User, 3)
+	for i := range users {
+		users[i] = model.User{ID: primitive.NewObjectID(), Fullname: "User"}
+	}
+
+	mt.Run("first page then the next", func(mt *mtest.T) {
+		t := mt.T
+		useMock(mt)
+		ur := NewUserRouter()
+		mt.AddMockResponses(cursorReply(t, "user", users[0], users[1], users[2]))
+
+		rec := serve(ur.Routes(), anonymous, http.MethodGet, "/?after=&limit=2", "")
+		if rec.Code != http.StatusOK {
+			t.Fatalf("status %d, want 200: %s", rec.Code, rec.Body)
+		}
+		var page struct {
+			Data       []model.UserResponse `json:"data"`
+			NextCursor string               `json:"nextCursor"`
+			PrevCursor string               `json:"prevCursor"`
+		}
+		json.Unmarshal(rec.Body.Bytes(), &page)
+		if len(page.Data) != 2 || page.Data[0].ID != users[0].ID || page.Data[1].ID != users[1].ID {
+			t.Fatalf("got %+v, want the first two users", page.Data)
+		}
+		if page.NextCursor == "" || page.PrevCursor != "" {
+			t.Fatalf("cursors next %q prev %q, want only next", page.NextCursor, page.PrevCursor)
+		}
+		pipeline := sentCommand(t, mt, "aggregate").Lookup("pipeline").Array()
+		if _, err := pipeline.Index(3).Value().Document().LookupErr("$lookup"); err != nil {
+			t.Errorf("accounts not looked up after the page cut: %v", pipeline)
+		}
+
+		mt.ClearEvents()
+		mt.AddMockResponses(cursorReply(t, "user", users[2]))
+		rec = serve(ur.Routes(), anonymous, http.MethodGet, "/?limit=2&after="+page.NextCursor, "")
+		if rec.Code != http.StatusOK {
+			t.Fatalf("status %d, want 200: %s", rec.Code, rec.Body)
+		}
+		match := sentCommand(t, mt, "aggregate").Lookup("pipeline").Array().Index(0).Value().Document()
+		if after := match.Lookup("$match", "$and", "1", "_id", "$gt").ObjectID(); after != users[1].ID {
+			t.Errorf("next page starts after %s, want %s", after.Hex(), users[1].ID.Hex())
+		}
+	})
+
+	mt.Run("invalid cursor", func(mt *mtest.T) {
+		t := mt.T
+		useMock(mt)
+		rec := serve(NewUserRouter().Routes(), anonymous, http.MethodGet, "/?before=bm90LWEtY3Vyc29y", "")
+		var body errorResponse
+		json.Unmarshal(rec.Body.Bytes(), &body)
+		if rec.Code != http.StatusBadRequest || body.Code != "INVALID_CURSOR" {
+			t.Errorf("got %d %q, want 400 INVALID_CURSOR", rec.Code, body.Code)
+		}
+	})
+}
+
+func TestGetProfilesBatch(t *testing.T) {
+	mt := mtest.New(t, mockDB)
+	defer mt.Close()
+
+	withAccount := model.UserResponse{ID: primitive.NewObjectID(), Fullname: "Alice",
+		Account: model.AccountResponse{ID: primitive.NewObjectID(), Username: "alice"}}
+	withoutAccount := model.UserResponse{ID: primitive.NewObjectID(), Fullname: "Bob"}
+	missing := primitive.NewObjectID()
+
+	ids := []string{withAccount.ID.Hex(), withoutAccount.ID.Hex(), missing.Hex(), withAccount.ID.Hex(), "not-an-id"}
+	body, _ := json.Marshal(model.UserBatchRequest{Ids: ids})
+	tooMany, _ := json.Marshal(model.UserBatchRequest{Ids: make([]string, maxPageLimit+1)})
+
+	mt.Run("found, missing and duplicate ids", func(mt *mtest.T) {
+		t := mt.T
+		useMock(mt)
+		mt.AddMockResponses(cursorReply(t, "user", withAccount, withoutAccount))
+
+		rec := serve(NewUserRouter().ProfileRoutes(), asUser(primitive.NewObjectID(), "admin"), http.MethodPost, "/batch", string(body))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("status %d: %s", rec.Code, rec.Body)
+		}
+		var rs model.UserBatchResponse
+		if err := json.Unmarshal(rec.Body.Bytes(), &rs); err != nil {
+			t.Fatal(err)
+		}
+		if len(rs.Users) != 2 || rs.Users[withAccount.ID.Hex()].Account.Username != "alice" || rs.Users[withoutAccount.ID.Hex()].Fullname != "Bob" {
+			t.Errorf("users %+v, want alice and bob", rs.Users)
+		}
+		if len(rs.Errors) != 2 || rs.Errors[missing.Hex()] == "" || rs.Errors["not-an-id"] == "" {
+			t.Errorf("errors %v, want the missing and the invalid id", rs.Errors)
+		}
+
+		pipeline := sentCommand(t, mt, "aggregate").Lookup("pipeline").Array()
+		queried, _ := pipeline.Index(0).Value().Document().Lookup("$match", "_id", "$in").Array().Values()
+		if len(queried) != 3 {
+			t.Errorf("queried %d ids, want the 3 distinct valid ones", len(queried))
+		}
+		if keep, _ := pipeline.Index(2).Value().Document().Lookup("$unwind", "preserveNullAndEmptyArrays").BooleanOK(); !keep {
+			t.Errorf("users without an account are dropped: %v", pipeline.Index(2))
+		}
+	})
+
+	mt.Run("too many ids", func(mt *mtest.T) {
+		t := mt.T
+		useMock(mt)
+		rec := serve(NewUserRouter().ProfileRoutes(), asAPIKey(userAdminScope), http.MethodPost, "/batch", string(tooMany))
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("status %d, want 400", rec.Code)
+		}
+	})
+
+	mt.Run("not an admin", func(mt *mtest.T) {
+		t := mt.T
+		useMock(mt)
+		rec := serve(NewUserRouter().ProfileRoutes(), asUser(primitive.NewObjectID(), "user"), http.MethodPost, "/batch", string(body))
+		if rec.Code != http.StatusForbidden || len(mt.GetAllStartedEvents()) > 0 {
+			t.Errorf("status %d with %d commands, want 403 and none", rec.Code, len(mt.GetAllStartedEvents()))
+		}
+	})
+}
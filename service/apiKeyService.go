@@ -0,0 +1,123 @@
+package service
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"main/db"
+	"main/db/builder"
+	"main/model"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const apiKeyPrefix = "gk_"
+
+var ErrInvalidAPIKey = errors.New("invalid api key")
+
+type APIKeyService struct {
+	apiKeyCollection *mongo.Collection
+}
+
+func NewAPIKeyService() *APIKeyService {
+	return &APIKeyService{
+		apiKeyCollection: db.MongoDatabase.Collection("apiKey"),
+	}
+}
+
+// keys are random and long, a plain sha256 is enough (unlike passwords)
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func (as *APIKeyService) GetAPIKeys(ctx context.Context, page int, limit int) (*model.PagedResponse[model.APIKey], error) {
+	ctx, cancel := db.WithTimeout(ctx)
+	defer cancel()
+
+	keys, total, err := builder.AggregatePaged[model.APIKey](ctx, as.apiKeyCollection, []bson.M{builder.Sort("createAt", -1)}, page, limit)
+	if err != nil {
+		return nil, err
+	}
+	return model.NewPagedResponse(keys, page, limit, total), nil
+}
+
+// The returned key is the only time it's available in clear
+func (as *APIKeyService) CreateAPIKey(ctx context.Context, req *model.APIKeyRequest) (*model.APIKeyCreated, error) {
+	ctx, cancel := db.WithTimeout(ctx)
+	defer cancel()
+
+	if req.Name == "" {
+		return nil, model.ValidationError{Field: "name", Message: "is required"}
+	}
+	if req.ExpiresAt != nil && req.ExpiresAt.Before(time.Now()) {
+		return nil, model.ValidationError{Field: "expiresAt", Message: "must be in the future"}
+	}
+
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+	key := apiKeyPrefix + hex.EncodeToString(secret)
+
+	apiKey := model.APIKey{
+		Name:      req.Name,
+		Prefix:    key[:len(apiKeyPrefix)+8],
+		KeyHash:   hashAPIKey(key),
+		Scopes:    req.Scopes,
+		ExpiresAt: req.ExpiresAt,
+		CreateAt:  time.Now(),
+	}
+	if apiKey.Scopes == nil {
+		apiKey.Scopes = []string{}
+	}
+	rs, err := as.apiKeyCollection.InsertOne(ctx, apiKey)
+	if err != nil {
+		return nil, err
+	}
+	apiKey.ID, _ = rs.InsertedID.(primitive.ObjectID)
+	return &model.APIKeyCreated{APIKey: apiKey, Key: key}, nil
+}
+
+// Revoked keys are kept so they still show up when listing
+func (as *APIKeyService) RevokeAPIKey(ctx context.Context, kid string) error {
+	ctx, cancel := db.WithTimeout(ctx)
+	defer cancel()
+
+	id, err := builder.ConvertToObjectId(kid)
+	if err != nil {
+		return err
+	}
+	rs, err := as.apiKeyCollection.UpdateByID(ctx, id, bson.M{"$set": bson.M{"revoked": true}})
+	if err != nil {
+		return err
+	}
+	if rs.MatchedCount == 0 {
+		return mongo.ErrNoDocuments
+	}
+	return nil
+}
+
+// Unknown, revoked and expired keys all give ErrInvalidAPIKey
+func (as *APIKeyService) Authenticate(ctx context.Context, key string) (*model.APIKey, error) {
+	ctx, cancel := db.WithTimeout(ctx)
+	defer cancel()
+
+	var apiKey model.APIKey
+	err := as.apiKeyCollection.FindOne(ctx, bson.M{"keyHash": hashAPIKey(key)}).Decode(&apiKey)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, ErrInvalidAPIKey
+	}
+	if err != nil {
+		return nil, err
+	}
+	if apiKey.Revoked || (apiKey.ExpiresAt != nil && apiKey.ExpiresAt.Before(time.Now())) {
+		return nil, ErrInvalidAPIKey
+	}
+	return &apiKey, nil
+}
@@ -2,54 +2,372 @@ package service
 
 import (
 	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"log"
+	"main/auth"
 	"main/db"
+	"main/db/builder"
 	"main/model"
+	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var (
+	// same error for an unknown username/email and a wrong password
+	ErrInvalidCredentials = errors.New("invalid username or password")
+	ErrWrongPassword      = errors.New("current password is wrong")
+	ErrDuplicateUsername  = errors.New("username is already taken")
 )
 
 type AuthService struct {
-	accountCollection *mongo.Collection
-	roleService       *RoleService
+	accountCollection      *mongo.Collection
+	refreshTokenCollection *mongo.Collection
+	roleService            *RoleService
+	userService            *UserService
+	defaultRole            string // empty when running deny by default
+	passwordPolicy         *PasswordPolicy
 }
 
 func NewAuthService() *AuthService {
+	// main checks the policy config at startup, this can't fail past that
+	policy, err := LoadPasswordPolicy()
+	if err != nil {
+		log.Fatal(err)
+	}
 	return &AuthService{
-		accountCollection: db.MongoDatabase.Collection("account"),
-		roleService:       NewRoleService(),
+		accountCollection:      db.MongoDatabase.Collection("account"),
+		refreshTokenCollection: db.MongoDatabase.Collection("refreshToken"),
+		roleService:            NewRoleService(),
+		userService:            NewUserService(),
+		defaultRole:            getDefaultRole(),
+		passwordPolicy:         policy,
+	}
+}
+
+// DEFAULT_ROLE: role every newly registered account gets ("user" if unset)
+// DENY_BY_DEFAULT=true: never give a default role, such accounts stay role-less
+func getDefaultRole() string {
+	if deny, _ := strconv.ParseBool(os.Getenv("DENY_BY_DEFAULT")); deny {
+		return ""
+	}
+	if role := os.Getenv("DEFAULT_ROLE"); role != "" {
+		return role
+	}
+	return "user"
+}
+
+// What the default role is created with: reading forms and answering them
+var defaultRolePermissions = []string{model.PermissionReadForms, model.PermissionSubmitResponses}
+
+// Creates the default role when it doesn't exist yet, so registration can't fail on it.
+// An existing role is left as is, permissions included.
+func (as *AuthService) EnsureDefaultRole(ctx context.Context) error {
+	ctx, cancel := db.WithTimeout(ctx)
+	defer cancel()
+
+	if as.defaultRole == "" {
+		return nil
+	}
+	_, err := as.roleService.roleCollection.UpdateOne(ctx, bson.M{"name": as.defaultRole},
+		bson.M{"$setOnInsert": bson.M{"name": as.defaultRole, "permissions": defaultRolePermissions}}, options.Update().SetUpsert(true))
+	return err
+}
+
+// bcrypt hash of nothing in particular, compared against when the username is unknown
+// so both failures take the same time
+var dummyHash, _ = model.HashPassword("not a real password")
+
+// identifier is a username or, when it has an @, the email of the account's user
+func (as *AuthService) Login(ctx context.Context, identifier string, password string) (*model.AccountResponse, error) {
+	ctx, cancel := db.WithTimeout(ctx)
+	defer cancel()
+
+	identifier = strings.TrimSpace(identifier)
+	// the exact form still matches accounts registered before usernames were lower cased
+	filter := bson.M{"username": bson.M{"$in": []string{model.NormalizeUsername(identifier), identifier}}}
+	if strings.Contains(identifier, "@") {
+		accountId, err := as.userService.GetAccountIdByEmail(ctx, identifier)
+		switch {
+		case err == nil:
+			filter = bson.M{"_id": accountId}
+		case !errors.Is(err, ErrUserNotFound):
+			return nil, err
+		}
+		// no such email, usernames may contain an @ too
+	}
+
+	var account model.Account
+	err := as.accountCollection.FindOne(ctx, filter).Decode(&account)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		(&model.Account{Password: dummyHash}).CheckPassword(password)
+		return nil, ErrInvalidCredentials
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !account.CheckPassword(password) {
+		return nil, ErrInvalidCredentials
 	}
+
+	// accounts from before hashing get upgraded on their first login
+	if account.NeedsRehash() {
+		if hash, err := model.HashPassword(password); err == nil {
+			if _, err := as.accountCollection.UpdateByID(ctx, account.ID, bson.M{"$set": bson.M{"password": hash}}); err != nil {
+				log.Printf("rehash password of %s: %v", account.ID.Hex(), err)
+			}
+		}
+	}
+
+	return as.issueTokens(ctx, &account)
 }
 
-func (as *AuthService) Login(username string, password string) (*model.AccountResponse, error) {
-	var account model.AccountResponse
-	err := as.accountCollection.FindOne(context.TODO(),
-		bson.D{{"username", username}, {"password", password}}).Decode(&account)
+// A fresh access token plus a refresh token, stored hashed
+func (as *AuthService) issueTokens(ctx context.Context, account *model.Account) (*model.AccountResponse, error) {
+	roles := make([]string, 0, len(account.Roles))
+	for _, role := range account.Roles {
+		roles = append(roles, role.Name)
+	}
+	token, err := auth.GenerateToken(auth.JWTClaims{
+		AccountId: account.ID.Hex(),
+		Username:  account.Username,
+		Roles:     roles,
+	}, auth.TokenTTL)
 	if err != nil {
 		return nil, err
 	}
-	return &account, nil
+
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+	refreshToken := hex.EncodeToString(secret)
+	now := time.Now()
+	_, err = as.refreshTokenCollection.InsertOne(ctx, model.RefreshToken{
+		AccountId: account.ID,
+		TokenHash: hashRefreshToken(refreshToken),
+		ExpiresAt: now.Add(auth.RefreshTokenTTL),
+		CreateAt:  now,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &model.AccountResponse{
+		ID:           account.ID,
+		Username:     account.Username,
+		Roles:        account.Roles,
+		Token:        token,
+		RefreshToken: refreshToken,
+	}, nil
+}
+
+func hashRefreshToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
 }
 
-func (as *AuthService) Register(username string, password string, roles []model.Role) (*mongo.InsertOneResult, error) {
-	var rolesList []model.Role
+/*
+* Refresh
+* Trades a refresh token for a new access token and a new refresh token, the old one is revoked.
+* Presenting an already revoked token means it leaked (or the client lost track of its latest one),
+* every refresh token of the account is revoked then and the user has to log in again.
+ */
+func (as *AuthService) Refresh(ctx context.Context, refreshToken string) (*model.AccountResponse, error) {
+	ctx, cancel := db.WithTimeout(ctx)
+	defer cancel()
 
-	for _, role := range roles {
-		role, err := as.roleService.GetRoleByName(role.Name)
+	var stored model.RefreshToken
+	// revoking as part of the lookup so two concurrent refreshes can't both succeed
+	err := as.refreshTokenCollection.FindOneAndUpdate(ctx,
+		bson.M{"tokenHash": hashRefreshToken(refreshToken)},
+		bson.M{"$set": bson.M{"revoked": true}}).Decode(&stored)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, auth.ErrInvalidToken
+	}
+	if err != nil {
+		return nil, err
+	}
+	if stored.Revoked {
+		if err := as.revokeRefreshTokens(ctx, stored.AccountId); err != nil {
+			return nil, err
+		}
+		return nil, auth.ErrInvalidToken
+	}
+	if stored.ExpiresAt.Before(time.Now()) {
+		return nil, auth.ErrInvalidToken
+	}
+
+	// roles may have changed since the last login
+	var account model.Account
+	err = as.accountCollection.FindOne(ctx, bson.M{"_id": stored.AccountId}).Decode(&account)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, auth.ErrInvalidToken
+	}
+	if err != nil {
+		return nil, err
+	}
+	return as.issueTokens(ctx, &account)
+}
+
+// Revokes the refresh token, unknown or already revoked tokens are ignored
+func (as *AuthService) Logout(ctx context.Context, refreshToken string) error {
+	ctx, cancel := db.WithTimeout(ctx)
+	defer cancel()
+
+	_, err := as.refreshTokenCollection.UpdateOne(ctx,
+		bson.M{"tokenHash": hashRefreshToken(refreshToken)}, bson.M{"$set": bson.M{"revoked": true}})
+	return err
+}
+
+func (as *AuthService) revokeRefreshTokens(ctx context.Context, accountId primitive.ObjectID) error {
+	_, err := builder.UpdateMany(ctx, as.refreshTokenCollection,
+		bson.M{"accountId": accountId, "revoked": false}, bson.M{"revoked": true})
+	return err
+}
+
+/*
+* VerifyToken
+* Validates the token and checks it against the account: the account must still exist
+* and the token must be issued after the last password change.
+* The roles of the returned claims are the account's current ones, along with the permissions
+* they grant, so granting or revoking a role takes effect right away instead of at the next login.
+ */
+func (as *AuthService) VerifyToken(ctx context.Context, token string) (*auth.JWTClaims, error) {
+	ctx, cancel := db.WithTimeout(ctx)
+	defer cancel()
+
+	claims, err := auth.ValidateToken(token)
+	if err != nil {
+		return nil, err
+	}
+	id, err := primitive.ObjectIDFromHex(claims.AccountId)
+	if err != nil {
+		return nil, auth.ErrInvalidToken
+	}
+	var account model.Account
+	err = as.accountCollection.FindOne(ctx, bson.M{"_id": id},
+		options.FindOne().SetProjection(bson.M{"passwordChangedAt": 1, "roles.name": 1, "roles.permissions": 1})).Decode(&account)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, auth.ErrInvalidToken
+	}
+	if err != nil {
+		return nil, err
+	}
+	// iat only has second precision
+	if claims.IssuedAt == nil || claims.IssuedAt.Time.Before(account.PasswordChangedAt.Truncate(time.Second)) {
+		return nil, auth.ErrInvalidToken
+	}
+	claims.Roles = make([]string, 0, len(account.Roles))
+	claims.Permissions = []string{}
+	granted := map[string]bool{}
+	for _, role := range account.Roles {
+		claims.Roles = append(claims.Roles, role.Name)
+		for _, perm := range role.Permissions {
+			if !granted[perm] {
+				granted[perm] = true
+				claims.Permissions = append(claims.Permissions, perm)
+			}
+		}
+	}
+	return claims, nil
+}
+
+// Every token issued before the change stops working, refresh tokens included
+func (as *AuthService) ChangePassword(ctx context.Context, accountId string, current string, newPassword string) error {
+	ctx, cancel := db.WithTimeout(ctx)
+	defer cancel()
+
+	id, err := primitive.ObjectIDFromHex(accountId)
+	if err != nil {
+		return err
+	}
+	var account model.Account
+	if err := as.accountCollection.FindOne(ctx, bson.M{"_id": id}).Decode(&account); err != nil {
+		return err
+	}
+	if !account.CheckPassword(current) {
+		return ErrWrongPassword
+	}
+	if err := as.passwordPolicy.Validate("newPassword", newPassword); err != nil {
+		return err
+	}
+	hash, err := model.HashPassword(newPassword)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	_, err = as.accountCollection.UpdateByID(ctx, id, bson.M{"$set": bson.M{
+		"password":          hash,
+		"passwordChangedAt": now,
+		"updatedAt":         now,
+	}})
+	if err != nil {
+		return err
+	}
+	return as.revokeRefreshTokens(ctx, id)
+}
+
+// Accounts only ever get the default role here, more are granted by an admin (POST /users/{uid}/roles)
+func (as *AuthService) Register(ctx context.Context, username string, password string) (*mongo.InsertOneResult, error) {
+	ctx, cancel := db.WithTimeout(ctx)
+	defer cancel()
+
+	username = model.NormalizeUsername(username)
+	if username == "" {
+		return nil, model.ValidationError{Field: "username", Message: "is required"}
+	}
+	if err := as.passwordPolicy.Validate("password", password); err != nil {
+		return nil, err
+	}
+	// accounts from before normalization may still have upper case usernames,
+	// the unique index only catches exact matches
+	taken, err := as.accountCollection.CountDocuments(ctx, bson.M{"username": username},
+		options.Count().SetCollation(caseInsensitive).SetLimit(1))
+	if err != nil {
+		return nil, err
+	}
+	if taken > 0 {
+		return nil, ErrDuplicateUsername
+	}
+
+	rolesList := []model.Role{}
+	if as.defaultRole != "" {
+		role, err := as.roleService.GetRoleByName(ctx, as.defaultRole)
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, ErrRoleNotFound
+		}
 		if err != nil {
 			return nil, err
 		}
 		rolesList = append(rolesList, *role)
 	}
 
+	hash, err := model.HashPassword(password)
+	if err != nil {
+		return nil, err
+	}
 	account := model.Account{
 		Username: username,
-		Password: password,
+		Password: hash,
 		Roles:    rolesList,
 	}
 
-	rs, err := as.accountCollection.InsertOne(context.TODO(), account)
-
+	// a concurrent registration of the same name can still get past the check above
+	rs, err := as.accountCollection.InsertOne(ctx, account)
+	if mongo.IsDuplicateKeyError(err) {
+		return nil, ErrDuplicateUsername
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,475 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"main/auth"
+	"main/model"
+
+	"github.com/golang-jwt/jwt/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestVerifyTokenPermissions(t *testing.T) {
+	initJWT(t)
+	mt := mtest.New(t, mockDB)
+	defer mt.Close()
+
+	accountId := primitive.NewObjectID()
+	token, err := auth.GenerateToken(auth.JWTClaims{AccountId: accountId.Hex(), Username: "alice"}, auth.TokenTTL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		roles     []model.Role
+		wantRoles []string
+		wantPerms []string
+	}{
+		{"permissions of every role, once", []model.Role{
+			{Name: "user", Permissions: []string{model.PermissionReadForms, model.PermissionSubmitResponses}},
+			{Name: "editor", Permissions: []string{model.PermissionReadForms, model.PermissionUpdateForms}},
+		}, []string{"user", "editor"}, []string{model.PermissionReadForms, model.PermissionSubmitResponses, model.PermissionUpdateForms}},
+		{"role without permissions", []model.Role{{Name: "admin"}}, []string{"admin"}, []string{}},
+		{"no roles", []model.Role{}, []string{}, []string{}},
+	}
+	for _, tt := range tests {
+		mt.Run(tt.name, func(mt *mtest.T) {
+			t := mt.T
+			useMock(mt)
+			mt.AddMockResponses(cursorReply(t, "account", model.Account{ID: accountId, Roles: tt.roles}))
+
+			claims, err := NewAuthService().VerifyToken(context.Background(), token)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(claims.Roles, tt.wantRoles) || !reflect.DeepEqual(claims.Permissions, tt.wantPerms) {
+				t.Errorf("roles %v permissions %v, want %v %v", claims.Roles, claims.Permissions, tt.wantRoles, tt.wantPerms)
+			}
+			projection := mt.GetStartedEvent().Command.Lookup("projection").Document()
+			if _, err := projection.LookupErr("roles.permissions"); err != nil {
+				t.Errorf("permissions not read, projection %v", projection)
+			}
+		})
+	}
+}
+
+func TestEnsureDefaultRole(t *testing.T) {
+	mt := mtest.New(t, mockDB)
+	defer mt.Close()
+
+	mt.Run("created with the baseline permissions", func(mt *mtest.T) {
+		t := mt.T
+		t.Setenv("DEFAULT_ROLE", "member")
+		useMock(mt)
+		mt.AddMockResponses(writeReply(1))
+
+		if err := NewAuthService().EnsureDefaultRole(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		upserts := sentStatements(mt, "update", "role")
+		if len(upserts) != 1 {
+			t.Fatalf("sent %d updates, want 1", len(upserts))
+		}
+		if name := asMap(t, upserts[0].Filter)["name"]; name != "member" {
+			t.Errorf("upserted role %v, want member", name)
+		}
+		var update struct {
+			SetOnInsert model.Role `bson:"$setOnInsert"`
+		}
+		bson.Unmarshal(upserts[0].Update, &update)
+		if update.SetOnInsert.Name != "member" || !reflect.DeepEqual(update.SetOnInsert.Permissions, defaultRolePermissions) {
+			t.Errorf("created as %+v, want member with %v", update.SetOnInsert, defaultRolePermissions)
+		}
+	})
+
+	mt.Run("deny by default", func(mt *mtest.T) {
+		t := mt.T
+		t.Setenv("DENY_BY_DEFAULT", "true")
+		useMock(mt)
+
+		if err := NewAuthService().EnsureDefaultRole(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		if n := len(mt.GetAllStartedEvents()); n != 0 {
+			t.Errorf("sent %d commands, want none", n)
+		}
+	})
+}
+
+func TestRefresh(t *testing.T) {
+	initJWT(t)
+	mt := mtest.New(t, mockDB)
+	defer mt.Close()
+
+	const presented = "0123456789abcdef"
+	account := model.Account{ID: primitive.NewObjectID(), Username: "alice", Roles: []model.Role{{Name: "user"}}}
+	stored := func(revoked bool, expiresIn time.Duration) model.RefreshToken {
+		return model.RefreshToken{ID: primitive.NewObjectID(), AccountId: account.ID, TokenHash: hashRefreshToken(presented),
+			Revoked: revoked, ExpiresAt: time.Now().Add(expiresIn)}
+	}
+
+	tests := []struct {
+		name          string
+		replies       []bson.D
+		wantErr       error
+		wantRevokeAll bool
+	}{
+		{"rotates the token", []bson.D{
+			findAndModifyReply(t, stored(false, time.Hour)),
+			cursorReply(t, "account", account),
+			writeReply(1),
+		}, nil, false},
+		{"reused token revokes every token of the account", []bson.D{
+			findAndModifyReply(t, stored(true, time.Hour)),
+			writeReply(3),
+		}, auth.ErrInvalidToken, true},
+		{"expired token", []bson.D{findAndModifyReply(t, stored(false, -time.Minute))}, auth.ErrInvalidToken, false},
+		{"unknown token", []bson.D{findAndModifyReply(t, nil)}, auth.ErrInvalidToken, false},
+		{"account deleted since", []bson.D{
+			findAndModifyReply(t, stored(false, time.Hour)),
+			cursorReply(t, "account"),
+		}, auth.ErrInvalidToken, false},
+	}
+	for _, tt := range tests {
+		mt.Run(tt.name, func(mt *mtest.T) {
+			t := mt.T
+			useMock(mt)
+			mt.AddMockResponses(tt.replies...)
+
+			rs, err := NewAuthService().Refresh(context.Background(), presented)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("err %v, want %v", err, tt.wantErr)
+			}
+
+			// the presented token is always revoked by the lookup itself
+			lookup := sentStatements(mt, "findAndModify", "refreshToken")
+			if len(lookup) != 1 || asMap(t, lookup[0].Filter)["tokenHash"] != hashRefreshToken(presented) {
+				t.Fatalf("looked up %v, want the hash of the presented token", lookup)
+			}
+			if set, _ := asMap(t, lookup[0].Update)["$set"].(bson.M); set["revoked"] != true {
+				t.Errorf("lookup update %v does not revoke it", asMap(t, lookup[0].Update))
+			}
+
+			revokeAll := sentStatements(mt, "update", "refreshToken")
+			if got := len(revokeAll) == 1; got != tt.wantRevokeAll {
+				t.Fatalf("revoked every token %t, want %t", got, tt.wantRevokeAll)
+			}
+			if tt.wantRevokeAll {
+				if filter := asMap(t, revokeAll[0].Filter); filter["accountId"] != account.ID || filter["revoked"] != false {
+					t.Errorf("revoked %v, want the live tokens of %s", filter, account.ID.Hex())
+				}
+			}
+
+			var inserted []bson.Raw
+			for _, e := range mt.GetAllStartedEvents() {
+				if e.CommandName == "insert" {
+					inserted = append(inserted, e.Command.Lookup("documents").Array().Index(0).Value().Document())
+				}
+			}
+			if err != nil {
+				if len(inserted) > 0 {
+					t.Errorf("a new refresh token was stored")
+				}
+				return
+			}
+			if rs.RefreshToken == "" || rs.RefreshToken == presented {
+				t.Errorf("refresh token %q, want a new one", rs.RefreshToken)
+			}
+			var next model.RefreshToken
+			if len(inserted) != 1 || bson.Unmarshal(inserted[0], &next) != nil {
+				t.Fatalf("stored %d refresh tokens, want 1", len(inserted))
+			}
+			if next.TokenHash != hashRefreshToken(rs.RefreshToken) || next.AccountId != account.ID || next.Revoked {
+				t.Errorf("stored %+v, want the hash of the new token for %s", next, account.ID.Hex())
+			}
+			claims, err := auth.ValidateToken(rs.Token)
+			if err != nil || claims.AccountId != account.ID.Hex() || !reflect.DeepEqual(claims.Roles, []string{"user"}) {
+				t.Errorf("access token claims %+v (%v)", claims, err)
+			}
+		})
+	}
+}
+
+func TestLogout(t *testing.T) {
+	mt := mtest.New(t, mockDB)
+	defer mt.Close()
+
+	for name, matched := range map[string]int{"live token": 1, "unknown or revoked token": 0} {
+		mt.Run(name, func(mt *mtest.T) {
+			t := mt.T
+			useMock(mt)
+			mt.AddMockResponses(writeReply(matched))
+
+			if err := NewAuthService().Logout(context.Background(), "0123456789abcdef"); err != nil {
+				t.Fatal(err)
+			}
+			updates := sentStatements(mt, "update", "refreshToken")
+			if len(updates) != 1 || asMap(t, updates[0].Filter)["tokenHash"] != hashRefreshToken("0123456789abcdef") {
+				t.Fatalf("updated %v, want the presented token", updates)
+			}
+			if set, _ := asMap(t, updates[0].Update)["$set"].(bson.M); set["revoked"] != true {
+				t.Errorf("update %v does not revoke it", asMap(t, updates[0].Update))
+			}
+		})
+	}
+}
+
+// A token as GenerateToken would have signed it at issuedAt, initJWT must have run
+func tokenIssuedAt(t testing.TB, accountId primitive.ObjectID, issuedAt time.Time) string {
+	t.Helper()
+	claims := auth.JWTClaims{AccountId: accountId.Hex(), RegisteredClaims: jwt.RegisteredClaims{
+		IssuedAt:  jwt.NewNumericDate(issuedAt),
+		ExpiresAt: jwt.NewNumericDate(issuedAt.Add(auth.TokenTTL)),
+	}}
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(strings.Repeat("s", 32)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestChangePassword(t *testing.T) {
+	initJWT(t)
+	mt := mtest.New(t, mockDB)
+	defer mt.Close()
+
+	hash, err := model.HashPassword("Old-passw0rd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	account := model.Account{ID: primitive.NewObjectID(), Username: "alice", Password: hash}
+
+	tests := []struct {
+		name        string
+		replies     []bson.D
+		current     string
+		newPassword string
+		wantErr     func(error) bool
+	}{
+		{"changed", []bson.D{cursorReply(t, "account", account), writeReply(1), writeReply(2)},
+			"Old-passw0rd", "New-passw0rd", func(err error) bool { return err == nil }},
+		{"wrong current password", []bson.D{cursorReply(t, "account", account)},
+			"old-passw0rd", "New-passw0rd", func(err error) bool { return errors.Is(err, ErrWrongPassword) }},
+		{"new password breaks the policy", []bson.D{cursorReply(t, "account", account)},
+			"Old-passw0rd", "short", func(err error) bool {
+				var errs model.ValidationErrors
+				return errors.As(err, &errs) && len(errs) > 0 && errs[0].Field == "newPassword"
+			}},
+		{"unknown account", []bson.D{cursorReply(t, "account")},
+			"Old-passw0rd", "New-passw0rd", func(err error) bool { return errors.Is(err, mongo.ErrNoDocuments) }},
+	}
+	for _, tt := range tests {
+		mt.Run(tt.name, func(mt *mtest.T) {
+			t := mt.T
+			useMock(mt)
+			mt.AddMockResponses(tt.replies...)
+
+			err := NewAuthService().ChangePassword(context.Background(), account.ID.Hex(), tt.current, tt.newPassword)
+			if !tt.wantErr(err) {
+				t.Fatalf("unexpected err %v", err)
+			}
+			updates := sentStatements(mt, "update", "account")
+			revoked := sentStatements(mt, "update", "refreshToken")
+			if err != nil {
+				if len(updates)+len(revoked) > 0 {
+					t.Errorf("wrote %v %v after a failed check", updates, revoked)
+				}
+				return
+			}
+
+			if len(updates) != 1 || asMap(t, updates[0].Filter)["_id"] != account.ID {
+				t.Fatalf("updated %v, want account %s", updates, account.ID.Hex())
+			}
+			set, _ := asMap(t, updates[0].Update)["$set"].(bson.M)
+			stored := model.Account{Password: set["password"].(string)}
+			if stored.NeedsRehash() || !stored.CheckPassword(tt.newPassword) {
+				t.Errorf("stored password %q is not a hash of the new one", stored.Password)
+			}
+			changedAt, ok := set["passwordChangedAt"].(primitive.DateTime)
+			if !ok {
+				t.Fatalf("passwordChangedAt not set: %v", set)
+			}
+			if len(revoked) != 1 || asMap(t, revoked[0].Filter)["accountId"] != account.ID {
+				t.Errorf("revoked refresh tokens %v, want every one of %s", revoked, account.ID.Hex())
+			}
+
+			// tokens issued before the change are refused, later ones still work
+			account := account
+			account.PasswordChangedAt = changedAt.Time()
+			for _, check := range []struct {
+				token   string
+				wantErr error
+			}{
+				{tokenIssuedAt(t, account.ID, changedAt.Time().Add(-time.Minute)), auth.ErrInvalidToken},
+				{tokenIssuedAt(t, account.ID, changedAt.Time()), nil},
+			} {
+				mt.AddMockResponses(cursorReply(t, "account", account))
+				if _, err := NewAuthService().VerifyToken(context.Background(), check.token); !errors.Is(err, check.wantErr) {
+					t.Errorf("verify got %v, want %v", err, check.wantErr)
+				}
+			}
+		})
+	}
+}
+
+func TestLogin(t *testing.T) {
+	initJWT(t)
+	mt := mtest.New(t, mockDB)
+	defer mt.Close()
+
+	hash, err := model.HashPassword("Corr3ct-horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	account := model.Account{ID: primitive.NewObjectID(), Username: "alice", Password: hash}
+	user := model.User{ID: primitive.NewObjectID(), AccountId: account.ID}
+	byUsername := func(normalized, raw string) bson.M {
+		return bson.M{"username": bson.M{"$in": bson.A{normalized, raw}}}
+	}
+
+	tests := []struct {
+		name       string
+		identifier string
+		password   string
+		replies    []bson.D
+		wantFilter bson.M // of the account lookup
+		wantErr    error
+	}{
+		{"by username", " Alice", "Corr3ct-horse", []bson.D{
+			cursorReply(t, "account", account), writeReply(1),
+		}, byUsername("alice", "Alice"), nil},
+		{"by email", "Alice@Example.com", "Corr3ct-horse", []bson.D{
+			cursorReply(t, "user", user), cursorReply(t, "account", account), writeReply(1),
+		}, bson.M{"_id": account.ID}, nil},
+		{"username with an @", "al@ice", "Corr3ct-horse", []bson.D{
+			cursorReply(t, "user"), cursorReply(t, "user"), cursorReply(t, "account", account), writeReply(1),
+		}, byUsername("al@ice", "al@ice"), nil},
+		{"wrong password", "alice", "wrong", []bson.D{
+			cursorReply(t, "account", account),
+		}, byUsername("alice", "alice"), ErrInvalidCredentials},
+		{"unknown username", "bob", "Corr3ct-horse", []bson.D{
+			cursorReply(t, "account"),
+		}, byUsername("bob", "bob"), ErrInvalidCredentials},
+		{"unknown email", "bob@example.com", "Corr3ct-horse", []bson.D{
+			cursorReply(t, "user"), cursorReply(t, "user"), cursorReply(t, "account"),
+		}, byUsername("bob@example.com", "bob@example.com"), ErrInvalidCredentials},
+	}
+	for _, tt := range tests {
+		mt.Run(tt.name, func(mt *mtest.T) {
+			t := mt.T
+			useMock(mt)
+			mt.AddMockResponses(tt.replies...)
+
+			rs, err := NewAuthService().Login(context.Background(), tt.identifier, tt.password)
+			if err != tt.wantErr {
+				t.Fatalf("err %v, want %v", err, tt.wantErr)
+			}
+			var filter bson.M
+			for _, e := range mt.GetAllStartedEvents() {
+				if e.CommandName == "find" && e.Command.Lookup("find").StringValue() == "account" {
+					filter = asMap(t, e.Command.Lookup("filter").Document())
+				}
+			}
+			if !reflect.DeepEqual(filter, tt.wantFilter) {
+				t.Errorf("account looked up by %v, want %v", filter, tt.wantFilter)
+			}
+			if err == nil && (rs.Token == "" || rs.RefreshToken == "") {
+				t.Errorf("no tokens in %+v", rs)
+			}
+		})
+	}
+}
+
+// An unknown identifier still pays for a bcrypt comparison, or response times would tell which accounts exist
+func TestLoginUnknownTakesAsLong(t *testing.T) {
+	mt := mtest.New(t, mockDB)
+	defer mt.Close()
+
+	if cost, err := bcrypt.Cost([]byte(dummyHash)); err != nil || cost != bcrypt.DefaultCost {
+		t.Fatalf("dummy hash cost %d (%v), want %d like real ones", cost, err, bcrypt.DefaultCost)
+	}
+	compare := time.Now()
+	(&model.Account{Password: dummyHash}).CheckPassword("Corr3ct-horse")
+	oneCheck := time.Since(compare)
+
+	mt.Run("unknown", func(mt *mtest.T) {
+		t := mt.T
+		useMock(mt)
+		mt.AddMockResponses(cursorReply(t, "account"))
+
+		start := time.Now()
+		if _, err := NewAuthService().Login(context.Background(), "bob", "Corr3ct-horse"); err != ErrInvalidCredentials {
+			t.Fatalf("err %v, want %v", err, ErrInvalidCredentials)
+		}
+		// loose bound, only the missing comparison must show
+		if took := time.Since(start); took < oneCheck/4 {
+			t.Errorf("took %v, a password check takes %v", took, oneCheck)
+		}
+	})
+}
+
+func TestGetDefaultRole(t *testing.T) {
+	tests := []struct {
+		name          string
+		defaultRole   string
+		denyByDefault string
+		want          string
+	}{
+		{"unset", "", "", "user"},
+		{"configured", "member", "", "member"},
+		{"deny by default", "", "true", ""},
+		{"deny by default wins over the configured role", "member", "1", ""},
+		{"deny by default off", "member", "false", "member"},
+		{"unparsable deny by default", "", "yes", "user"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("DEFAULT_ROLE", tt.defaultRole)
+			t.Setenv("DENY_BY_DEFAULT", tt.denyByDefault)
+			if got := getDefaultRole(); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRegisterDenyByDefault(t *testing.T) {
+	t.Setenv("DENY_BY_DEFAULT", "true")
+	mt := mtest.New(t, mockDB)
+	defer mt.Close()
+
+	mt.Run("no role", func(mt *mtest.T) {
+		t := mt.T
+		useMock(mt)
+		mt.AddMockResponses(cursorReply(t, "account"), mtest.CreateSuccessResponse())
+
+		if _, err := NewAuthService().Register(context.Background(), "alice", "Corr3ct-horse"); err != nil {
+			t.Fatal(err)
+		}
+		for _, e := range mt.GetAllStartedEvents() {
+			if e.CommandName == "find" && e.Command.Lookup("find").StringValue() == "role" {
+				t.Errorf("looked up a default role: %v", e.Command)
+			}
+		}
+		var account model.Account
+		for _, e := range mt.GetAllStartedEvents() {
+			if e.CommandName == "insert" {
+				bson.Unmarshal(e.Command.Lookup("documents", "0").Document(), &account)
+			}
+		}
+		if account.Username != "alice" || account.Roles == nil || len(account.Roles) != 0 {
+			t.Errorf("stored %+v, want alice with an empty roles list", account)
+		}
+	})
+}
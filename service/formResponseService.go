@@ -0,0 +1,112 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"main/db"
+	"main/db/builder"
+	"main/model"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+var (
+	ErrUnknownQuestion = errors.New("answer to a question that is not on the form")
+	ErrDuplicateAnswer = errors.New("question answered more than once")
+)
+
+type FormResponseService struct {
+	responseCollection *mongo.Collection
+	formCollection     *mongo.Collection
+	questionCollection *mongo.Collection
+	userCollection     *mongo.Collection
+}
+
+func NewFormResponseService() *FormResponseService {
+	return &FormResponseService{
+		responseCollection: db.MongoDatabase.Collection("formResponse"),
+		formCollection:     db.MongoDatabase.Collection("form"),
+		questionCollection: db.MongoDatabase.Collection("question"),
+		userCollection:     db.MongoDatabase.Collection("user"),
+	}
+}
+
+// The respondent is the user of accountId, the response is anonymous without one (service clients)
+func (rs *FormResponseService) SubmitResponse(ctx context.Context, fid string, accountId string, req *model.FormResponseRequest) (*mongo.InsertOneResult, error) {
+	ctx, cancel := db.WithTimeout(ctx)
+	defer cancel()
+
+	var respondentId primitive.ObjectID
+	if accountId != "" {
+		var err error
+		if respondentId, err = userIdOfAccount(ctx, rs.userCollection, accountId); err != nil {
+			return nil, err
+		}
+	}
+
+	form, err := builder.GetById[model.Form](ctx, rs.formCollection, fid)
+	if err != nil {
+		return nil, err
+	}
+
+	var questions []model.Question
+	cursor, err := rs.questionCollection.Find(ctx, bson.M{"_id": bson.M{"$in": form.Questions}})
+	if err != nil {
+		return nil, err
+	}
+	if err = cursor.All(ctx, &questions); err != nil {
+		return nil, err
+	}
+	onForm := map[primitive.ObjectID]*model.Question{}
+	for i := range questions {
+		onForm[questions[i].Id] = &questions[i]
+	}
+
+	answered := map[primitive.ObjectID]interface{}{}
+	for _, answer := range req.Answers {
+		if onForm[answer.QuestionId] == nil {
+			return nil, ErrUnknownQuestion
+		}
+		if _, ok := answered[answer.QuestionId]; ok {
+			return nil, ErrDuplicateAnswer
+		}
+		answered[answer.QuestionId] = answer.Value
+	}
+
+	// unanswered questions are checked too, for the required rule
+	var invalid model.ValidationErrors
+	for _, question := range questions {
+		if err := ValidateAnswer(&question, answered[question.Id]); err != nil {
+			invalid = append(invalid, err.(model.ValidationError))
+		}
+	}
+	if len(invalid) > 0 {
+		return nil, invalid
+	}
+
+	return rs.responseCollection.InsertOne(ctx, &model.FormResponse{
+		FormId:       form.ID,
+		RespondentId: respondentId,
+		Answers:      req.Answers,
+	})
+}
+
+func (rs *FormResponseService) GetResponses(ctx context.Context, fid string, page int, limit int) (*model.PagedResponse[model.FormResponse], error) {
+	ctx, cancel := db.WithTimeout(ctx)
+	defer cancel()
+
+	id, err := builder.ConvertToObjectId(fid)
+	if err != nil {
+		return nil, err
+	}
+	aggSearch := builder.SearchById("formId", id)
+	aggSort := builder.Sort("submittedAt", -1)
+
+	responses, total, err := builder.AggregatePaged[model.FormResponse](ctx, rs.responseCollection, []bson.M{aggSearch, aggSort}, page, limit)
+	if err != nil {
+		return nil, err
+	}
+	return model.NewPagedResponse(responses, page, limit, total), nil
+}
@@ -0,0 +1,169 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"main/db"
+	"main/db/builder"
+	"main/model"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var ErrQuestionNotFound = errors.New("question not found")
+
+type FormService struct {
+	formCollection     *mongo.Collection
+	questionCollection *mongo.Collection
+	projectCollection  *mongo.Collection
+	responseCollection *mongo.Collection
+}
+
+func NewFormService() *FormService {
+	return &FormService{
+		formCollection:     db.MongoDatabase.Collection("form"),
+		questionCollection: db.MongoDatabase.Collection("question"),
+		projectCollection:  db.MongoDatabase.Collection("project"),
+		responseCollection: db.MongoDatabase.Collection("formResponse"),
+	}
+}
+
+func (fs *FormService) GetForms(ctx context.Context, page int, limit int) (*model.PagedResponse[model.Form], error) {
+	ctx, cancel := db.WithTimeout(ctx)
+	defer cancel()
+
+	forms, total, err := builder.AggregatePaged[model.Form](ctx, fs.formCollection, []bson.M{builder.Sort("createAt", -1)}, page, limit)
+	if err != nil {
+		return nil, err
+	}
+	return model.NewPagedResponse(forms, page, limit, total), nil
+}
+
+func (fs *FormService) GetFormById(ctx context.Context, fid string) (*model.Form, error) {
+	ctx, cancel := db.WithTimeout(ctx)
+	defer cancel()
+
+	return builder.GetById[model.Form](ctx, fs.formCollection, fid)
+}
+
+func (fs *FormService) CreateForm(ctx context.Context, form *model.Form) (*mongo.InsertOneResult, error) {
+	ctx, cancel := db.WithTimeout(ctx)
+	defer cancel()
+
+	if err := fs.checkQuestions(ctx, form.Questions...); err != nil {
+		return nil, err
+	}
+	return fs.formCollection.InsertOne(ctx, form)
+}
+
+func (fs *FormService) UpdateForm(ctx context.Context, fid string, req *model.FormUpdateRequest) (*model.Form, error) {
+	ctx, cancel := db.WithTimeout(ctx)
+	defer cancel()
+
+	set := bson.M{"updateAt": time.Now()}
+	if req.Name != nil {
+		set["name"] = *req.Name
+	}
+	if req.Description != nil {
+		set["description"] = *req.Description
+	}
+	if req.Questions != nil {
+		if err := fs.checkQuestions(ctx, *req.Questions...); err != nil {
+			return nil, err
+		}
+		set["questions"] = *req.Questions
+	}
+	return fs.update(ctx, fid, bson.M{"$set": set})
+}
+
+// Deletes the form along with its responses and detaches it from the projects using it
+func (fs *FormService) DeleteForm(ctx context.Context, fid string) error {
+	ctx, cancel := db.WithTimeout(ctx)
+	defer cancel()
+
+	id, err := builder.ConvertToObjectId(fid)
+	if err != nil {
+		return err
+	}
+	return db.WithTransaction(ctx, func(sc mongo.SessionContext) error {
+		rs, err := fs.formCollection.DeleteOne(sc, bson.M{"_id": id})
+		if err != nil {
+			return err
+		}
+		if rs.DeletedCount == 0 {
+			return mongo.ErrNoDocuments
+		}
+		if _, err := fs.projectCollection.UpdateMany(sc, bson.M{"forms": id}, bson.M{"$pull": bson.M{"forms": id}}); err != nil {
+			return err
+		}
+		// answers without their form can't be read nor validated anymore
+		_, err = fs.responseCollection.DeleteMany(sc, bson.M{"formId": id})
+		return err
+	})
+}
+
+// Attaching a question already on the form is a no-op
+func (fs *FormService) AddQuestion(ctx context.Context, fid string, questionId primitive.ObjectID) (*model.Form, error) {
+	ctx, cancel := db.WithTimeout(ctx)
+	defer cancel()
+
+	if err := fs.checkQuestions(ctx, questionId); err != nil {
+		return nil, err
+	}
+	return fs.update(ctx, fid, bson.M{
+		"$addToSet": bson.M{"questions": questionId},
+		"$set":      bson.M{"updateAt": time.Now()},
+	})
+}
+
+// Detaching a question not on the form is a no-op
+func (fs *FormService) RemoveQuestion(ctx context.Context, fid string, questionId string) (*model.Form, error) {
+	ctx, cancel := db.WithTimeout(ctx)
+	defer cancel()
+
+	qid, err := builder.ConvertToObjectId(questionId)
+	if err != nil {
+		return nil, err
+	}
+	return fs.update(ctx, fid, bson.M{
+		"$pull": bson.M{"questions": qid},
+		"$set":  bson.M{"updateAt": time.Now()},
+	})
+}
+
+func (fs *FormService) update(ctx context.Context, fid string, update bson.M) (*model.Form, error) {
+	var form model.Form
+	id, err := builder.ConvertToObjectId(fid)
+	if err != nil {
+		return nil, err
+	}
+	err = fs.formCollection.FindOneAndUpdate(ctx, bson.M{"_id": id}, update,
+		options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&form)
+	if err != nil {
+		return nil, err
+	}
+	return &form, nil
+}
+
+// every id has to be an existing question
+func (fs *FormService) checkQuestions(ctx context.Context, ids ...primitive.ObjectID) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	unique := map[primitive.ObjectID]bool{}
+	for _, id := range ids {
+		unique[id] = true
+	}
+	count, err := fs.questionCollection.CountDocuments(ctx, bson.M{"_id": bson.M{"$in": ids}})
+	if err != nil {
+		return err
+	}
+	if count != int64(len(unique)) {
+		return ErrQuestionNotFound
+	}
+	return nil
+}
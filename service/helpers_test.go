@@ -0,0 +1,135 @@
+package service
+
+import (
+	"strings"
+	"testing"
+
+	"main/auth"
+	"main/db"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+// Shared by the service tests. Services run against the driver's mock deployment: every test
+// queues the replies of the commands it expects, in order, and checks the commands sent.
+
+var mockDB = mtest.NewOptions().ClientType(mtest.Mock)
+
+// Points the db package at the mock deployment, services have to be created after
+func useMock(mt *mtest.T) {
+	db.MongoClient = mt.Client
+	db.MongoDatabase = mt.DB
+}
+
+// Signs tokens with a fixed secret, as InitJWT does at startup
+func initJWT(t testing.TB) {
+	t.Setenv("JWT_SECRET", strings.Repeat("s", 32))
+	auth.InitJWT()
+}
+
+// reply to a find or aggregate
+func cursorReply(t testing.TB, coll string, docs ...interface{}) bson.D {
+	batch := make([]bson.D, 0, len(docs))
+	for _, d := range docs {
+		batch = append(batch, toDoc(t, d))
+	}
+	return mtest.CreateCursorResponse(0, "test."+coll, mtest.FirstBatch, batch...)
+}
+
+// reply to CountDocuments
+func countReply(t testing.TB, coll string, n int) bson.D {
+	if n == 0 {
+		return cursorReply(t, coll)
+	}
+	return cursorReply(t, coll, bson.M{"_id": 1, "n": n})
+}
+
+// reply to an insert, update or delete touching n documents
+func writeReply(n int) bson.D {
+	return mtest.CreateSuccessResponse(bson.E{Key: "n", Value: n}, bson.E{Key: "nModified", Value: n})
+}
+
+// reply to a FindOneAndUpdate/Delete, doc nil when nothing matched
+func findAndModifyReply(t testing.TB, doc interface{}) bson.D {
+	if doc == nil {
+		return mtest.CreateSuccessResponse(bson.E{Key: "value", Value: nil})
+	}
+	return mtest.CreateSuccessResponse(bson.E{Key: "value", Value: toDoc(t, doc)})
+}
+
+// reply to an upsert that inserted a document
+func upsertReply(t testing.TB, id interface{}) bson.D {
+	return mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}, bson.E{Key: "nModified", Value: 0},
+		bson.E{Key: "upserted", Value: bson.A{bson.D{{Key: "index", Value: 0}, {Key: "_id", Value: id}}}})
+}
+
+func duplicateKeyReply() bson.D {
+	return mtest.CreateWriteErrorsResponse(mtest.WriteError{Index: 0, Code: 11000, Message: "E11000 duplicate key error"})
+}
+
+func toDoc(t testing.TB, v interface{}) bson.D {
+	t.Helper()
+	raw, err := bson.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var d bson.D
+	if err := bson.Unmarshal(raw, &d); err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+// A write statement sent to the database: the filter and, for updates, the update document
+type statement struct {
+	Filter bson.Raw
+	Update bson.Raw
+}
+
+// Statements of every command name ("update", "delete"...) sent to coll, in order
+func sentStatements(mt *mtest.T, name string, coll string) []statement {
+	list, filter, update := map[string]string{"update": "updates", "delete": "deletes"}[name], "q", "u"
+	if name == "findAndModify" {
+		filter, update = "query", "update"
+	}
+	var statements []statement
+	for _, e := range mt.GetAllStartedEvents() {
+		if e.CommandName != name || e.Command.Lookup(name).StringValue() != coll {
+			continue
+		}
+		if list == "" {
+			statements = append(statements, rawStatement(e.Command, filter, update))
+			continue
+		}
+		values, _ := e.Command.Lookup(list).Array().Values()
+		for _, v := range values {
+			statements = append(statements, rawStatement(v.Document(), filter, update))
+		}
+	}
+	return statements
+}
+
+func rawStatement(doc bson.Raw, filter string, update string) statement {
+	s := statement{}
+	if v, err := doc.LookupErr(filter); err == nil {
+		s.Filter = v.Document()
+	}
+	if v, err := doc.LookupErr(update); err == nil {
+		s.Update = v.Document()
+	}
+	return s
+}
+
+// Decodes raw into a map so tests can compare plain values
+func asMap(t testing.TB, raw bson.Raw) bson.M {
+	t.Helper()
+	m := bson.M{}
+	if raw == nil {
+		return m
+	}
+	if err := bson.Unmarshal(raw, &m); err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
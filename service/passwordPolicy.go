@@ -0,0 +1,136 @@
+package service
+
+import (
+	"bufio"
+	"fmt"
+	"main/model"
+	"os"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// a few of the most common leaked passwords, PASSWORD_DENYLIST_PATH adds more
+var commonPasswords = []string{
+	"password", "password1", "password123", "123456", "12345678", "123456789", "1234567890",
+	"qwerty", "qwerty123", "abc123", "111111", "iloveyou", "admin", "admin123", "welcome",
+	"welcome1", "letmein", "monkey", "dragon", "football", "baseball", "sunshine", "princess",
+	"passw0rd", "p@ssw0rd", "Password1", "Password123",
+}
+
+// bcrypt ignores everything past 72 bytes, longer passwords would match on their prefix
+const maxPasswordBytes = 72
+
+type PasswordPolicy struct {
+	MinLength     int
+	RequireUpper  bool
+	RequireLower  bool
+	RequireDigit  bool
+	RequireSymbol bool
+	denylist      map[string]bool // lowercased
+}
+
+/*
+* LoadPasswordPolicy
+* PASSWORD_MIN_LENGTH: default 8, at most 72
+* PASSWORD_REQUIRE_UPPER, PASSWORD_REQUIRE_LOWER, PASSWORD_REQUIRE_DIGIT: default true
+* PASSWORD_REQUIRE_SYMBOL: default false
+* PASSWORD_DENYLIST_PATH: file with one forbidden password per line, on top of the built-in list
+ */
+func LoadPasswordPolicy() (*PasswordPolicy, error) {
+	policy := &PasswordPolicy{
+		MinLength:     8,
+		RequireUpper:  envBool("PASSWORD_REQUIRE_UPPER", true),
+		RequireLower:  envBool("PASSWORD_REQUIRE_LOWER", true),
+		RequireDigit:  envBool("PASSWORD_REQUIRE_DIGIT", true),
+		RequireSymbol: envBool("PASSWORD_REQUIRE_SYMBOL", false),
+		denylist:      map[string]bool{},
+	}
+	if v := os.Getenv("PASSWORD_MIN_LENGTH"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("PASSWORD_MIN_LENGTH: %q is not a positive number", v)
+		}
+		if n > maxPasswordBytes {
+			return nil, fmt.Errorf("PASSWORD_MIN_LENGTH: %d is over the %d bytes bcrypt supports", n, maxPasswordBytes)
+		}
+		policy.MinLength = n
+	}
+
+	for _, p := range commonPasswords {
+		policy.denylist[strings.ToLower(p)] = true
+	}
+	if path := os.Getenv("PASSWORD_DENYLIST_PATH"); path != "" {
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			if p := strings.TrimSpace(scanner.Text()); p != "" {
+				policy.denylist[strings.ToLower(p)] = true
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return policy, nil
+}
+
+// Every rule the password breaks, as validation errors on field
+func (p *PasswordPolicy) Validate(field string, password string) error {
+	var errs model.ValidationErrors
+	fail := func(msg string) {
+		errs = append(errs, model.ValidationError{Field: field, Message: msg})
+	}
+
+	if utf8.RuneCountInString(password) < p.MinLength {
+		fail(fmt.Sprintf("must be at least %d characters", p.MinLength))
+	}
+	if len(password) > maxPasswordBytes {
+		fail(fmt.Sprintf("must be at most %d bytes", maxPasswordBytes))
+	}
+	var upper, lower, digit, symbol bool
+	for _, c := range password {
+		switch {
+		case unicode.IsUpper(c):
+			upper = true
+		case unicode.IsLower(c):
+			lower = true
+		case unicode.IsDigit(c):
+			digit = true
+		case unicode.IsPunct(c) || unicode.IsSymbol(c):
+			symbol = true
+		}
+	}
+	if p.RequireUpper && !upper {
+		fail("must contain an uppercase letter")
+	}
+	if p.RequireLower && !lower {
+		fail("must contain a lowercase letter")
+	}
+	if p.RequireDigit && !digit {
+		fail("must contain a digit")
+	}
+	if p.RequireSymbol && !symbol {
+		fail("must contain a symbol")
+	}
+	if p.denylist[strings.ToLower(password)] {
+		fail("is too common")
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+func envBool(key string, def bool) bool {
+	if v, err := strconv.ParseBool(os.Getenv(key)); err == nil {
+		return v
+	}
+	return def
+}
@@ -0,0 +1,105 @@
+package service
+
+import (
+	"errors"
+	"main/model"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestPasswordPolicyValidate(t *testing.T) {
+	strict := &PasswordPolicy{
+		MinLength:     8,
+		RequireUpper:  true,
+		RequireLower:  true,
+		RequireDigit:  true,
+		RequireSymbol: true,
+		denylist:      map[string]bool{"p@ssw0rd!": true},
+	}
+	lenient := &PasswordPolicy{MinLength: 1, denylist: map[string]bool{}}
+
+	tests := []struct {
+		name     string
+		policy   *PasswordPolicy
+		password string
+		want     []string // messages, nil when valid
+	}{
+		{"valid", strict, "Corr3ct-horse", nil},
+		{"too short", strict, "Ab1-", []string{"must be at least 8 characters"}},
+		{"length counts characters not bytes", strict, "Äb1-éééé", nil},
+		{"72 bytes", lenient, strings.Repeat("a", 72), nil},
+		{"over 72 bytes", lenient, strings.Repeat("a", 73), []string{"must be at most 72 bytes"}},
+		{"over 72 bytes in multi-byte characters", lenient, strings.Repeat("é", 37), []string{"must be at most 72 bytes"}},
+		{"no uppercase", strict, "corr3ct-horse", []string{"must contain an uppercase letter"}},
+		{"no lowercase", strict, "CORR3CT-HORSE", []string{"must contain a lowercase letter"}},
+		{"no digit", strict, "Correct-horse", []string{"must contain a digit"}},
+		{"no symbol", strict, "Corr3cthorse", []string{"must contain a symbol"}},
+		{"denied whatever the case", strict, "P@ssw0rd!", []string{"is too common"}},
+		{"every broken rule", strict, "a", []string{
+			"must be at least 8 characters",
+			"must contain an uppercase letter",
+			"must contain a digit",
+			"must contain a symbol",
+		}},
+		{"rules off", lenient, "a", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.policy.Validate("password", tt.password)
+			if tt.want == nil {
+				if err != nil {
+					t.Fatalf("got %v, want no error", err)
+				}
+				return
+			}
+			var errs model.ValidationErrors
+			if !errors.As(err, &errs) {
+				t.Fatalf("got %v, want validation errors", err)
+			}
+			var got []string
+			for _, e := range errs {
+				if e.Field != "password" {
+					t.Errorf("field %q, want password", e.Field)
+				}
+				got = append(got, e.Message)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadPasswordPolicyMinLength(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    int
+		wantErr bool
+	}{
+		{"", 8, false},
+		{"12", 12, false},
+		{"72", 72, false},
+		{"73", 0, true},
+		{"0", 0, true},
+		{"eight", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			t.Setenv("PASSWORD_MIN_LENGTH", tt.value)
+			policy, err := LoadPasswordPolicy()
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("got min length %d, want an error", policy.MinLength)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if policy.MinLength != tt.want {
+				t.Errorf("got %d, want %d", policy.MinLength, tt.want)
+			}
+		})
+	}
+}
@@ -2,46 +2,220 @@ package service
 
 import (
 	"context"
+	"errors"
 	"main/db"
 	"main/db/builder"
 	"main/model"
+	"regexp"
+	"time"
 
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
+var ErrNoUserProfile = errors.New("account has no user profile yet")
+
 type ProjectService struct {
 	projectCollection *mongo.Collection
+	userCollection    *mongo.Collection
 }
 
 func NewProjectService() *ProjectService {
 	return &ProjectService{
 		projectCollection: db.MongoDatabase.Collection("project"),
+		userCollection:    db.MongoDatabase.Collection("user"),
 	}
 }
 
-func (p *ProjectService) GetProjects() (*[]model.ProjectResponse, error) {
-	var projects []model.ProjectResponse
+func (p *ProjectService) GetProjects(ctx context.Context, query model.ProjectQuery, page int, limit int) (*model.PagedResponse[model.ProjectResponse], error) {
+	ctx, cancel := db.WithTimeout(ctx)
+	defer cancel()
 
+	var pipeline []bson.M
+	if query.Name != "" {
+		pipeline = append(pipeline, builder.SearchInsensitiveMultiline("name", regexp.QuoteMeta(query.Name)))
+	}
+	if query.SortField != "" {
+		pipeline = append(pipeline, builder.Sort(query.SortField, query.SortOrder))
+	}
 	aggLookup := builder.Lookup("user", "createBy", "_id", "createBy")
-	aggUnwind := builder.Unwind("createBy")
+	// orphaned projects have no creator left, they're still listed
+	aggUnwind := builder.Unwind("createBy", true)
 
-	cursor, err := p.projectCollection.Aggregate(context.TODO(), []bson.M{aggLookup, aggUnwind})
+	projects, total, err := builder.AggregatePaged[model.ProjectResponse](ctx, p.projectCollection, pipeline, page, limit, aggLookup, aggUnwind)
 	if err != nil {
 		return nil, err
 	}
 
-	if err = cursor.All(context.TODO(), &projects); err != nil {
+	return model.NewPagedResponse(projects, page, limit, total), nil
+}
+
+func (p *ProjectService) GetProjectById(ctx context.Context, pid string) (*model.Project, error) {
+	ctx, cancel := db.WithTimeout(ctx)
+	defer cancel()
+
+	return builder.GetById[model.Project](ctx, p.projectCollection, pid)
+}
+
+// The server owns _id, version and orphaned, createBy has to be set by the caller
+func (p *ProjectService) CreateProject(ctx context.Context, project *model.Project) (*mongo.InsertOneResult, error) {
+	ctx, cancel := db.WithTimeout(ctx)
+	defer cancel()
+
+	project.ID = primitive.NilObjectID
+	project.Version = 0
+	project.Orphaned = false
+	return p.projectCollection.InsertOne(ctx, project)
+}
+
+// User of the account, the one its projects are created by
+func (p *ProjectService) UserIdOfAccount(ctx context.Context, accountId string) (primitive.ObjectID, error) {
+	ctx, cancel := db.WithTimeout(ctx)
+	defer cancel()
+
+	return userIdOfAccount(ctx, p.userCollection, accountId)
+}
+
+// ErrNoUserProfile when the account didn't create its user yet
+func userIdOfAccount(ctx context.Context, userCollection *mongo.Collection, accountId string) (primitive.ObjectID, error) {
+	id, err := primitive.ObjectIDFromHex(accountId)
+	if err != nil {
+		return primitive.NilObjectID, err
+	}
+	user, err := builder.GetByFieldProjected[model.User](ctx, userCollection, "accountId", id, map[string]int{"_id": 1})
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return primitive.NilObjectID, ErrNoUserProfile
+	}
+	if err != nil {
+		return primitive.NilObjectID, err
+	}
+	return user.ID, nil
+}
+
+// Whether the account's user created the project, mongo.ErrNoDocuments when there's no such project
+func (p *ProjectService) IsOwner(ctx context.Context, pid string, accountId string) (bool, error) {
+	userId, err := p.UserIdOfAccount(ctx, accountId)
+	if errors.Is(err, ErrNoUserProfile) {
+		userId = primitive.NilObjectID
+	} else if err != nil {
+		return false, err
+	}
+
+	ctx, cancel := db.WithTimeout(ctx)
+	defer cancel()
+	project, err := builder.GetByIdProjected[model.Project](ctx, p.projectCollection, pid, map[string]int{"createBy": 1})
+	if err != nil {
+		return false, err
+	}
+	return !userId.IsZero() && project.CreateBy == userId, nil
+}
+
+func (p *ProjectService) UpdateProject(ctx context.Context, pid string, req *model.ProjectUpdateRequest) (*model.Project, error) {
+	ctx, cancel := db.WithTimeout(ctx)
+	defer cancel()
+
+	id, err := builder.ConvertToObjectId(pid)
+	if err != nil {
 		return nil, err
 	}
 
-	return &projects, nil
+	set := bson.M{"updateAt": time.Now()}
+	if req.Name != nil {
+		set["name"] = *req.Name
+	}
+	if req.Description != nil {
+		set["description"] = *req.Description
+	}
+	if req.Participants != nil {
+		set["participants"] = *req.Participants
+	}
+	if req.Forms != nil {
+		set["forms"] = *req.Forms
+	}
+
+	if req.Version != nil {
+		if _, err := builder.UpdateVersioned(ctx, p.projectCollection, pid, set, *req.Version); err != nil {
+			return nil, err
+		}
+	} else {
+		rs, err := p.projectCollection.UpdateByID(ctx, id, bson.M{"$set": set, "$inc": bson.M{"version": 1}})
+		if err != nil {
+			return nil, err
+		}
+		if rs.MatchedCount == 0 {
+			return nil, mongo.ErrNoDocuments
+		}
+	}
+
+	return builder.GetById[model.Project](ctx, p.projectCollection, pid)
+}
+
+func (p *ProjectService) DeleteProject(ctx context.Context, pid string) error {
+	ctx, cancel := db.WithTimeout(ctx)
+	defer cancel()
+
+	id, err := builder.ConvertToObjectId(pid)
+	if err != nil {
+		return err
+	}
+	rs, err := p.projectCollection.DeleteOne(ctx, bson.M{"_id": id})
+	if err != nil {
+		return err
+	}
+	if rs.DeletedCount == 0 {
+		return mongo.ErrNoDocuments
+	}
+	return nil
+}
+
+// Adding a user already taking part is a no-op
+func (p *ProjectService) AddParticipant(ctx context.Context, pid string, userId primitive.ObjectID) (*model.Project, error) {
+	ctx, cancel := db.WithTimeout(ctx)
+	defer cancel()
+
+	count, err := p.userCollection.CountDocuments(ctx, bson.M{"_id": userId})
+	if err != nil {
+		return nil, err
+	}
+	if count == 0 {
+		return nil, ErrUserNotFound
+	}
+	return p.updateParticipants(ctx, pid, bson.M{"$addToSet": bson.M{"participants": userId}})
 }
 
-func (p *ProjectService) GetProjectById(pid string) (*model.Project, error) {
-	return builder.GetById[model.Project](p.projectCollection, pid)
+// Removing a user not taking part is a no-op
+func (p *ProjectService) RemoveParticipant(ctx context.Context, pid string, userId string) (*model.Project, error) {
+	ctx, cancel := db.WithTimeout(ctx)
+	defer cancel()
+
+	uid, err := builder.ConvertToObjectId(userId)
+	if err != nil {
+		return nil, err
+	}
+	return p.updateParticipants(ctx, pid, bson.M{"$pull": bson.M{"participants": uid}})
 }
 
-func (p *ProjectService) CreateProject(project *model.Project) (*mongo.InsertOneResult, error) {
-	return p.projectCollection.InsertOne(context.TODO(), project)
+// $addToSet/$pull only touch the given user so concurrent changes to other participants are kept
+func (p *ProjectService) updateParticipants(ctx context.Context, pid string, update bson.M) (*model.Project, error) {
+	var project model.Project
+	id, err := builder.ConvertToObjectId(pid)
+	if err != nil {
+		return nil, err
+	}
+	// $addToSet/$pull fail on a null array, projects created without participants have one
+	_, err = p.projectCollection.UpdateOne(ctx, bson.M{"_id": id, "participants": nil},
+		bson.M{"$set": bson.M{"participants": []primitive.ObjectID{}}})
+	if err != nil {
+		return nil, err
+	}
+
+	update["$set"] = bson.M{"updateAt": time.Now()}
+	err = p.projectCollection.FindOneAndUpdate(ctx, bson.M{"_id": id}, update,
+		options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&project)
+	if err != nil {
+		return nil, err
+	}
+	return &project, nil
 }
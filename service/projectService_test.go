@@ -0,0 +1,69 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"main/db/builder"
+	"main/model"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+func TestUpdateProjectVersion(t *testing.T) {
+	mt := mtest.New(t, mockDB)
+	defer mt.Close()
+
+	id := primitive.NewObjectID()
+	name := "Renamed"
+	version := func(v int64) *int64 { return &v }
+
+	tests := []struct {
+		name        string
+		version     *int64
+		replies     []bson.D
+		wantErr     error
+		wantVersion interface{} // the version filter sent, nil when unguarded
+	}{
+		{"fresh version", version(4), []bson.D{
+			writeReply(1),
+			cursorReply(t, "project", model.Project{ID: id, Name: name, Version: 5}),
+		}, nil, int64(4)},
+		{"stale version", version(3), []bson.D{writeReply(0), countReply(t, "project", 1)}, builder.ErrVersionConflict, int64(3)},
+		{"no version given", nil, []bson.D{
+			writeReply(1),
+			cursorReply(t, "project", model.Project{ID: id, Name: name, Version: 5}),
+		}, nil, nil},
+	}
+	for _, tt := range tests {
+		mt.Run(tt.name, func(mt *mtest.T) {
+			t := mt.T
+			useMock(mt)
+			mt.AddMockResponses(tt.replies...)
+
+			project, err := NewProjectService().UpdateProject(context.Background(), id.Hex(),
+				&model.ProjectUpdateRequest{Name: &name, Version: tt.version})
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("err %v, want %v", err, tt.wantErr)
+			}
+			if err == nil && (project.Name != name || project.Version != 5) {
+				t.Errorf("got %+v, want the updated project", project)
+			}
+
+			updates := sentStatements(mt, "update", "project")
+			if len(updates) != 1 {
+				t.Fatalf("sent %d updates, want 1", len(updates))
+			}
+			filter, update := asMap(t, updates[0].Filter), asMap(t, updates[0].Update)
+			if filter["version"] != tt.wantVersion {
+				t.Errorf("version filter %v, want %v", filter["version"], tt.wantVersion)
+			}
+			if inc, _ := update["$inc"].(bson.M); inc["version"] != int32(1) {
+				t.Errorf("update %v does not bump the version", update)
+			}
+		})
+	}
+}
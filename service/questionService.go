@@ -2,7 +2,10 @@ package service
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"main/db"
+	"main/db/builder"
 	"main/model"
 
 	"github.com/google/uuid"
@@ -20,28 +23,37 @@ func NewQuestionService() *QuestionService {
 	}
 }
 
-func (qs *QuestionService) GetQuestionById(id string) (*model.Question, error) {
+func (qs *QuestionService) GetQuestionById(ctx context.Context, id string) (*model.Question, error) {
+	ctx, cancel := db.WithTimeout(ctx)
+	defer cancel()
+
 	var question model.Question
-	err := qs.questionCollection.FindOne(context.TODO(), bson.D{{"id", id}}).Decode(&question)
+	err := qs.questionCollection.FindOne(ctx, bson.D{{Key: "id", Value: id}}).Decode(&question)
 	if err != nil {
 		return nil, err
 	}
 	return &question, nil
 }
 
-func (qs *QuestionService) GetAllQuestions() (*[]model.Question, error) {
-	var questions []model.Question
-	cursor, err := qs.questionCollection.Find(context.TODO(), bson.D{})
+func (qs *QuestionService) GetAllQuestions(ctx context.Context, page int, limit int) (*model.PagedResponse[model.Question], error) {
+	ctx, cancel := db.WithTimeout(ctx)
+	defer cancel()
+
+	questions, total, err := builder.AggregatePaged[model.Question](ctx, qs.questionCollection, []bson.M{}, page, limit)
 	if err != nil {
 		return nil, err
 	}
-	if err = cursor.All(context.TODO(), &questions); err != nil {
+	return model.NewPagedResponse(questions, page, limit, total), nil
+}
+
+func (qs *QuestionService) CreateQuestion(ctx context.Context, question *model.Question) (*mongo.InsertOneResult, error) {
+	ctx, cancel := db.WithTimeout(ctx)
+	defer cancel()
+
+	if err := ValidateQuestionRules(question); err != nil {
 		return nil, err
 	}
-	return &questions, nil
-}
 
-func (qs *QuestionService) CreateQuestion(question *model.Question) (*mongo.InsertOneResult, error) {
 	newUuid, err := uuid.NewRandom()
 	if err != nil {
 		return nil, err
@@ -49,9 +61,61 @@ func (qs *QuestionService) CreateQuestion(question *model.Question) (*mongo.Inse
 
 	question.Uuid = newUuid.String()
 
-	rs, err := qs.questionCollection.InsertOne(context.TODO(), question)
+	rs, err := qs.questionCollection.InsertOne(ctx, question)
 	if err != nil {
 		return nil, err
 	}
 	return rs, nil
 }
+
+/*
+* CreateQuestions
+* Imports many questions in one round trip. The rules of every question are checked first,
+* any invalid one rejects the whole batch. A question failing on insert (e.g. a duplicate id)
+* doesn't stop the others, it's reported in Errors.
+ */
+func (qs *QuestionService) CreateQuestions(ctx context.Context, questions []model.Question) (*model.QuestionBatchResponse, error) {
+	ctx, cancel := db.WithTimeout(ctx)
+	defer cancel()
+
+	if len(questions) == 0 {
+		return nil, model.ValidationError{Field: "questions", Message: "is required"}
+	}
+	var invalid model.ValidationErrors
+	for i := range questions {
+		var single model.ValidationError
+		if err := ValidateQuestionRules(&questions[i]); errors.As(err, &single) {
+			single.Field = fmt.Sprintf("questions[%d].%s", i, single.Field)
+			invalid = append(invalid, single)
+		}
+	}
+	if invalid != nil {
+		return nil, invalid
+	}
+
+	for i := range questions {
+		newUuid, err := uuid.NewRandom()
+		if err != nil {
+			return nil, err
+		}
+		questions[i].Uuid = newUuid.String()
+	}
+
+	inserted, err := builder.CreateMany(ctx, qs.questionCollection, questions)
+	rs := &model.QuestionBatchResponse{Questions: inserted, Errors: map[int]string{}}
+	var bulkErr mongo.BulkWriteException
+	if !errors.As(err, &bulkErr) {
+		if err != nil {
+			return nil, err
+		}
+		return rs, nil
+	}
+	// the driver messages name the database and index, only the reason goes out
+	for _, writeErr := range bulkErr.WriteErrors {
+		rs.Errors[writeErr.Index] = "not inserted"
+		if writeErr.Code == 11000 {
+			rs.Errors[writeErr.Index] = "duplicate id"
+		}
+	}
+	return rs, nil
+}
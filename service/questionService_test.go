@@ -0,0 +1,89 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"main/model"
+
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+func TestCreateQuestions(t *testing.T) {
+	mt := mtest.New(t, mockDB)
+	defer mt.Close()
+
+	batch := func() []model.Question {
+		return []model.Question{
+			{Content: "Name?", Type: model.QuestionText},
+			{Content: "Age?", Type: model.QuestionNumber},
+			{Content: "Colour?", Type: model.QuestionSingleChoice},
+		}
+	}
+
+	mt.Run("all inserted", func(mt *mtest.T) {
+		t := mt.T
+		useMock(mt)
+		mt.AddMockResponses(writeReply(3))
+
+		rs, err := NewQuestionService().CreateQuestions(context.Background(), batch())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(rs.Questions) != 3 || len(rs.Errors) != 0 {
+			t.Fatalf("got %d questions and errors %v, want 3 and none", len(rs.Questions), rs.Errors)
+		}
+		seen := map[string]bool{}
+		for i, q := range rs.Questions {
+			if q.Id.IsZero() || q.Uuid == "" || seen[q.Uuid] {
+				t.Errorf("question %d stored with id %s uuid %q", i, q.Id.Hex(), q.Uuid)
+			}
+			seen[q.Uuid] = true
+		}
+		if n := len(mt.GetAllStartedEvents()); n != 1 {
+			t.Errorf("sent %d commands, want a single insert", n)
+		}
+	})
+
+	mt.Run("duplicate in the middle", func(mt *mtest.T) {
+		t := mt.T
+		useMock(mt)
+		mt.AddMockResponses(mtest.CreateWriteErrorsResponse(
+			mtest.WriteError{Index: 1, Code: 11000, Message: "E11000 duplicate key error collection: test.question"}))
+
+		rs, err := NewQuestionService().CreateQuestions(context.Background(), batch())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(rs.Questions) != 2 || rs.Questions[0].Content != "Name?" || rs.Questions[1].Content != "Colour?" {
+			t.Errorf("got %+v, want the first and last question", rs.Questions)
+		}
+		if want := map[int]string{1: "duplicate id"}; len(rs.Errors) != 1 || rs.Errors[1] != want[1] {
+			t.Errorf("errors %v, want %v", rs.Errors, want)
+		}
+	})
+
+	mt.Run("invalid rules reject the batch", func(mt *mtest.T) {
+		t := mt.T
+		useMock(mt)
+		questions := batch()
+		questions[2].Validation = &model.QuestionValidation{Min: floatPtr(5), Max: floatPtr(1)}
+
+		_, err := NewQuestionService().CreateQuestions(context.Background(), questions)
+		var invalid model.ValidationErrors
+		if !errors.As(err, &invalid) || len(invalid) != 1 || invalid[0].Field != "questions[2].validation.min" {
+			t.Fatalf("err %v, want questions[2].validation.min", err)
+		}
+		if n := len(mt.GetAllStartedEvents()); n != 0 {
+			t.Errorf("sent %d commands, want none", n)
+		}
+	})
+
+	mt.Run("empty", func(mt *mtest.T) {
+		t := mt.T
+		useMock(mt)
+		_, err := NewQuestionService().CreateQuestions(context.Background(), nil)
+		checkValidationField(t, err, "questions")
+	})
+}
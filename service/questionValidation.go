@@ -0,0 +1,164 @@
+package service
+
+import (
+	"fmt"
+	"main/model"
+	"regexp"
+	"unicode/utf8"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Checks the rules themselves when a question is saved, so answers never hit a broken pattern
+func ValidateQuestionRules(question *model.Question) error {
+	v := question.Validation
+	if v == nil {
+		return nil
+	}
+	if v.Pattern != "" {
+		if _, err := regexp.Compile(v.Pattern); err != nil {
+			return model.ValidationError{Field: "validation.pattern", Message: "is not a valid regular expression"}
+		}
+	}
+	if v.MinLength != nil && v.MaxLength != nil && *v.MinLength > *v.MaxLength {
+		return model.ValidationError{Field: "validation.minLength", Message: "is greater than maxLength"}
+	}
+	if v.Min != nil && v.Max != nil && *v.Min > *v.Max {
+		return model.ValidationError{Field: "validation.min", Message: "is greater than max"}
+	}
+	return nil
+}
+
+/*
+* ValidateAnswer
+* Checks an answer (as decoded from JSON) against the question type and validation rules.
+* A nil answer means unanswered, only rejected for required questions.
+ */
+func ValidateAnswer(question *model.Question, answer interface{}) error {
+	field := "answers." + question.Id.Hex()
+	invalid := func(format string, args ...interface{}) error {
+		return model.ValidationError{Field: field, Message: fmt.Sprintf(format, args...)}
+	}
+
+	rules := question.Validation
+	if rules == nil {
+		rules = &model.QuestionValidation{}
+	}
+	if isEmptyAnswer(answer) {
+		if rules.Required {
+			return invalid("is required")
+		}
+		return nil
+	}
+
+	switch question.Type {
+	case model.QuestionText:
+		text, ok := answer.(string)
+		if !ok {
+			return invalid("must be a string")
+		}
+		length := utf8.RuneCountInString(text)
+		if rules.MinLength != nil && length < *rules.MinLength {
+			return invalid("must be at least %d characters", *rules.MinLength)
+		}
+		if rules.MaxLength != nil && length > *rules.MaxLength {
+			return invalid("must be at most %d characters", *rules.MaxLength)
+		}
+		if rules.Pattern != "" {
+			re, err := regexp.Compile(rules.Pattern)
+			if err != nil || !re.MatchString(text) {
+				return invalid("has an invalid format")
+			}
+		}
+
+	case model.QuestionNumber:
+		number, ok := answer.(float64)
+		if !ok {
+			return invalid("must be a number")
+		}
+		if rules.Min != nil && number < *rules.Min {
+			return invalid("must be at least %v", *rules.Min)
+		}
+		if rules.Max != nil && number > *rules.Max {
+			return invalid("must be at most %v", *rules.Max)
+		}
+
+	case model.QuestionSingleChoice:
+		choice, ok := answer.(string)
+		if !ok {
+			return invalid("must be one of the options")
+		}
+		if !containsString(questionOptions(question), choice) {
+			return invalid("%q is not one of the options", choice)
+		}
+
+	case model.QuestionMultipleChoice:
+		choices, ok := answer.([]interface{})
+		if !ok {
+			return invalid("must be a list of options")
+		}
+		if rules.MinLength != nil && len(choices) < *rules.MinLength {
+			return invalid("must pick at least %d options", *rules.MinLength)
+		}
+		if rules.MaxLength != nil && len(choices) > *rules.MaxLength {
+			return invalid("must pick at most %d options", *rules.MaxLength)
+		}
+		options := questionOptions(question)
+		picked := map[string]bool{}
+		for _, c := range choices {
+			choice, ok := c.(string)
+			if !ok || !containsString(options, choice) {
+				return invalid("%v is not one of the options", c)
+			}
+			if picked[choice] {
+				return invalid("%q is picked more than once", choice)
+			}
+			picked[choice] = true
+		}
+	}
+	return nil
+}
+
+func isEmptyAnswer(answer interface{}) bool {
+	switch a := answer.(type) {
+	case nil:
+		return true
+	case string:
+		return a == ""
+	case []interface{}:
+		return len(a) == 0
+	}
+	return false
+}
+
+// options from the validation rules, otherwise from the trait (see the example in questionModel.go)
+func questionOptions(question *model.Question) []string {
+	if question.Validation != nil && len(question.Validation.Options) > 0 {
+		return question.Validation.Options
+	}
+	var options []string
+	raw := question.Trait["options"]
+	if a, ok := raw.(primitive.A); ok { // as decoded from mongo
+		raw = []interface{}(a)
+	}
+	switch raw := raw.(type) {
+	case []interface{}:
+		for _, o := range raw {
+			if s, ok := o.(string); ok {
+				options = append(options, s)
+			}
+		}
+	case []string:
+		options = raw
+	}
+	return options
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,110 @@
+package service
+
+import (
+	"main/model"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func intPtr(n int) *int { return &n }
+
+func floatPtr(n float64) *float64 { return &n }
+
+func TestValidateQuestionRules(t *testing.T) {
+	tests := []struct {
+		name      string
+		rules     *model.QuestionValidation
+		wantField string // empty when valid
+	}{
+		{"no rules", nil, ""},
+		{"valid rules", &model.QuestionValidation{Pattern: `^\d+$`, MinLength: intPtr(1), MaxLength: intPtr(5), Min: floatPtr(0), Max: floatPtr(1)}, ""},
+		{"equal bounds", &model.QuestionValidation{MinLength: intPtr(3), MaxLength: intPtr(3), Min: floatPtr(2), Max: floatPtr(2)}, ""},
+		{"broken pattern", &model.QuestionValidation{Pattern: `(`}, "validation.pattern"},
+		{"minLength over maxLength", &model.QuestionValidation{MinLength: intPtr(5), MaxLength: intPtr(1)}, "validation.minLength"},
+		{"min over max", &model.QuestionValidation{Min: floatPtr(10), Max: floatPtr(1)}, "validation.min"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidateQuestionRules(&model.Question{Validation: tt.rules})
+			checkValidationField(t, err, tt.wantField)
+		})
+	}
+}
+
+func TestValidateAnswer(t *testing.T) {
+	choices := &model.QuestionValidation{Options: []string{"red", "green", "blue"}}
+
+	tests := []struct {
+		name     string
+		question model.Question
+		answer   interface{}
+		wantErr  bool
+	}{
+		{"unanswered optional", model.Question{Type: model.QuestionText}, nil, false},
+		{"unanswered required", model.Question{Type: model.QuestionText, Validation: &model.QuestionValidation{Required: true}}, nil, true},
+		{"empty string required", model.Question{Type: model.QuestionText, Validation: &model.QuestionValidation{Required: true}}, "", true},
+		{"empty list required", model.Question{Type: model.QuestionMultipleChoice, Validation: &model.QuestionValidation{Required: true}}, []interface{}{}, true},
+
+		{"text", model.Question{Type: model.QuestionText}, "hello", false},
+		{"text not a string", model.Question{Type: model.QuestionText}, 42.0, true},
+		{"text too short", model.Question{Type: model.QuestionText, Validation: &model.QuestionValidation{MinLength: intPtr(3)}}, "ab", true},
+		{"text length in characters", model.Question{Type: model.QuestionText, Validation: &model.QuestionValidation{MaxLength: intPtr(3)}}, "Ảnh", false},
+		{"text too long", model.Question{Type: model.QuestionText, Validation: &model.QuestionValidation{MaxLength: intPtr(3)}}, "abcd", true},
+		{"text matches pattern", model.Question{Type: model.QuestionText, Validation: &model.QuestionValidation{Pattern: `^\d{3}$`}}, "123", false},
+		{"text misses pattern", model.Question{Type: model.QuestionText, Validation: &model.QuestionValidation{Pattern: `^\d{3}$`}}, "12a", true},
+
+		{"number", model.Question{Type: model.QuestionNumber, Validation: &model.QuestionValidation{Min: floatPtr(1), Max: floatPtr(5)}}, 3.0, false},
+		{"number not a number", model.Question{Type: model.QuestionNumber}, "3", true},
+		{"number below min", model.Question{Type: model.QuestionNumber, Validation: &model.QuestionValidation{Min: floatPtr(1)}}, 0.5, true},
+		{"number above max", model.Question{Type: model.QuestionNumber, Validation: &model.QuestionValidation{Max: floatPtr(5)}}, 6.0, true},
+		{"zero is an answer", model.Question{Type: model.QuestionNumber, Validation: &model.QuestionValidation{Required: true, Min: floatPtr(0)}}, 0.0, false},
+
+		{"single choice", model.Question{Type: model.QuestionSingleChoice, Validation: choices}, "green", false},
+		{"single choice unknown", model.Question{Type: model.QuestionSingleChoice, Validation: choices}, "pink", true},
+		{"single choice not a string", model.Question{Type: model.QuestionSingleChoice, Validation: choices}, []interface{}{"red"}, true},
+		{"single choice from trait", model.Question{Type: model.QuestionSingleChoice, Trait: bson.M{"options": []string{"yes", "no"}}}, "no", false},
+		{"single choice from stored trait", model.Question{Type: model.QuestionSingleChoice, Trait: bson.M{"options": primitive.A{"yes", "no"}}}, "yes", false},
+		{"single choice unknown in trait", model.Question{Type: model.QuestionSingleChoice, Trait: bson.M{"options": []interface{}{"yes", "no"}}}, "maybe", true},
+
+		{"multi choice", model.Question{Type: model.QuestionMultipleChoice, Validation: choices}, []interface{}{"red", "blue"}, false},
+		{"multi choice not a list", model.Question{Type: model.QuestionMultipleChoice, Validation: choices}, "red", true},
+		{"multi choice unknown", model.Question{Type: model.QuestionMultipleChoice, Validation: choices}, []interface{}{"red", "pink"}, true},
+		{"multi choice not strings", model.Question{Type: model.QuestionMultipleChoice, Validation: choices}, []interface{}{1.0}, true},
+		{"multi choice picked twice", model.Question{Type: model.QuestionMultipleChoice, Validation: choices}, []interface{}{"red", "red"}, true},
+		{"multi choice too few", model.Question{Type: model.QuestionMultipleChoice, Validation: &model.QuestionValidation{Options: choices.Options, MinLength: intPtr(2)}}, []interface{}{"red"}, true},
+		{"multi choice too many", model.Question{Type: model.QuestionMultipleChoice, Validation: &model.QuestionValidation{Options: choices.Options, MaxLength: intPtr(1)}}, []interface{}{"red", "blue"}, true},
+
+		{"other types only check required", model.Question{Type: "matrix"}, map[string]interface{}{"row": "col"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.question.Id = primitive.NewObjectID()
+			err := ValidateAnswer(&tt.question, tt.answer)
+			wantField := ""
+			if tt.wantErr {
+				wantField = "answers." + tt.question.Id.Hex()
+			}
+			checkValidationField(t, err, wantField)
+		})
+	}
+}
+
+// wantField empty means err must be nil
+func checkValidationField(t *testing.T, err error, wantField string) {
+	t.Helper()
+	if wantField == "" {
+		if err != nil {
+			t.Fatalf("got %v, want no error", err)
+		}
+		return
+	}
+	verr, ok := err.(model.ValidationError)
+	if !ok {
+		t.Fatalf("got %v, want a validation error on %s", err, wantField)
+	}
+	if verr.Field != wantField {
+		t.Errorf("error on %s, want %s", verr.Field, wantField)
+	}
+}
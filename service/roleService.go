@@ -2,45 +2,309 @@ package service
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"main/db"
+	"main/db/builder"
 	"main/model"
+	"os"
+	"strings"
 
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var (
+	ErrDuplicateRole = errors.New("a role with this name already exists")
+	ErrRoleInUse     = errors.New("role is still assigned to accounts")
+	// registration hands it out, without it every signup would fail
+	ErrDefaultRole = errors.New("the default role cannot be renamed or deleted")
 )
 
 type RoleService struct {
-	roleCollection *mongo.Collection
+	roleCollection    *mongo.Collection
+	accountCollection *mongo.Collection
+	defaultRole       string // empty when running deny by default
 }
 
 func NewRoleService() *RoleService {
 	return &RoleService{
-		roleCollection: db.MongoDatabase.Collection("role"),
+		roleCollection:    db.MongoDatabase.Collection("role"),
+		accountCollection: db.MongoDatabase.Collection("account"),
+		defaultRole:       getDefaultRole(),
+	}
+}
+
+func (as *RoleService) GetRoles(ctx context.Context, page int, limit int) (*model.PagedResponse[model.Role], error) {
+	ctx, cancel := db.WithTimeout(ctx)
+	defer cancel()
+
+	roles, total, err := builder.AggregatePaged[model.Role](ctx, as.roleCollection, []bson.M{builder.Sort("name", 1)}, page, limit)
+	if err != nil {
+		return nil, err
 	}
+	return model.NewPagedResponse(roles, page, limit, total), nil
 }
 
-func (as *RoleService) GetRole(roleId string) (*model.Role, error) {
+func (as *RoleService) GetRole(ctx context.Context, roleId string) (*model.Role, error) {
+	ctx, cancel := db.WithTimeout(ctx)
+	defer cancel()
+
 	var role model.Role
 	objId, err := primitive.ObjectIDFromHex(roleId)
 	if err != nil {
 		return nil, err
 	}
 	filter := bson.M{"_id": objId}
-	er := as.roleCollection.FindOne(context.TODO(), filter).Decode(&role)
+	er := as.roleCollection.FindOne(ctx, filter).Decode(&role)
 	return &role, er
 }
 
-func (as *RoleService) GetRoleByName(roleName string) (*model.Role, error) {
+func (as *RoleService) GetRoleByName(ctx context.Context, roleName string) (*model.Role, error) {
+	ctx, cancel := db.WithTimeout(ctx)
+	defer cancel()
+
 	var role model.Role
 	filter := bson.M{"name": roleName}
-	er := as.roleCollection.FindOne(context.TODO(), filter).Decode(&role)
+	er := as.roleCollection.FindOne(ctx, filter).Decode(&role)
 	return &role, er
 }
 
-func (as *RoleService) NewRole(roleName string) (*mongo.InsertOneResult, error) {
-	role := model.Role{
-		Name: roleName,
+func (as *RoleService) NewRole(ctx context.Context, role model.Role) (*mongo.InsertOneResult, error) {
+	ctx, cancel := db.WithTimeout(ctx)
+	defer cancel()
+
+	role.Id = primitive.NilObjectID
+	if role.Name = strings.TrimSpace(role.Name); role.Name == "" {
+		return nil, model.ValidationError{Field: "name", Message: "is required"}
+	}
+	rs, err := as.roleCollection.InsertOne(ctx, role)
+	if mongo.IsDuplicateKeyError(err) {
+		return nil, ErrDuplicateRole
+	}
+	return rs, err
+}
+
+/*
+* UpdateRole
+* Renames the role and/or replaces its permissions. Accounts keep a copy of their roles,
+* those copies are updated in the same transaction.
+ */
+func (as *RoleService) UpdateRole(ctx context.Context, roleId string, req *model.RoleUpdateRequest) (*model.Role, error) {
+	ctx, cancel := db.WithTimeout(ctx)
+	defer cancel()
+
+	id, err := primitive.ObjectIDFromHex(roleId)
+	if err != nil {
+		return nil, err
+	}
+	set := bson.M{}
+	if req.Name != nil {
+		name := strings.TrimSpace(*req.Name)
+		if name == "" {
+			return nil, model.ValidationError{Field: "name", Message: "cannot be empty"}
+		}
+		set["name"] = name
+	}
+	if req.Permissions != nil {
+		set["permissions"] = *req.Permissions
+	}
+
+	var role model.Role
+	err = db.WithTransaction(ctx, func(sc mongo.SessionContext) error {
+		if name, ok := set["name"]; ok && as.defaultRole != "" && name != as.defaultRole {
+			var current model.Role
+			if err := as.roleCollection.FindOne(sc, bson.M{"_id": id}).Decode(&current); err != nil {
+				return err
+			}
+			if current.Name == as.defaultRole {
+				return ErrDefaultRole
+			}
+		}
+		if len(set) > 0 {
+			err := as.roleCollection.FindOneAndUpdate(sc, bson.M{"_id": id}, bson.M{"$set": set},
+				options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&role)
+			if mongo.IsDuplicateKeyError(err) {
+				return ErrDuplicateRole
+			}
+			if err != nil {
+				return err
+			}
+		} else if err := as.roleCollection.FindOne(sc, bson.M{"_id": id}).Decode(&role); err != nil {
+			return err
+		}
+
+		copies := bson.M{}
+		for field, value := range set {
+			copies["roles.$[role]."+field] = value
+		}
+		if len(copies) == 0 {
+			return nil
+		}
+		_, err := as.accountCollection.UpdateMany(sc, bson.M{"roles._id": id}, bson.M{"$set": copies},
+			options.Update().SetArrayFilters(options.ArrayFilters{Filters: []interface{}{bson.M{"role._id": id}}}))
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &role, nil
+}
+
+// Roles still given to an account can't be deleted, take them away first. The default role never can.
+func (as *RoleService) DeleteRole(ctx context.Context, roleId string) error {
+	ctx, cancel := db.WithTimeout(ctx)
+	defer cancel()
+
+	id, err := primitive.ObjectIDFromHex(roleId)
+	if err != nil {
+		return err
+	}
+	var role model.Role
+	if err := as.roleCollection.FindOne(ctx, bson.M{"_id": id}).Decode(&role); err != nil {
+		return err
+	}
+	if as.defaultRole != "" && role.Name == as.defaultRole {
+		return ErrDefaultRole
+	}
+	inUse, err := as.accountCollection.CountDocuments(ctx, bson.M{"roles._id": id}, options.Count().SetLimit(1))
+	if err != nil {
+		return err
+	}
+	if inUse > 0 {
+		return ErrRoleInUse
+	}
+	rs, err := as.roleCollection.DeleteOne(ctx, bson.M{"_id": id})
+	if err != nil {
+		return err
+	}
+	if rs.DeletedCount == 0 {
+		return mongo.ErrNoDocuments
+	}
+	return nil
+}
+
+func catalogHasRole(catalog *model.RoleCatalog, name string) bool {
+	for _, role := range catalog.Roles {
+		if role.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Reads and validates the JSON role catalog at path
+func LoadRoleCatalog(path string) (*model.RoleCatalog, error) {
+	var catalog model.RoleCatalog
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &catalog); err != nil {
+		return nil, fmt.Errorf("role catalog %s: %w", path, err)
+	}
+
+	defined := map[string]bool{}
+	for _, perm := range catalog.Permissions {
+		defined[perm] = true
+	}
+	seen := map[string]bool{}
+	for _, role := range catalog.Roles {
+		if role.Name == "" {
+			return nil, fmt.Errorf("role catalog %s: role without a name", path)
+		}
+		if seen[role.Name] {
+			return nil, fmt.Errorf("role catalog %s: role %q is defined twice", path, role.Name)
+		}
+		seen[role.Name] = true
+		for _, perm := range role.Permissions {
+			if !defined[perm] {
+				return nil, fmt.Errorf("role catalog %s: role %q uses undefined permission %q", path, role.Name, perm)
+			}
+		}
+	}
+	return &catalog, nil
+}
+
+/*
+* SyncRoles
+* Upserts the catalog roles by name, changed permissions are copied to the accounts holding the role.
+* With prune roles missing from the catalog are deleted, except the ones still given to an account,
+* those are reported as kept. All in one transaction.
+* Pruning with a catalog that lacks the default role is rejected with ErrDefaultRole.
+ */
+func (as *RoleService) SyncRoles(ctx context.Context, catalog *model.RoleCatalog, prune bool) (*model.RoleSyncResult, error) {
+	ctx, cancel := db.WithTimeout(ctx)
+	defer cancel()
+
+	if prune && as.defaultRole != "" && !catalogHasRole(catalog, as.defaultRole) {
+		return nil, ErrDefaultRole
+	}
+
+	var rs model.RoleSyncResult
+	err := db.WithTransaction(ctx, func(sc mongo.SessionContext) error {
+		// the transaction may be retried, start over every time
+		rs = model.RoleSyncResult{Kept: []string{}}
+		names := make([]string, 0, len(catalog.Roles))
+
+		for _, role := range catalog.Roles {
+			names = append(names, role.Name)
+			permissions := role.Permissions
+			if permissions == nil {
+				permissions = []string{}
+			}
+			updated, err := as.roleCollection.UpdateOne(sc,
+				bson.M{"name": role.Name},
+				bson.M{"$set": bson.M{"permissions": permissions}},
+				options.Update().SetUpsert(true))
+			if err != nil {
+				return err
+			}
+			rs.Upserted += updated.UpsertedCount
+			rs.Modified += updated.ModifiedCount
+			if updated.ModifiedCount == 0 {
+				continue
+			}
+			if _, err := as.accountCollection.UpdateMany(sc, bson.M{"roles.name": role.Name},
+				bson.M{"$set": bson.M{"roles.$[role].permissions": permissions}},
+				options.Update().SetArrayFilters(options.ArrayFilters{Filters: []interface{}{bson.M{"role.name": role.Name}}})); err != nil {
+				return err
+			}
+		}
+
+		if !prune {
+			return nil
+		}
+		cur, err := as.roleCollection.Find(sc, bson.M{"name": bson.M{"$nin": names}})
+		if err != nil {
+			return err
+		}
+		var stale []model.Role
+		if err := cur.All(sc, &stale); err != nil {
+			return err
+		}
+		for _, role := range stale {
+			inUse, err := as.accountCollection.CountDocuments(sc, bson.M{"roles._id": role.Id}, options.Count().SetLimit(1))
+			if err != nil {
+				return err
+			}
+			if inUse > 0 {
+				rs.Kept = append(rs.Kept, role.Name)
+				continue
+			}
+			deleted, err := as.roleCollection.DeleteOne(sc, bson.M{"_id": role.Id})
+			if err != nil {
+				return err
+			}
+			rs.Pruned += deleted.DeletedCount
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
-	return as.roleCollection.InsertOne(context.TODO(), role)
+	return &rs, nil
 }
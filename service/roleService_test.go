@@ -0,0 +1,276 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"main/model"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+func stringPtr(s string) *string { return &s }
+
+func TestUpdateRoleDefaultRole(t *testing.T) {
+	t.Setenv("DEFAULT_ROLE", "member")
+	mt := mtest.New(t, mockDB)
+	defer mt.Close()
+
+	id := primitive.NewObjectID()
+	tests := []struct {
+		name    string
+		current string
+		req     model.RoleUpdateRequest
+		replies []bson.D
+		wantErr error
+	}{
+		{"renaming the default role", "member", model.RoleUpdateRequest{Name: stringPtr("members")}, []bson.D{
+			cursorReply(t, "role", model.Role{Id: id, Name: "member"}),
+			mtest.CreateSuccessResponse(), // abortTransaction
+		}, ErrDefaultRole},
+		{"renaming another role", "editor", model.RoleUpdateRequest{Name: stringPtr("author")}, []bson.D{
+			cursorReply(t, "role", model.Role{Id: id, Name: "editor"}),
+			findAndModifyReply(t, model.Role{Id: id, Name: "author"}),
+			writeReply(2),
+			mtest.CreateSuccessResponse(), // commitTransaction
+		}, nil},
+		{"keeping the default role's name", "member", model.RoleUpdateRequest{Name: stringPtr("member")}, []bson.D{
+			findAndModifyReply(t, model.Role{Id: id, Name: "member"}),
+			writeReply(2),
+			mtest.CreateSuccessResponse(),
+		}, nil},
+		{"new permissions for the default role", "member", model.RoleUpdateRequest{Permissions: &[]string{"read:forms"}}, []bson.D{
+			findAndModifyReply(t, model.Role{Id: id, Name: "member", Permissions: []string{"read:forms"}}),
+			writeReply(2),
+			mtest.CreateSuccessResponse(),
+		}, nil},
+	}
+	for _, tt := range tests {
+		mt.Run(tt.name, func(mt *mtest.T) {
+			t := mt.T
+			useMock(mt)
+			mt.AddMockResponses(tt.replies...)
+			role, err := NewRoleService().UpdateRole(context.Background(), id.Hex(), &tt.req)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantErr != nil {
+				if updates := sentStatements(mt, "findAndModify", "role"); len(updates) > 0 {
+					t.Errorf("role updated anyway")
+				}
+				return
+			}
+			if role.Id != id {
+				t.Errorf("got role %+v", role)
+			}
+		})
+	}
+}
+
+func TestDeleteRoleDefaultRole(t *testing.T) {
+	t.Setenv("DEFAULT_ROLE", "member")
+	mt := mtest.New(t, mockDB)
+	defer mt.Close()
+
+	id := primitive.NewObjectID()
+	tests := []struct {
+		name    string
+		replies []bson.D
+		wantErr error
+	}{
+		{"default role", []bson.D{cursorReply(t, "role", model.Role{Id: id, Name: "member"})}, ErrDefaultRole},
+		{"role in use", []bson.D{cursorReply(t, "role", model.Role{Id: id, Name: "editor"}), countReply(t, "account", 1)}, ErrRoleInUse},
+		{"unused role", []bson.D{cursorReply(t, "role", model.Role{Id: id, Name: "editor"}), countReply(t, "account", 0), writeReply(1)}, nil},
+	}
+	for _, tt := range tests {
+		mt.Run(tt.name, func(mt *mtest.T) {
+			t := mt.T
+			useMock(mt)
+			mt.AddMockResponses(tt.replies...)
+			err := NewRoleService().DeleteRole(context.Background(), id.Hex())
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got %v, want %v", err, tt.wantErr)
+			}
+			deletes := sentStatements(mt, "delete", "role")
+			if (tt.wantErr == nil) != (len(deletes) == 1) {
+				t.Errorf("%d role deletes", len(deletes))
+			}
+		})
+	}
+}
+
+func TestSyncRolesPruneDefaultRole(t *testing.T) {
+	mt := mtest.New(t, mockDB)
+	defer mt.Close()
+
+	tests := []struct {
+		name    string
+		deny    string
+		catalog model.RoleCatalog
+		wantErr error
+	}{
+		{"catalog without the default role", "", model.RoleCatalog{Roles: []model.Role{{Name: "editor"}}}, ErrDefaultRole},
+		{"deny by default has no default role", "true", model.RoleCatalog{Roles: []model.Role{{Name: "editor"}}}, nil},
+		{"catalog with the default role", "", model.RoleCatalog{Roles: []model.Role{{Name: "member"}}}, nil},
+	}
+	for _, tt := range tests {
+		mt.Run(tt.name, func(mt *mtest.T) {
+			t := mt.T
+			t.Setenv("DEFAULT_ROLE", "member")
+			t.Setenv("DENY_BY_DEFAULT", tt.deny)
+			useMock(mt)
+			mt.AddMockResponses(writeReply(1), writeReply(0), cursorReply(t, "role"), mtest.CreateSuccessResponse())
+			_, err := NewRoleService().SyncRoles(context.Background(), &tt.catalog, true)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantErr != nil && len(mt.GetAllStartedEvents()) > 0 {
+				t.Error("the database was touched")
+			}
+		})
+	}
+}
+
+func TestLoadRoleCatalog(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string // none when empty, the file doesn't exist
+		wantErr string
+	}{
+		{"valid", `{"permissions":["read:forms","update:forms"],"roles":[{"name":"user","permissions":["read:forms"]},{"name":"editor","permissions":["read:forms","update:forms"]}]}`, ""},
+		{"missing file", "", "no such file"},
+		{"not JSON", `roles: [user]`, "invalid character"},
+		{"role without a name", `{"roles":[{"permissions":[]}]}`, "role without a name"},
+		{"role defined twice", `{"roles":[{"name":"user"},{"name":"user"}]}`, `role "user" is defined twice`},
+		{"undefined permission", `{"permissions":["read:forms"],"roles":[{"name":"user","permissions":["delete:forms"]}]}`,
+			`role "user" uses undefined permission "delete:forms"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "roles.json")
+			if tt.content != "" {
+				if err := os.WriteFile(path, []byte(tt.content), 0o600); err != nil {
+					t.Fatal(err)
+				}
+			}
+			catalog, err := LoadRoleCatalog(path)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err %v, want %q", err, tt.wantErr)
+				}
+				if tt.content != "" && !strings.Contains(err.Error(), path) {
+					t.Errorf("err %v doesn't name the file", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(catalog.Roles) != 2 || catalog.Roles[1].Name != "editor" || len(catalog.Roles[1].Permissions) != 2 {
+				t.Errorf("loaded %+v", catalog)
+			}
+		})
+	}
+}
+
+func TestSyncRoles(t *testing.T) {
+	t.Setenv("DEFAULT_ROLE", "user")
+	mt := mtest.New(t, mockDB)
+	defer mt.Close()
+
+	catalog := &model.RoleCatalog{
+		Permissions: []string{model.PermissionReadForms, model.PermissionUpdateForms},
+		Roles: []model.Role{
+			{Name: "user", Permissions: []string{model.PermissionReadForms}},
+			{Name: "editor", Permissions: []string{model.PermissionReadForms, model.PermissionUpdateForms}},
+			{Name: "viewer"},
+		},
+	}
+	unchanged := mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}, bson.E{Key: "nModified", Value: 0})
+	unused, inUse := model.Role{Id: primitive.NewObjectID(), Name: "old"}, model.Role{Id: primitive.NewObjectID(), Name: "legacy"}
+
+	tests := []struct {
+		name    string
+		prune   bool
+		replies []bson.D
+		want    model.RoleSyncResult
+	}{
+		{"upserts and copies changed permissions", false, []bson.D{
+			writeReply(1), writeReply(3), // user changed, copied to its accounts
+			upsertReply(t, primitive.NewObjectID()), // editor is new
+			unchanged,                               // viewer
+		}, model.RoleSyncResult{Upserted: 1, Modified: 1, Kept: []string{}}},
+		{"prunes unused roles only", true, []bson.D{
+			unchanged, unchanged, unchanged,
+			cursorReply(t, "role", unused, inUse),
+			countReply(t, "account", 0), writeReply(1),
+			countReply(t, "account", 2),
+		}, model.RoleSyncResult{Pruned: 1, Kept: []string{"legacy"}}},
+	}
+	for _, tt := range tests {
+		mt.Run(tt.name, func(mt *mtest.T) {
+			t := mt.T
+			useMock(mt)
+			mt.AddMockResponses(tt.replies...)
+			mt.AddMockResponses(mtest.CreateSuccessResponse()) // commitTransaction
+
+			rs, err := NewRoleService().SyncRoles(context.Background(), catalog, tt.prune)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(*rs, tt.want) {
+				t.Errorf("got %+v, want %+v", *rs, tt.want)
+			}
+
+			upserts := sentStatements(mt, "update", "role")
+			if len(upserts) != len(catalog.Roles) {
+				t.Fatalf("%d role upserts, want %d", len(upserts), len(catalog.Roles))
+			}
+			for i, role := range catalog.Roles {
+				set, _ := asMap(t, upserts[i].Update)["$set"].(bson.M)
+				got, _ := set["permissions"].(bson.A)
+				if asMap(t, upserts[i].Filter)["name"] != role.Name || got == nil || len(got) != len(role.Permissions) {
+					t.Errorf("upsert %d: %v %v, want %s with %v", i, asMap(t, upserts[i].Filter), set, role.Name, role.Permissions)
+				}
+			}
+
+			// only the roles whose permissions changed are copied to the accounts
+			copies := sentStatements(mt, "update", "account")
+			if wantCopies := tt.want.Modified; int64(len(copies)) != wantCopies {
+				t.Fatalf("%d account updates, want %d", len(copies), wantCopies)
+			}
+			if len(copies) == 1 {
+				set, _ := asMap(t, copies[0].Update)["$set"].(bson.M)
+				if asMap(t, copies[0].Filter)["roles.name"] != "user" || set["roles.$[role].permissions"] == nil {
+					t.Errorf("copied %v %v, want user's permissions", asMap(t, copies[0].Filter), set)
+				}
+			}
+
+			deletes := sentStatements(mt, "delete", "role")
+			if !tt.prune {
+				if len(deletes) > 0 {
+					t.Errorf("deleted %v without prune", deletes)
+				}
+				return
+			}
+			for _, e := range mt.GetAllStartedEvents() {
+				if e.CommandName != "find" {
+					continue
+				}
+				if nin, _ := e.Command.Lookup("filter", "name", "$nin").Array().Values(); len(nin) != len(catalog.Roles) {
+					t.Errorf("stale roles looked up with %v", e.Command.Lookup("filter"))
+				}
+			}
+			if len(deletes) != 1 || asMap(t, deletes[0].Filter)["_id"] != unused.Id {
+				t.Errorf("deleted %v, want only %s", deletes, unused.Name)
+			}
+		})
+	}
+}
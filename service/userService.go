@@ -2,28 +2,54 @@ package service
 
 import (
 	"context"
+	"errors"
 	"main/db"
 	"main/db/builder"
 	"main/model"
+	"time"
 
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
+var (
+	ErrMergeSameUser  = errors.New("cannot merge a user into itself")
+	ErrUserNotFound   = errors.New("user not found")
+	ErrDuplicateEmail = errors.New("email is already used by another user")
+	ErrRoleNotFound   = errors.New("role not found")
+	ErrNoAccount      = errors.New("user has no account")
+	ErrProfileExists  = errors.New("account already has a user profile")
+)
+
+// compares strings ignoring case, for data stored before it was normalized
+var caseInsensitive = &options.Collation{Locale: "en", Strength: 2}
+
 type UserService struct {
-	userCollection    *mongo.Collection
-	accountCollection *mongo.Collection
+	userCollection         *mongo.Collection
+	accountCollection      *mongo.Collection
+	projectCollection      *mongo.Collection
+	refreshTokenCollection *mongo.Collection
+	responseCollection     *mongo.Collection
+	roleService            *RoleService
 }
 
 func NewUserService() *UserService {
 	return &UserService{
-		userCollection:    db.MongoDatabase.Collection("user"),
-		accountCollection: db.MongoDatabase.Collection("account"),
+		userCollection:         db.MongoDatabase.Collection("user"),
+		accountCollection:      db.MongoDatabase.Collection("account"),
+		projectCollection:      db.MongoDatabase.Collection("project"),
+		refreshTokenCollection: db.MongoDatabase.Collection("refreshToken"),
+		responseCollection:     db.MongoDatabase.Collection("formResponse"),
+		roleService:            NewRoleService(),
 	}
 }
 
-func (us *UserService) GetUserByID(uid string, isAccountId bool) (*model.UserResponse, error) {
+func (us *UserService) GetUserByID(ctx context.Context, uid string, isAccountId bool) (*model.UserResponse, error) {
+	ctx, cancel := db.WithTimeout(ctx)
+	defer cancel()
+
 	var user model.UserResponse
 	var aggSearch bson.M
 
@@ -41,43 +67,442 @@ func (us *UserService) GetUserByID(uid string, isAccountId bool) (*model.UserRes
 	aggLookup := builder.Lookup("account", "accountId", "_id", "account")
 
 	// to remove the array of account field
-	aggUnwind := builder.Unwind("account")
+	aggUnwind := builder.Unwind("account", false)
 
-	cursor, err := us.userCollection.Aggregate(context.TODO(), []bson.M{aggSearch, aggLookup, aggUnwind})
+	cursor, err := us.userCollection.Aggregate(ctx, []bson.M{aggSearch, aggLookup, aggUnwind})
 
 	if err != nil {
 		return nil, err
 	}
 
-	if cursor.Next(context.TODO()) {
+	if cursor.Next(ctx) {
 		err := cursor.Decode(&user)
 		if err != nil {
 			return nil, err
 		}
+		user.FillCompleteness()
 		return &user, nil
 	}
 
 	return nil, mongo.ErrNoDocuments
 }
 
-func (us *UserService) NewUser(reqUser *model.UserRequest, accountId primitive.ObjectID) (*mongo.InsertOneResult, error) {
+// Fetches many users in one query, a bad or unknown id only fails that id. Ids given twice are fetched once.
+func (us *UserService) GetUsersByIDs(ctx context.Context, uids []string) (*model.UserBatchResponse, error) {
+	ctx, cancel := db.WithTimeout(ctx)
+	defer cancel()
+
+	rs := &model.UserBatchResponse{
+		Users:  map[string]model.UserResponse{},
+		Errors: map[string]string{},
+	}
+
+	ids := make([]primitive.ObjectID, 0, len(uids))
+	seen := map[primitive.ObjectID]bool{}
+	for _, uid := range uids {
+		id, err := primitive.ObjectIDFromHex(uid)
+		if err != nil {
+			rs.Errors[uid] = err.Error()
+			continue
+		}
+		if !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) == 0 {
+		return rs, nil
+	}
+
+	aggSearch := builder.SearchByIds("_id", ids)
+	aggLookup := builder.Lookup("account", "accountId", "_id", "account")
+	// users without an account are still found
+	aggUnwind := builder.Unwind("account", true)
+
+	var users []model.UserResponse
+	cursor, err := us.userCollection.Aggregate(ctx, []bson.M{aggSearch, aggLookup, aggUnwind})
+	if err != nil {
+		return nil, err
+	}
+	if err = cursor.All(ctx, &users); err != nil {
+		return nil, err
+	}
+
+	for _, user := range users {
+		user.FillCompleteness()
+		rs.Users[user.ID.Hex()] = user
+	}
+	for _, id := range ids {
+		if _, ok := rs.Users[id.Hex()]; !ok {
+			rs.Errors[id.Hex()] = mongo.ErrNoDocuments.Error()
+		}
+	}
+	return rs, nil
+}
+
+func (us *UserService) GetUsers(ctx context.Context, page int, limit int) (*model.PagedResponse[model.UserResponse], error) {
+	ctx, cancel := db.WithTimeout(ctx)
+	defer cancel()
+
+	// only for the users of the page, users without an account are listed too
+	aggLookup := builder.Lookup("account", "accountId", "_id", "account")
+	aggUnwind := builder.Unwind("account", true)
+
+	users, total, err := builder.AggregatePaged[model.UserResponse](ctx, us.userCollection, []bson.M{}, page, limit, aggLookup, aggUnwind)
+	if err != nil {
+		return nil, err
+	}
+	for i := range users {
+		users[i].FillCompleteness()
+	}
+	return model.NewPagedResponse(users, page, limit, total), nil
+}
+
+/*
+* GetUsersCursor
+* Same listing as GetUsers with keyset pagination on _id: pass the NextCursor of a page to get the
+* one after it, the PrevCursor with backward for the one before. An empty cursor starts at the first
+* page, or the last one when backward.
+ */
+func (us *UserService) GetUsersCursor(ctx context.Context, cursor string, backward bool, limit int) (*builder.CursorListResult[model.UserResponse], error) {
+	ctx, cancel := db.WithTimeout(ctx)
+	defer cancel()
+
+	users, err := builder.ListCursor[model.UserResponse](ctx, us.userCollection, builder.CursorListOptions{
+		Limit:      limit,
+		Cursor:     cursor,
+		Backward:   backward,
+		PageStages: []bson.M{builder.Lookup("account", "accountId", "_id", "account"), builder.Unwind("account", true)},
+	})
+	if err != nil {
+		return nil, err
+	}
+	for i := range users.Data {
+		users.Data[i].FillCompleteness()
+	}
+	return users, nil
+}
+
+// Full-text search, needs a text index over fullName and email (builder.EnsureTextIndex)
+func (us *UserService) SearchUsers(ctx context.Context, query string, page int, limit int) (*model.PagedResponse[model.User], error) {
+	ctx, cancel := db.WithTimeout(ctx)
+	defer cancel()
+
+	users, total, err := builder.TextSearch[model.User](ctx, us.userCollection, query, page, limit)
+	if err != nil {
+		return nil, err
+	}
+	return model.NewPagedResponse(users, page, limit, total), nil
+}
+
+// Account of the user with that email, ErrUserNotFound when there's none (or it has no account)
+func (us *UserService) GetAccountIdByEmail(ctx context.Context, email string) (primitive.ObjectID, error) {
+	ctx, cancel := db.WithTimeout(ctx)
+	defer cancel()
+
+	email = model.NormalizeEmail(email)
+	user, err := builder.GetByFieldProjected[model.User](ctx, us.userCollection, "email", email, map[string]int{"accountId": 1})
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		// emails stored before normalization may still have upper case letters, only those
+		// need the slower lookup as the collation can't use the email index
+		var legacy model.User
+		err = us.userCollection.FindOne(ctx, bson.M{"email": email},
+			options.FindOne().SetCollation(caseInsensitive).SetProjection(bson.M{"accountId": 1})).Decode(&legacy)
+		user = &legacy
+	}
+	if errors.Is(err, mongo.ErrNoDocuments) || (err == nil && user.AccountId.IsZero()) {
+		return primitive.NilObjectID, ErrUserNotFound
+	}
+	if err != nil {
+		return primitive.NilObjectID, err
+	}
+	return user.AccountId, nil
+}
+
+func (us *UserService) NewUser(ctx context.Context, reqUser *model.UserRequest, accountId primitive.ObjectID) (*mongo.InsertOneResult, error) {
+	ctx, cancel := db.WithTimeout(ctx)
+	defer cancel()
+
 	newusr := model.User{
 		AccountId: accountId,
 		Fullname:  reqUser.Fullname,
 		DOB:       reqUser.DOB,
-		Email:     reqUser.Email,
+		Email:     model.NormalizeEmail(reqUser.Email),
 		Phone:     reqUser.Phone,
 		Address:   reqUser.Address,
 		Avatar:    reqUser.Avatar,
 		Status:    reqUser.Status,
 	}
-	rs, err := us.userCollection.InsertOne(context.TODO(), newusr)
+	// one profile per account, the account only points at one of them
+	if !accountId.IsZero() {
+		exists, err := us.userCollection.CountDocuments(ctx, bson.M{"accountId": accountId}, options.Count().SetLimit(1))
+		if err != nil {
+			return nil, err
+		}
+		if exists > 0 {
+			return nil, ErrProfileExists
+		}
+	}
+	// the unique index only catches exact matches, emails from before normalization may differ in case
+	if newusr.Email != "" {
+		taken, err := us.userCollection.CountDocuments(ctx, bson.M{"email": newusr.Email},
+			options.Count().SetCollation(caseInsensitive).SetLimit(1))
+		if err != nil {
+			return nil, err
+		}
+		if taken > 0 {
+			return nil, ErrDuplicateEmail
+		}
+	}
+	rs, err := us.userCollection.InsertOne(ctx, newusr)
+	if mongo.IsDuplicateKeyError(err) {
+		return nil, ErrDuplicateEmail
+	}
+	if err != nil {
+		return nil, err
+	}
 
-	accErr := us.accountCollection.FindOneAndUpdate(context.TODO(), bson.M{"_id": accountId}, bson.M{"$set": bson.M{"userId": rs.InsertedID}}).Err()
+	accErr := us.accountCollection.FindOneAndUpdate(ctx, bson.M{"_id": accountId}, bson.M{"$set": bson.M{"userId": rs.InsertedID}}).Err()
 
 	if accErr != nil {
 		return nil, accErr
 	}
 
-	return rs, err
+	return rs, nil
+}
+
+// Gives the role to the user's account, a no-op when it already has it
+func (us *UserService) AddRole(ctx context.Context, uid string, roleName string) (*model.AccountResponse, error) {
+	ctx, cancel := db.WithTimeout(ctx)
+	defer cancel()
+
+	role, err := us.roleService.GetRoleByName(ctx, roleName)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, ErrRoleNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	accountId, err := us.accountIdOf(ctx, uid)
+	if err != nil {
+		return nil, err
+	}
+	// $push fails on a null array, accounts registered without any role have one
+	if _, err := us.accountCollection.UpdateOne(ctx, bson.M{"_id": accountId, "roles": nil},
+		bson.M{"$set": bson.M{"roles": []model.Role{}}}); err != nil {
+		return nil, err
+	}
+	// matched by name, $addToSet would add a second copy if the stored one has other permissions
+	if _, err := us.accountCollection.UpdateOne(ctx, bson.M{"_id": accountId, "roles.name": bson.M{"$ne": role.Name}},
+		bson.M{"$push": bson.M{"roles": role}, "$set": bson.M{"updatedAt": time.Now()}}); err != nil {
+		return nil, err
+	}
+	return builder.GetById[model.AccountResponse](ctx, us.accountCollection, accountId.Hex())
+}
+
+// Takes the role away from the user's account, a no-op when it doesn't have it
+func (us *UserService) RemoveRole(ctx context.Context, uid string, roleName string) (*model.AccountResponse, error) {
+	ctx, cancel := db.WithTimeout(ctx)
+	defer cancel()
+
+	accountId, err := us.accountIdOf(ctx, uid)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := us.accountCollection.UpdateOne(ctx, bson.M{"_id": accountId, "roles.name": roleName},
+		bson.M{"$pull": bson.M{"roles": bson.M{"name": roleName}}, "$set": bson.M{"updatedAt": time.Now()}}); err != nil {
+		return nil, err
+	}
+	return builder.GetById[model.AccountResponse](ctx, us.accountCollection, accountId.Hex())
+}
+
+func (us *UserService) accountIdOf(ctx context.Context, uid string) (primitive.ObjectID, error) {
+	user, err := builder.GetByIdProjected[model.User](ctx, us.userCollection, uid, map[string]int{"accountId": 1})
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return primitive.NilObjectID, ErrUserNotFound
+	}
+	if err != nil {
+		return primitive.NilObjectID, err
+	}
+	if user.AccountId.IsZero() {
+		return primitive.NilObjectID, ErrNoAccount
+	}
+	return user.AccountId, nil
+}
+
+// Deletes the user with everything hanging off it (see deleteCascade), in one transaction
+func (us *UserService) DeleteUser(ctx context.Context, uid string) error {
+	ctx, cancel := db.WithTimeout(ctx)
+	defer cancel()
+
+	id, err := primitive.ObjectIDFromHex(uid)
+	if err != nil {
+		return err
+	}
+
+	return db.WithTransaction(ctx, func(sc mongo.SessionContext) error {
+		var user model.User
+		if err := us.userCollection.FindOne(sc, bson.M{"_id": id}).Decode(&user); err != nil {
+			return err
+		}
+		return us.deleteCascade(sc, user.AccountId, id)
+	})
+}
+
+// Self-service version of DeleteUser, starting from the logged in account which may have no user yet
+func (us *UserService) DeleteAccount(ctx context.Context, accountId string) error {
+	ctx, cancel := db.WithTimeout(ctx)
+	defer cancel()
+
+	id, err := primitive.ObjectIDFromHex(accountId)
+	if err != nil {
+		return err
+	}
+
+	return db.WithTransaction(ctx, func(sc mongo.SessionContext) error {
+		var user model.User
+		err := us.userCollection.FindOne(sc, bson.M{"accountId": id}).Decode(&user)
+		if err != nil && !errors.Is(err, mongo.ErrNoDocuments) {
+			return err
+		}
+		return us.deleteCascade(sc, id, user.ID)
+	})
+}
+
+/*
+* deleteCascade
+* Deletes the account (and its refresh tokens) and the user, takes the user out of the projects
+* it joined and flags the ones it created as orphaned, they're kept for the other participants.
+* Its form responses are kept anonymously.
+* Either id may be zero when that side doesn't exist. Must run inside a transaction.
+ */
+func (us *UserService) deleteCascade(sc mongo.SessionContext, accountId primitive.ObjectID, userId primitive.ObjectID) error {
+	if !accountId.IsZero() {
+		rs, err := us.accountCollection.DeleteOne(sc, bson.M{"_id": accountId})
+		if err != nil {
+			return err
+		}
+		// nothing to delete at all
+		if rs.DeletedCount == 0 && userId.IsZero() {
+			return mongo.ErrNoDocuments
+		}
+		if _, err := us.refreshTokenCollection.DeleteMany(sc, bson.M{"accountId": accountId}); err != nil {
+			return err
+		}
+	}
+	if userId.IsZero() {
+		return nil
+	}
+
+	if _, err := us.userCollection.DeleteOne(sc, bson.M{"_id": userId}); err != nil {
+		return err
+	}
+	if _, err := us.projectCollection.UpdateMany(sc,
+		bson.M{"participants": userId}, bson.M{"$pull": bson.M{"participants": userId}}); err != nil {
+		return err
+	}
+	if _, err := builder.UpdateMany(sc, us.projectCollection,
+		bson.M{"createBy": userId}, bson.M{"orphaned": true}); err != nil {
+		return err
+	}
+	// answers still count for the form, they just become anonymous
+	_, err := us.responseCollection.UpdateMany(sc,
+		bson.M{"respondentId": userId}, bson.M{"$unset": bson.M{"respondentId": ""}})
+	return err
+}
+
+/*
+* MergeUsers
+* Re-points everything referencing the secondary user (created and joined projects, form responses)
+* to the primary one, then deletes the secondary user. All in one transaction.
+* On conflicts the primary wins: its email/username are kept and only its blank fields
+* are filled from the secondary user. A primary without an account takes over the secondary's one,
+* otherwise the secondary account is deleted. Either way every token of the secondary account stops working.
+ */
+func (us *UserService) MergeUsers(ctx context.Context, primaryId string, secondaryId string) error {
+	ctx, cancel := db.WithTimeout(ctx)
+	defer cancel()
+
+	primaryObjId, err := primitive.ObjectIDFromHex(primaryId)
+	if err != nil {
+		return err
+	}
+	secondaryObjId, err := primitive.ObjectIDFromHex(secondaryId)
+	if err != nil {
+		return err
+	}
+	if primaryObjId == secondaryObjId {
+		return ErrMergeSameUser
+	}
+
+	return db.WithTransaction(ctx, func(sc mongo.SessionContext) error {
+		var primary, secondary model.User
+		if err := us.userCollection.FindOne(sc, bson.M{"_id": primaryObjId}).Decode(&primary); err != nil {
+			return err
+		}
+		if err := us.userCollection.FindOne(sc, bson.M{"_id": secondaryObjId}).Decode(&secondary); err != nil {
+			return err
+		}
+		// first, the secondary's email would collide with itself on the unique index once copied over
+		if _, err := us.userCollection.DeleteOne(sc, bson.M{"_id": secondaryObjId}); err != nil {
+			return err
+		}
+
+		fill := bson.M{}
+		for field, values := range map[string][2]string{
+			"fullName": {primary.Fullname, secondary.Fullname},
+			"dob":      {primary.DOB, secondary.DOB},
+			"email":    {primary.Email, model.NormalizeEmail(secondary.Email)},
+			"phone":    {primary.Phone, secondary.Phone},
+			"address":  {primary.Address, secondary.Address},
+			"avatar":   {primary.Avatar, secondary.Avatar},
+		} {
+			if values[0] == "" && values[1] != "" {
+				fill[field] = values[1]
+			}
+		}
+		takeAccount := primary.AccountId.IsZero() && !secondary.AccountId.IsZero()
+		if takeAccount {
+			fill["accountId"] = secondary.AccountId
+		}
+		if len(fill) > 0 {
+			if _, err := us.userCollection.UpdateByID(sc, primaryObjId, bson.M{"$set": fill}); err != nil {
+				return err
+			}
+		}
+
+		if _, err := builder.UpdateMany(sc, us.projectCollection,
+			bson.M{"createBy": secondaryObjId}, bson.M{"createBy": primaryObjId}); err != nil {
+			return err
+		}
+		// $addToSet and $pull can't touch the same field in one update
+		if _, err := us.projectCollection.UpdateMany(sc,
+			bson.M{"participants": secondaryObjId}, bson.M{"$addToSet": bson.M{"participants": primaryObjId}}); err != nil {
+			return err
+		}
+		if _, err := us.projectCollection.UpdateMany(sc,
+			bson.M{"participants": secondaryObjId}, bson.M{"$pull": bson.M{"participants": secondaryObjId}}); err != nil {
+			return err
+		}
+		if _, err := builder.UpdateMany(sc, us.responseCollection,
+			bson.M{"respondentId": secondaryObjId}, bson.M{"respondentId": primaryObjId}); err != nil {
+			return err
+		}
+
+		if secondary.AccountId.IsZero() {
+			return nil
+		}
+		if _, err := us.refreshTokenCollection.DeleteMany(sc, bson.M{"accountId": secondary.AccountId}); err != nil {
+			return err
+		}
+		if takeAccount {
+			// access tokens issued before now are rejected by VerifyToken
+			_, err := us.accountCollection.UpdateByID(sc, secondary.AccountId,
+				bson.M{"$set": bson.M{"userId": primaryObjId, "passwordChangedAt": time.Now()}})
+			return err
+		}
+		// a deleted account fails VerifyToken on its own
+		_, err := us.accountCollection.DeleteOne(sc, bson.M{"_id": secondary.AccountId})
+		return err
+	})
 }
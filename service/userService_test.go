@@ -0,0 +1,350 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"main/model"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+func TestMergeUsers(t *testing.T) {
+	mt := mtest.New(t, mockDB)
+	defer mt.Close()
+
+	primaryAccount, secondaryAccount := primitive.NewObjectID(), primitive.NewObjectID()
+	tests := []struct {
+		name      string
+		primary   model.User
+		secondary model.User
+		wantFill  bson.M // nil when nothing is filled
+		// what happens to the secondary account: "delete", "take over" or "" without one
+		wantAccount string
+	}{
+		{"fills blank fields and deletes the secondary account",
+			model.User{Fullname: "Alice", Phone: "111", AccountId: primaryAccount},
+			model.User{Fullname: "Alice B", Email: " ALICE@Example.com", Phone: "222", Avatar: "a.png", AccountId: secondaryAccount},
+			bson.M{"email": "alice@example.com", "avatar": "a.png"}, "delete"},
+		{"takes over the secondary account",
+			model.User{Fullname: "Alice"},
+			model.User{Fullname: "Alice B", AccountId: secondaryAccount},
+			bson.M{"accountId": secondaryAccount}, "take over"},
+		{"secondary without an account",
+			model.User{Fullname: "Alice", AccountId: primaryAccount},
+			model.User{},
+			nil, ""},
+	}
+	for _, tt := range tests {
+		mt.Run(tt.name, func(mt *mtest.T) {
+			t := mt.T
+			useMock(mt)
+			tt.primary.ID, tt.secondary.ID = primitive.NewObjectID(), primitive.NewObjectID()
+			primaryId, secondaryId := tt.primary.ID, tt.secondary.ID
+
+			mt.AddMockResponses(cursorReply(t, "user", tt.primary), cursorReply(t, "user", tt.secondary), writeReply(1))
+			if tt.wantFill != nil {
+				mt.AddMockResponses(writeReply(1))
+			}
+			mt.AddMockResponses(writeReply(1), writeReply(1), writeReply(1), writeReply(2))
+			if tt.wantAccount != "" {
+				mt.AddMockResponses(writeReply(3), writeReply(1))
+			}
+			mt.AddMockResponses(mtest.CreateSuccessResponse()) // commitTransaction
+
+			if err := NewUserService().MergeUsers(context.Background(), primaryId.Hex(), secondaryId.Hex()); err != nil {
+				t.Fatal(err)
+			}
+
+			// the secondary goes first, its email would collide with the copy on the primary
+			if deletes := sentStatements(mt, "delete", "user"); len(deletes) != 1 || asMap(t, deletes[0].Filter)["_id"] != secondaryId {
+				t.Errorf("user deletes %v", deletes)
+			}
+			fills := sentStatements(mt, "update", "user")
+			switch {
+			case tt.wantFill == nil && len(fills) > 0:
+				t.Errorf("primary updated with %v", fills[0].Update)
+			case tt.wantFill != nil:
+				if len(fills) != 1 || asMap(t, fills[0].Filter)["_id"] != primaryId {
+					t.Fatalf("primary updates %v", fills)
+				}
+				if set := asMap(t, fills[0].Update)["$set"]; !equalM(set.(bson.M), tt.wantFill) {
+					t.Errorf("filled %v, want %v", set, tt.wantFill)
+				}
+			}
+
+			projects := sentStatements(mt, "update", "project")
+			wantProjects := []struct{ filter, op, field string }{
+				{"createBy", "$set", "createBy"},
+				{"participants", "$addToSet", "participants"},
+				{"participants", "$pull", "participants"},
+			}
+			if len(projects) != len(wantProjects) {
+				t.Fatalf("%d project updates, want %d", len(projects), len(wantProjects))
+			}
+			for i, want := range wantProjects {
+				if asMap(t, projects[i].Filter)[want.filter] != secondaryId {
+					t.Errorf("project update %d filters on %v", i, projects[i].Filter)
+				}
+				wantId := primaryId
+				if want.op == "$pull" {
+					wantId = secondaryId
+				}
+				if got := asMap(t, projects[i].Update)[want.op].(bson.M)[want.field]; got != wantId {
+					t.Errorf("project update %d: %s %v, want %s", i, want.op, got, wantId.Hex())
+				}
+			}
+			responses := sentStatements(mt, "update", "formResponse")
+			if len(responses) != 1 || asMap(t, responses[0].Filter)["respondentId"] != secondaryId ||
+				asMap(t, responses[0].Update)["$set"].(bson.M)["respondentId"] != primaryId {
+				t.Errorf("response updates %v", responses)
+			}
+
+			tokens := sentStatements(mt, "delete", "refreshToken")
+			accountUpdates, accountDeletes := sentStatements(mt, "update", "account"), sentStatements(mt, "delete", "account")
+			switch tt.wantAccount {
+			case "":
+				if len(tokens)+len(accountUpdates)+len(accountDeletes) > 0 {
+					t.Error("accounts touched without a secondary account")
+				}
+			case "delete":
+				if len(accountUpdates) > 0 || len(accountDeletes) != 1 || asMap(t, accountDeletes[0].Filter)["_id"] != secondaryAccount {
+					t.Errorf("account updates %v, deletes %v", accountUpdates, accountDeletes)
+				}
+			case "take over":
+				if len(accountDeletes) > 0 || len(accountUpdates) != 1 || asMap(t, accountUpdates[0].Filter)["_id"] != secondaryAccount {
+					t.Fatalf("account updates %v, deletes %v", accountUpdates, accountDeletes)
+				}
+				set := asMap(t, accountUpdates[0].Update)["$set"].(bson.M)
+				if set["userId"] != primaryId || set["passwordChangedAt"] == nil {
+					t.Errorf("account set %v, want userId %s and passwordChangedAt", set, primaryId.Hex())
+				}
+			}
+			if tt.wantAccount != "" && (len(tokens) != 1 || asMap(t, tokens[0].Filter)["accountId"] != secondaryAccount) {
+				t.Errorf("refresh token deletes %v", tokens)
+			}
+		})
+	}
+}
+
+func TestMergeUsersInvalid(t *testing.T) {
+	mt := mtest.New(t, mockDB)
+	defer mt.Close()
+
+	id := primitive.NewObjectID().Hex()
+	tests := []struct {
+		name               string
+		primary, secondary string
+		wantErr            error
+	}{
+		{"same user", id, id, ErrMergeSameUser},
+		{"bad primary id", "nope", id, primitive.ErrInvalidHex},
+		{"bad secondary id", id, "nope", primitive.ErrInvalidHex},
+	}
+	for _, tt := range tests {
+		mt.Run(tt.name, func(mt *mtest.T) {
+			t := mt.T
+			useMock(mt)
+			err := NewUserService().MergeUsers(context.Background(), tt.primary, tt.secondary)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("got %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// same keys and values, compared with ==
+func equalM(got bson.M, want bson.M) bool {
+	if len(got) != len(want) {
+		return false
+	}
+	for k, v := range want {
+		if got[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+func TestDeleteCascade(t *testing.T) {
+	mt := mtest.New(t, mockDB)
+	defer mt.Close()
+
+	accountId, userId := primitive.NewObjectID(), primitive.NewObjectID()
+	deleteUser := func(us *UserService) error { return us.DeleteUser(context.Background(), userId.Hex()) }
+	deleteAccount := func(us *UserService) error { return us.DeleteAccount(context.Background(), accountId.Hex()) }
+	userWrites := []bson.D{writeReply(1), writeReply(2), writeReply(1), writeReply(3)}
+
+	tests := []struct {
+		name        string
+		delete      func(us *UserService) error
+		replies     []bson.D
+		wantErr     error
+		wantAccount bool
+		wantUser    bool
+	}{
+		{"user with an account", deleteUser, append([]bson.D{
+			cursorReply(t, "user", model.User{ID: userId, AccountId: accountId}), writeReply(1), writeReply(2),
+		}, userWrites...), nil, true, true},
+		{"user without an account", deleteUser, append([]bson.D{
+			cursorReply(t, "user", model.User{ID: userId}),
+		}, userWrites...), nil, false, true},
+		{"unknown user", deleteUser, []bson.D{cursorReply(t, "user")}, mongo.ErrNoDocuments, false, false},
+		{"own account with a user", deleteAccount, append([]bson.D{
+			cursorReply(t, "user", model.User{ID: userId, AccountId: accountId}), writeReply(1), writeReply(2),
+		}, userWrites...), nil, true, true},
+		{"own account without a user", deleteAccount, []bson.D{
+			cursorReply(t, "user"), writeReply(1), writeReply(2),
+		}, nil, true, false},
+		{"account already gone", deleteAccount, []bson.D{cursorReply(t, "user"), writeReply(0)}, mongo.ErrNoDocuments, true, false},
+	}
+	for _, tt := range tests {
+		mt.Run(tt.name, func(mt *mtest.T) {
+			t := mt.T
+			useMock(mt)
+			mt.AddMockResponses(tt.replies...)
+			mt.AddMockResponses(mtest.CreateSuccessResponse()) // commitTransaction or abortTransaction
+
+			if err := tt.delete(NewUserService()); !errors.Is(err, tt.wantErr) {
+				t.Fatalf("err %v, want %v", err, tt.wantErr)
+			}
+
+			accounts, tokens := sentStatements(mt, "delete", "account"), sentStatements(mt, "delete", "refreshToken")
+			if !tt.wantAccount {
+				if len(accounts)+len(tokens) > 0 {
+					t.Errorf("deleted accounts %v and tokens %v", accounts, tokens)
+				}
+			} else {
+				if len(accounts) != 1 || asMap(t, accounts[0].Filter)["_id"] != accountId {
+					t.Errorf("deleted accounts %v, want %s", accounts, accountId.Hex())
+				}
+				if tt.wantErr == nil && (len(tokens) != 1 || asMap(t, tokens[0].Filter)["accountId"] != accountId) {
+					t.Errorf("deleted refresh tokens %v, want the ones of %s", tokens, accountId.Hex())
+				}
+			}
+
+			users, projects, responses := sentStatements(mt, "delete", "user"), sentStatements(mt, "update", "project"), sentStatements(mt, "update", "formResponse")
+			if !tt.wantUser {
+				if len(users)+len(projects)+len(responses) > 0 {
+					t.Errorf("touched users %v, projects %v, responses %v", users, projects, responses)
+				}
+				return
+			}
+			if len(users) != 1 || asMap(t, users[0].Filter)["_id"] != userId {
+				t.Errorf("deleted users %v, want %s", users, userId.Hex())
+			}
+			if len(projects) != 2 {
+				t.Fatalf("%d project updates, want 2", len(projects))
+			}
+			// taken out of the joined projects, the created ones are kept but flagged
+			if asMap(t, projects[0].Filter)["participants"] != userId || asMap(t, projects[0].Update)["$pull"].(bson.M)["participants"] != userId {
+				t.Errorf("participant update %v %v", asMap(t, projects[0].Filter), asMap(t, projects[0].Update))
+			}
+			if asMap(t, projects[1].Filter)["createBy"] != userId || asMap(t, projects[1].Update)["$set"].(bson.M)["orphaned"] != true {
+				t.Errorf("orphan update %v %v", asMap(t, projects[1].Filter), asMap(t, projects[1].Update))
+			}
+			// responses stay, anonymously
+			if len(responses) != 1 || asMap(t, responses[0].Filter)["respondentId"] != userId {
+				t.Fatalf("response updates %v", responses)
+			}
+			if unset, _ := asMap(t, responses[0].Update)["$unset"].(bson.M); len(unset) != 1 || unset["respondentId"] == nil {
+				t.Errorf("response update %v, want respondentId unset", asMap(t, responses[0].Update))
+			}
+			if deletes := sentStatements(mt, "delete", "formResponse"); len(deletes) > 0 {
+				t.Errorf("responses deleted %v", deletes)
+			}
+		})
+	}
+}
+
+func TestAddRemoveRole(t *testing.T) {
+	mt := mtest.New(t, mockDB)
+	defer mt.Close()
+
+	accountId, userId := primitive.NewObjectID(), primitive.NewObjectID()
+	editor := model.Role{Id: primitive.NewObjectID(), Name: "editor", Permissions: []string{model.PermissionUpdateForms}}
+	user := cursorReply(t, "user", model.User{ID: userId, AccountId: accountId})
+	account := func(roles ...model.Role) bson.D {
+		return cursorReply(t, "account", model.Account{ID: accountId, Username: "alice", Roles: roles})
+	}
+	add := func(us *UserService) (*model.AccountResponse, error) {
+		return us.AddRole(context.Background(), userId.Hex(), "editor")
+	}
+	remove := func(us *UserService) (*model.AccountResponse, error) {
+		return us.RemoveRole(context.Background(), userId.Hex(), "editor")
+	}
+
+	tests := []struct {
+		name      string
+		op        func(us *UserService) (*model.AccountResponse, error)
+		replies   []bson.D
+		wantErr   error
+		wantOp    string // "$push" or "$pull" sent for editor, empty when the account isn't written
+		wantRoles int
+	}{
+		{"grant", add, []bson.D{cursorReply(t, "role", editor), user, writeReply(0), writeReply(1), account(editor)},
+			nil, "$push", 1},
+		{"grant a role held already", add, []bson.D{cursorReply(t, "role", editor), user, writeReply(0), writeReply(0), account(editor)},
+			nil, "$push", 1},
+		{"grant an unknown role", add, []bson.D{cursorReply(t, "role")}, ErrRoleNotFound, "", 0},
+		{"grant to a user without an account", add, []bson.D{cursorReply(t, "role", editor), cursorReply(t, "user", model.User{ID: userId})},
+			ErrNoAccount, "", 0},
+		{"grant to an unknown user", add, []bson.D{cursorReply(t, "role", editor), cursorReply(t, "user")}, ErrUserNotFound, "", 0},
+		{"revoke", remove, []bson.D{user, writeReply(1), account()}, nil, "$pull", 0},
+		{"revoke a role not held", remove, []bson.D{user, writeReply(0), account()}, nil, "$pull", 0},
+		{"revoke from an unknown user", remove, []bson.D{cursorReply(t, "user")}, ErrUserNotFound, "", 0},
+	}
+	for _, tt := range tests {
+		mt.Run(tt.name, func(mt *mtest.T) {
+			t := mt.T
+			useMock(mt)
+			mt.AddMockResponses(tt.replies...)
+
+			rs, err := tt.op(NewUserService())
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("err %v, want %v", err, tt.wantErr)
+			}
+			updates := sentStatements(mt, "update", "account")
+			if tt.wantOp == "" {
+				if len(updates) > 0 {
+					t.Errorf("account updated %v", updates)
+				}
+				return
+			}
+			if len(rs.Roles) != tt.wantRoles {
+				t.Errorf("returned roles %v, want %d", rs.Roles, tt.wantRoles)
+			}
+
+			// the last update is the grant or revoke, granting first turns a null roles array into an empty one
+			last := updates[len(updates)-1]
+			filter, update := asMap(t, last.Filter), asMap(t, last.Update)
+			if filter["_id"] != accountId {
+				t.Errorf("updated %v, want account %s", filter, accountId.Hex())
+			}
+			switch tt.wantOp {
+			case "$push":
+				// a second copy is never pushed, whatever the permissions of the stored one
+				if !equalM(filter["roles.name"].(bson.M), bson.M{"$ne": "editor"}) {
+					t.Errorf("grant filter %v, want accounts without editor", filter)
+				}
+				if pushed, _ := update["$push"].(bson.M)["roles"].(bson.M); pushed["name"] != "editor" || pushed["_id"] != editor.Id {
+					t.Errorf("pushed %v, want the editor role", update["$push"])
+				}
+			case "$pull":
+				if filter["roles.name"] != "editor" {
+					t.Errorf("revoke filter %v, want accounts with editor", filter)
+				}
+				if pulled, _ := update["$pull"].(bson.M)["roles"].(bson.M); !equalM(pulled, bson.M{"name": "editor"}) {
+					t.Errorf("pulled %v, want editor by name", update["$pull"])
+				}
+			}
+			if update["$set"].(bson.M)["updatedAt"] == nil {
+				t.Errorf("updatedAt not set: %v", update)
+			}
+		})
+	}
+}